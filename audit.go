@@ -0,0 +1,380 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxAuditEntries is how many audit entries are kept in memory, the audit
+// log file keeps them all
+const MaxAuditEntries = 10000
+
+// AuditJSONL is the media type of the audit log export, a JSON entry per line
+const AuditJSONL = "application/x-ndjson"
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry records who made a mutating request and what it did
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	Actor         string    `json:"actor"` // the authenticated subject, anonymous without authentication
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	VMID          *int      `json:"vm_id,omitempty"`
+	PreviousState VMState   `json:"previous_state,omitempty"`
+	NewState      VMState   `json:"new_state,omitempty"`
+	Status        int       `json:"status"`
+	Result        string    `json:"result"` // success or failure
+	SourceIP      string    `json:"source_ip"`
+}
+
+// AuditLog keeps audit entries in memory, appending them to a file if any
+type AuditLog struct {
+	lock    sync.RWMutex
+	entries []AuditEntry
+	file    *os.File // nil to keep them in memory only
+}
+
+// NewAuditLog returns an audit log kept in memory only
+func NewAuditLog() *AuditLog {
+	return &AuditLog{}
+}
+
+// OpenAuditLog returns an audit log appending to filename, creating it if
+// missing, with its latest entries loaded
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading audit log %q: %v", filename, err)
+	}
+	l := NewAuditLog()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping broken line %d of audit log %q", line, filename)
+			continue
+		}
+		l.appendLocked(entry)
+	}
+	if l.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return nil, fmt.Errorf("error opening audit log %q: %v", filename, err)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' { // end the broken line
+		l.file.Write([]byte{'\n'})
+	}
+	return l, nil
+}
+
+// appendLocked keeps the entry in memory, the caller must hold the lock
+func (l *AuditLog) appendLocked(entry AuditEntry) {
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > MaxAuditEntries {
+		l.entries = l.entries[len(l.entries)-MaxAuditEntries:]
+	}
+}
+
+// Record an entry
+func (l *AuditLog) Record(entry AuditEntry) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.appendLocked(entry)
+	if l.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error appending to audit log %q: %v", l.file.Name(), err)
+	}
+	return nil
+}
+
+// Close the log file, if any
+func (l *AuditLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// AuditFilter selects audit entries, zero fields match anything
+type AuditFilter struct {
+	Actor  string
+	Method string
+	VMID   *int
+	Result string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Method == "" || strings.EqualFold(e.Method, f.Method)) &&
+		(f.VMID == nil || (e.VMID != nil && *e.VMID == *f.VMID)) &&
+		(f.Result == "" || e.Result == f.Result) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns the entries matching the filter, oldest first
+func (l *AuditLog) Query(filter AuditFilter) []AuditEntry {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range l.entries {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// parseAuditFilter reads the filter from the query parameters actor,
+// method, vm_id, result, since & until
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{Actor: query.Get("actor"), Method: query.Get("method"), Result: query.Get("result")}
+	if filter.Result != "" && filter.Result != AuditSuccess && filter.Result != AuditFailure {
+		return filter, fmt.Errorf("bad result %q, use %s or %s", filter.Result, AuditSuccess, AuditFailure)
+	}
+	if value := query.Get("vm_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("bad vm_id %q: %v", value, err)
+		}
+		filter.VMID = &id
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return filter, fmt.Errorf("bad %s time, use RFC 3339 like 2026-01-01T10:00:00Z: %v", name, err)
+			}
+		}
+	}
+	return filter, nil
+}
+
+// validRequestID matches the client request ids which are reused
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// setRequestID tags the response with the X-Request-ID of the client, or
+// a new one
+func setRequestID(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		id = randomHex(8)
+	}
+	w.Header().Set("X-Request-ID", id)
+}
+
+// sourceIP returns the IP of the caller of r
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// mutating tells whether the method changes anything
+func mutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// vmPath matches the VM id of a (routed) request path or a Location header
+var vmPath = regexp.MustCompile(`/(?:vms|trash)/(\d+)(/|$)`)
+
+// volumeActionPath matches the volume id of a (routed) volume attach or
+// detach request path, whose VM is in the body or the volume
+var volumeActionPath = regexp.MustCompile(`^/volumes/(\d+)/(?:attach|detach)$`)
+
+// vmIDIn returns the VM id in path, if any
+func vmIDIn(path string) (int, bool) {
+	return idIn(vmPath, path)
+}
+
+// idIn returns the id matched by re in path, if any
+func idIn(re *regexp.Regexp, path string) (int, bool) {
+	m := re.FindStringSubmatch(path)
+	if m == nil {
+		return NoVMID, false
+	}
+	id, err := strconv.Atoi(m[1])
+	return id, err == nil
+}
+
+// attachedVMID returns the id of the VM the volume of a volume attach or
+// detach request path is attached to, if any
+func (s *VMServer) attachedVMID(path string) (int, bool) {
+	volumeID, found := idIn(volumeActionPath, path)
+	if !found {
+		return NoVMID, false
+	}
+	volume, err := s.vmm.InspectVolume(volumeID)
+	if err != nil || volume.VMID == nil {
+		return NoVMID, false
+	}
+	return *volume.VMID, true
+}
+
+// auditedState returns the state of VM id, Deleted if it is in the trash
+// or was purged
+func (s *VMServer) auditedState(id int) (VMState, bool) {
+	if vm, found := s.vmm.Inspect(id); found {
+		return vm.State, true
+	}
+	if s.vmm.Deleted(id) {
+		return DELETED, true
+	}
+	return "", false
+}
+
+// auditWriter records the response status of an audited request
+type auditWriter struct {
+	http.ResponseWriter
+	entry   AuditEntry
+	path    string // routed, to find ids in
+	audited bool   // false until the handler of a self audited endpoint picks it
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.entry.Status == 0 {
+		w.entry.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.entry.Status == 0 {
+		w.entry.Status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses (like GraphQL subscriptions) working
+func (w *auditWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// auditRequest audits the request served by w, for self audited endpoints
+func auditRequest(w http.ResponseWriter) {
+	if aw, ok := w.(*auditWriter); ok {
+		aw.audited = true
+	}
+}
+
+// startAudit wraps w to audit r if it is a mutating request of a non public
+// endpoint, returns nil otherwise
+func (s *VMServer) startAudit(w http.ResponseWriter, r *http.Request, endpoint *EndpointSpec) *auditWriter {
+	if s.audit == nil || endpoint.Public || !mutating(r.Method) {
+		return nil
+	}
+	aw := &auditWriter{ResponseWriter: w, entry: AuditEntry{
+		Time:      time.Now(),
+		RequestID: w.Header().Get("X-Request-ID"),
+		Actor:     "anonymous",
+		Method:    r.Method,
+		Path:      originalPath(r),
+		SourceIP:  sourceIP(r),
+	}, path: r.URL.Path, audited: !endpoint.SelfAudited}
+	id, found := vmIDIn(r.URL.Path)
+	if !found {
+		id, found = s.attachedVMID(r.URL.Path) // detaching
+	}
+	if found {
+		aw.entry.VMID = &id
+		aw.entry.PreviousState, _ = s.auditedState(id)
+	}
+	return aw
+}
+
+// endAudit records the audited request once served
+func (s *VMServer) endAudit(aw *auditWriter, identity Identity) {
+	if !aw.audited {
+		return
+	}
+	entry := aw.entry
+	if identity.Subject != "" {
+		entry.Actor = identity.Subject
+	}
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	entry.Result = AuditSuccess
+	if entry.Status >= http.StatusBadRequest {
+		entry.Result = AuditFailure
+	}
+	if entry.VMID == nil && entry.Status == http.StatusCreated {
+		if id, found := vmIDIn(aw.Header().Get("Location")); found {
+			entry.VMID = &id
+		}
+	}
+	if entry.VMID == nil && entry.Result == AuditSuccess {
+		if id, found := s.attachedVMID(aw.path); found { // attaching
+			entry.VMID = &id
+			entry.PreviousState, _ = s.auditedState(id)
+		}
+	}
+	if entry.VMID != nil {
+		entry.NewState, _ = s.auditedState(*entry.VMID)
+	}
+	if err := s.audit.Record(entry); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *VMServer) listAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	entries := s.audit.Query(filter)
+	if r.URL.Query().Get("format") == "jsonl" || strings.Contains(r.Header.Get("Accept"), AuditJSONL) {
+		w.Header().Set("Content-Type", AuditJSONL)
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+		return
+	}
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, entries)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: entries, Links: map[string]string{"self": versionedPath(r, "/audit")}})
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditOf gets the audit entries of the query as admin
+func auditOf(t *testing.T, s *VMServer, query string) []AuditEntry {
+	t.Helper()
+	w := serveWithHeaders(s, http.MethodGet, "/audit"+query, map[string]string{"X-API-Key": testAPIKey})
+	var entries []AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to get audit: %d %s", w.Code, w.Body.String())
+	}
+	return entries
+}
+
+func TestAudit(t *testing.T) {
+	shrinkTime()
+	s := NewAuthServer(t)
+	w := serveWithHeaders(s, http.MethodPut, "/vms/1/launch", map[string]string{"X-API-Key": testAPIKey, "X-Request-ID": "req-1"})
+	if got := w.Header().Get("X-Request-ID"); got != "req-1" {
+		t.Errorf("got request id: %q, want: %q", got, "req-1")
+	}
+	viewer := "Bearer " + login(t, s, "viewer")
+	w = serveWithHeaders(s, http.MethodDelete, "/vms/2", map[string]string{"Authorization": viewer})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusForbidden)
+	}
+	serveWithHeaders(s, http.MethodGet, "/vms/2", map[string]string{"Authorization": viewer})
+
+	id := GoodID
+	entries := auditOf(t, s, "")
+	if len(entries) != 2 {
+		t.Fatalf("got: %+v, want the launch & delete entries only", entries)
+	}
+	launch := entries[0]
+	launch.Time = time.Time{}
+	want := AuditEntry{RequestID: "req-1", Actor: "ci", Method: http.MethodPut, Path: "/vms/1/launch", VMID: &id,
+		PreviousState: STOPPED, NewState: STARTING, Status: http.StatusOK, Result: AuditSuccess, SourceIP: "192.0.2.1"}
+	if !reflect.DeepEqual(launch, want) {
+		t.Errorf("got: %+v, want: %+v", launch, want)
+	}
+	if got := entries[1]; got.Actor != "viewer" || got.Status != http.StatusForbidden || got.Result != AuditFailure || got.RequestID == "" {
+		t.Errorf("got: %+v, want a failure of the viewer", got)
+	}
+
+	if got := auditOf(t, s, "?result=failure&method=delete"); len(got) != 1 || got[0].Method != http.MethodDelete {
+		t.Errorf("got: %+v, want the delete entry", got)
+	}
+	if got := auditOf(t, s, "?actor=ci&vm_id=1"); len(got) != 1 || got[0].RequestID != "req-1" {
+		t.Errorf("got: %+v, want the launch entry", got)
+	}
+	if got := auditOf(t, s, "?since="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339)); len(got) != 0 {
+		t.Errorf("got: %+v, want no entries", got)
+	}
+	w = serveWithHeaders(s, http.MethodGet, "/audit?vm_id=one", map[string]string{"X-API-Key": testAPIKey})
+	if p := decodeProblem(t, w); p.Code != BadRequest {
+		t.Errorf("got: %v, want: %v", p.Code, BadRequest)
+	}
+	w = serveWithHeaders(s, http.MethodGet, "/audit", map[string]string{"Authorization": viewer})
+	if p := decodeProblem(t, w); p.Code != InsufficientRole {
+		t.Errorf("got: %v, want: %v", p.Code, InsufficientRole)
+	}
+}
+
+func TestAuditCreate(t *testing.T) {
+	s := NewDefaultServer()
+	r := httptest.NewRequest(http.MethodPost, "/vms", strings.NewReader(`{"vcpus":1,"clock":1000,"ram":1024,"storage":10,"network":100}`))
+	if w := serveRequest(s, r); w.Code != http.StatusCreated {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusCreated)
+	}
+	entries := s.audit.Query(AuditFilter{})
+	if len(entries) != 1 || entries[0].VMID == nil || *entries[0].VMID != len(defaultVMs) ||
+		entries[0].NewState != STOPPED || entries[0].Actor != "anonymous" {
+		t.Errorf("got: %+v, want the creation of VM %d by anonymous", entries, len(defaultVMs))
+	}
+}
+
+func TestAuditDeleteAndVolumes(t *testing.T) {
+	defer slowTime()()
+	s := NewDefaultServer()
+	serve(s, http.MethodDelete, "/vms/0")
+	serve(s, http.MethodPost, "/trash/0/restore")
+	serveRequest(s, httptest.NewRequest(http.MethodPost, "/volumes", strings.NewReader(`{"size":10}`)))
+	serveRequest(s, httptest.NewRequest(http.MethodPut, "/volumes/1/attach", strings.NewReader(`{"vm_id":1}`)))
+	s.vmm.ResolveTransitions()
+	serve(s, http.MethodPut, "/volumes/1/detach")
+	s.vmm.ResolveTransitions()
+
+	entries := s.audit.Query(AuditFilter{})
+	if len(entries) != 5 {
+		t.Fatalf("got: %+v, want 5 entries", entries)
+	}
+	for i, want := range []struct {
+		vmID                    *int
+		previousState, newState VMState
+	}{
+		{intPtr(0), STOPPED, DELETED},
+		{intPtr(0), DELETED, STOPPED},
+		{nil, "", ""},
+		{intPtr(GoodID), STOPPED, STOPPED},
+		{intPtr(GoodID), STOPPED, STOPPED},
+	} {
+		got := entries[i]
+		if !reflect.DeepEqual(got.VMID, want.vmID) || got.PreviousState != want.previousState || got.NewState != want.newState {
+			t.Errorf("%s %s got VM %v from %q to %q, want: %+v", got.Method, got.Path, got.VMID, got.PreviousState, got.NewState, want)
+		}
+	}
+}
+
+func TestAuditGraphQL(t *testing.T) {
+	s := NewDefaultServer()
+	postGraphQL(t, s, `{ vms { totalCount } }`, nil)
+	postGraphQL(t, s, `mutation { deleteVM(id: 0) }`, nil)
+	entries := s.audit.Query(AuditFilter{})
+	if len(entries) != 1 || entries[0].Path != "/graphql" || entries[0].Status != http.StatusOK {
+		t.Fatalf("got: %+v, want the mutation only", entries)
+	}
+}
+
+// intPtr returns a pointer to a copy of i
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestAuditExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+	s := NewDefaultServer()
+	if s.audit, err = OpenAuditLog(filename); err != nil {
+		t.Fatal(err)
+	}
+	serve(s, http.MethodDelete, "/vms/0")
+	serve(s, http.MethodDelete, "/vms/0")
+	s.audit.Close()
+
+	w := serve(s, http.MethodGet, "/audit?format=jsonl")
+	if got := w.Header().Get("Content-Type"); got != AuditJSONL {
+		t.Errorf("got Content-Type: %q, want: %q", got, AuditJSONL)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if w.Body.String() != string(data) || strings.Count(string(data), "\n") != 2 {
+		t.Errorf("got export: %q, want the log file: %q", w.Body.String(), data)
+	}
+
+	reopened, err := OpenAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := reopened.Query(AuditFilter{Result: AuditFailure}); len(got) != 1 || got[0].Status != http.StatusNotFound {
+		t.Errorf("got: %+v, want the second delete failed", got)
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeRead allows to list & inspect
+	ScopeRead = "vms:read"
+
+	// ScopeWrite allows to change VMs
+	ScopeWrite = "vms:write"
+)
+
+// AuthJSON default filename of the authentication config
+const AuthJSON = "auth.json"
+
+// AuthRealm is the realm of WWW-Authenticate challenges
+const AuthRealm = "test-vmbackend"
+
+// DefaultTokenTTL is the lifetime of bearer tokens if not configured
+const DefaultTokenTTL = time.Hour
+
+// APIKey is a static API key, sent in the X-API-Key header
+type APIKey struct {
+	Key     string   `json:"key"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+	Roles   []Role   `json:"roles,omitempty"` // by default after the scopes
+}
+
+// User can exchange a username & password for a bearer token,
+// or log in on the OIDC provider
+type User struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Scopes   []string `json:"scopes"`
+	Roles    []Role   `json:"roles,omitempty"` // by default after the scopes
+	Name     string   `json:"name,omitempty"`  // for OIDC profile scope
+	Email    string   `json:"email,omitempty"` // for OIDC email scope
+}
+
+// AuthConfig is the authentication config file format
+type AuthConfig struct {
+	TokenSecret string       `json:"token_secret"` // HMAC key to sign bearer tokens
+	TokenTTL    string       `json:"token_ttl"`    // such as "1h"
+	APIKeys     []APIKey     `json:"api_keys"`
+	Users       []User       `json:"users"`
+	Issuer      string       `json:"issuer,omitempty"`       // OIDC issuer URL, by default the server URL
+	Clients     []OIDCClient `json:"oidc_clients,omitempty"` // empty allows any client & redirect URI
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes"`
+	Method  string   `json:"method"` // api_key, bearer or oidc
+	Roles   []Role   `json:"roles"`
+}
+
+// HasScope checks whether the identity was granted the scope
+func (id Identity) HasScope(scope string) bool {
+	for _, s := range id.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthError is an authentication or authorization failure,
+// with its WWW-Authenticate challenge
+type AuthError struct {
+	Code      ErrorCode
+	Detail    string
+	Challenge string
+}
+
+func (e *AuthError) Error() string {
+	return e.Detail
+}
+
+// Authenticator checks API keys & bearer tokens, and issues the latter
+type Authenticator struct {
+	config AuthConfig
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+	oidc   *OIDCProvider
+}
+
+// NewAuthenticator validates the config and returns its Authenticator
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	if len(config.TokenSecret) < 16 {
+		return nil, fmt.Errorf("token_secret must be at least 16 characters long")
+	}
+	ttl := DefaultTokenTTL
+	if config.TokenTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(config.TokenTTL); err != nil {
+			return nil, fmt.Errorf("bad token_ttl %q: %v", config.TokenTTL, err)
+		}
+	}
+	for _, apiKey := range config.APIKeys {
+		if err := checkRoles(apiKey.Roles); err != nil {
+			return nil, fmt.Errorf("API key of %q: %v", apiKey.Subject, err)
+		}
+	}
+	for _, user := range config.Users {
+		if err := checkRoles(user.Roles); err != nil {
+			return nil, fmt.Errorf("user %q: %v", user.Username, err)
+		}
+	}
+	a := &Authenticator{config: config, secret: []byte(config.TokenSecret), ttl: ttl, now: time.Now}
+	a.oidc = newOIDCProvider(a)
+	return a, nil
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("error reading random bytes: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// defaultAuthConfig generates a config with a random secret & API key
+func defaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		TokenSecret: randomHex(32),
+		TokenTTL:    DefaultTokenTTL.String(),
+		APIKeys: []APIKey{
+			{Key: randomHex(16), Subject: "ci", Scopes: []string{ScopeRead, ScopeWrite}, Roles: []Role{RoleAdmin}},
+		},
+		Users: []User{
+			{Username: "admin", Password: "admin", Scopes: []string{ScopeRead, ScopeWrite}, Roles: []Role{RoleAdmin},
+				Name: "Admin", Email: "admin@example.com"},
+			{Username: "operator", Password: "operator", Scopes: []string{ScopeRead, ScopeWrite}, Roles: []Role{RoleOperator},
+				Name: "Operator", Email: "operator@example.com"},
+			{Username: "viewer", Password: "viewer", Scopes: []string{ScopeRead}, Roles: []Role{RoleViewer},
+				Name: "Viewer", Email: "viewer@example.com"},
+		},
+	}
+}
+
+// loadAuthConfig loads the authentication config from a JSON file,
+// generating a default one if missing
+func loadAuthConfig(filename string) (AuthConfig, error) {
+	var config AuthConfig
+	log.Printf("Loading authentication config from local file %q", filename)
+	_, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Missing %q, generating one...", filename)
+		config = defaultAuthConfig()
+		configJSON, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return config, fmt.Errorf("error writing JSON for %q: %v", filename, err)
+		}
+		if err := ioutil.WriteFile(filename, configJSON, 0600); err != nil {
+			return config, fmt.Errorf("error generating default %q: %v", filename, err)
+		}
+		log.Printf("Tip: You can tweak %q adding API keys or users for next run.", filename)
+		return config, nil
+	} else if err != nil {
+		return config, fmt.Errorf("error stating %q: %v", filename, err)
+	}
+	configJSON, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, fmt.Errorf("error reading %q: %v", filename, err)
+	}
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return config, fmt.Errorf("error JSON-parsing %q: %v", filename, err)
+	}
+	return config, nil
+}
+
+// challenge returns a WWW-Authenticate Bearer challenge with the given
+// error attributes, such as `error="invalid_token"`
+func challenge(attributes ...string) string {
+	return strings.Join(append([]string{fmt.Sprintf(`Bearer realm="%s"`, AuthRealm)}, attributes...), ", ")
+}
+
+// unauthenticated returns a 401 AuthError
+func unauthenticated(detail string, attributes ...string) *AuthError {
+	return &AuthError{Code: Unauthenticated, Detail: detail, Challenge: challenge(attributes...)}
+}
+
+// Authenticate finds the Identity of the request caller, out of its
+// X-API-Key header or Authorization bearer token
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		for _, apiKey := range a.config.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey.Key)) == 1 {
+				return Identity{
+					Subject: apiKey.Subject,
+					Scopes:  apiKey.Scopes,
+					Method:  "api_key",
+					Roles:   rolesOf(apiKey.Roles, apiKey.Scopes),
+				}, nil
+			}
+		}
+		return Identity{}, unauthenticated("invalid API key")
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return Identity{}, unauthenticated("missing credentials, use an X-API-Key header or a bearer token")
+	}
+	const prefix = "bearer "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return Identity{}, unauthenticated("unsupported authorization scheme, use Bearer",
+			`error="invalid_request"`)
+	}
+	token := strings.TrimSpace(authorization[len(prefix):])
+	method := "bearer"
+	var claims Claims
+	err := decodeJWT(token, &claims, func(header jwtHeader, input, signature []byte) error {
+		if header.Algorithm == "RS256" {
+			method = "oidc"
+			return a.oidc.verifyAccessToken(header, input, signature)
+		}
+		return hs256(a.secret).verify(header, input, signature)
+	})
+	if err == nil {
+		err = claims.validAt(a.now())
+	}
+	if err != nil {
+		return Identity{}, unauthenticated(err.Error(),
+			`error="invalid_token"`, fmt.Sprintf(`error_description=%q`, err.Error()))
+	}
+	scopes := strings.Fields(claims.Scope)
+	return Identity{Subject: claims.Subject, Scopes: scopes, Method: method, Roles: rolesOf(claims.Roles, scopes)}, nil
+}
+
+// authorizeScope checks the identity has been granted scope
+func authorizeScope(identity Identity, scope string) error {
+	if identity.HasScope(scope) {
+		return nil
+	}
+	return &AuthError{
+		Code:      InsufficientScope,
+		Detail:    fmt.Sprintf("%s lacks the %q scope", identity.Subject, scope),
+		Challenge: challenge(`error="insufficient_scope"`, fmt.Sprintf("scope=%q", scope)),
+	}
+}
+
+// TokenResponse is the OAuth2 style response of the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"` // OIDC only
+}
+
+// checkPassword returns the user with those credentials, if any
+func (a *Authenticator) checkPassword(username, password string) (User, bool) {
+	for _, user := range a.config.Users {
+		if subtle.ConstantTimeCompare([]byte(username), []byte(user.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) == 1 {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// user finds a user by username
+func (a *Authenticator) user(username string) (User, bool) {
+	for _, user := range a.config.Users {
+		if user.Username == username {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// IssueToken returns a bearer token for the user credentials
+func (a *Authenticator) IssueToken(username, password string) (TokenResponse, error) {
+	user, ok := a.checkPassword(username, password)
+	if !ok {
+		return TokenResponse{}, &AuthError{Code: InvalidCredentials, Detail: "invalid username or password"}
+	}
+	now := a.now()
+	claims := Claims{
+		Issuer:    AuthRealm,
+		Subject:   user.Username,
+		Scope:     strings.Join(user.Scopes, " "),
+		Roles:     rolesOf(user.Roles, user.Scopes),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.ttl).Unix(),
+	}
+	token, err := signHS256(claims, a.secret)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(a.ttl.Seconds()),
+		Scope:       claims.Scope,
+	}, nil
+}
+
+// authorize checks the identity has the scope & role needed by the method
+func authorize(identity Identity, m MethodSpec) error {
+	scope := m.Scope
+	if scope == "" {
+		scope = requiredScope(m.Method)
+	}
+	if err := authorizeScope(identity, scope); err != nil {
+		return err
+	}
+	return authorizeRole(identity, m.Role)
+}
+
+// requiredScope returns the scope needed for a request method
+func requiredScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+const identityKey contextKey = "identity"
+
+const authenticationKey contextKey = "authentication"
+
+// authentication is the outcome of authenticating a request, kept in its
+// context not to authenticate it again
+type authentication struct {
+	identity Identity
+	err      error
+}
+
+// Authenticating wraps next to authenticate requests once, up front, so
+// the middlewares (like the rate limiter) and the endpoints share the outcome
+func (s *VMServer) Authenticating(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth != nil {
+			identity, err := s.auth.Authenticate(r)
+			r = r.WithContext(context.WithValue(r.Context(), authenticationKey, authentication{identity, err}))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticated returns the caller of r, as authenticated up front if it was
+func (s *VMServer) authenticated(r *http.Request) (Identity, error) {
+	if outcome, ok := r.Context().Value(authenticationKey).(authentication); ok {
+		return outcome.identity, outcome.err
+	}
+	return s.auth.Authenticate(r)
+}
+
+// withIdentity returns a request carrying the identity of its caller
+func withIdentity(r *http.Request, identity Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey, identity))
+}
+
+// identityOf returns the authenticated caller of the request, if any
+func identityOf(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey).(Identity)
+	return identity, ok
+}
+
+// writeAuthError dumps an authentication error with its challenge
+func writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	var aerr *AuthError
+	if !errors.As(err, &aerr) {
+		writeError(w, r, err)
+		return
+	}
+	if aerr.Challenge != "" {
+		w.Header().Set("WWW-Authenticate", aerr.Challenge)
+	}
+	writeProblem(w, r, NewProblem(aerr.Code, aerr.Detail))
+}
+
+// token exchanges user credentials, as JSON or form, for a bearer token
+func (s *VMServer) token(w http.ResponseWriter, r *http.Request) {
+	if s.auth == nil {
+		writeProblem(w, r, NewProblem(AuthDisabled, "authentication is disabled, run with -auth to enable it"))
+		return
+	}
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON credentials: %v", err)))
+			return
+		}
+	} else {
+		credentials.Username, credentials.Password = r.PostFormValue("username"), r.PostFormValue("password")
+	}
+	token, err := s.auth.IssueToken(credentials.Username, credentials.Password)
+	if err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusOK, token)
+}
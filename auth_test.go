@@ -0,0 +1,164 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "0123456789abcdef"
+
+var testAuthConfig = AuthConfig{
+	TokenSecret: "a test secret, long enough",
+	TokenTTL:    "10m",
+	APIKeys:     []APIKey{{Key: testAPIKey, Subject: "ci", Scopes: []string{ScopeRead, ScopeWrite}}},
+	Users: []User{
+		{Username: "admin", Password: "secret", Scopes: []string{ScopeRead, ScopeWrite}},
+		{Username: "operator", Password: "secret", Scopes: []string{ScopeRead, ScopeWrite}, Roles: []Role{RoleOperator}},
+		{Username: "viewer", Password: "secret", Scopes: []string{ScopeRead}, Name: "Viewer", Email: "viewer@example.com"},
+	},
+}
+
+func NewAuthServer(t *testing.T) *VMServer {
+	auth, err := NewAuthenticator(testAuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewDefaultServer()
+	s.auth = auth
+	return s
+}
+
+// serveWithHeaders runs a request with the given headers against the server
+func serveWithHeaders(s *VMServer, method, url string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return serveRequest(s, r)
+}
+
+// login gets a bearer token for the user through the token endpoint
+func login(t *testing.T, s *VMServer, username string) string {
+	t.Helper()
+	body := `{"username":"` + username + `","password":"secret"}`
+	r := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := serveRequest(s, r)
+	var token TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to login as %s: %d %s", username, w.Code, w.Body.String())
+	}
+	if token.TokenType != "Bearer" || token.ExpiresIn != 600 {
+		t.Fatalf("got token: %+v", token)
+	}
+	return token.AccessToken
+}
+
+func TestAuthDisabledByDefault(t *testing.T) {
+	if w := serve(NewDefaultServer(), http.MethodGet, "/vms"); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	w := serve(NewDefaultServer(), http.MethodPost, "/auth/token")
+	if p := decodeProblem(t, w); p.Code != AuthDisabled {
+		t.Fatalf("got: %+v, want code: %v", p, AuthDisabled)
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	s := NewAuthServer(t)
+	w := serveWithHeaders(s, http.MethodGet, "/vms", map[string]string{"X-API-Key": testAPIKey})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	w = serveWithHeaders(s, http.MethodGet, "/vms", map[string]string{"X-API-Key": "bad"})
+	if p := decodeProblem(t, w); p.Code != Unauthenticated || p.Status != http.StatusUnauthorized {
+		t.Fatalf("got: %+v, want code: %v", p, Unauthenticated)
+	}
+}
+
+func TestMissingCredentials(t *testing.T) {
+	w := serve(NewAuthServer(t), http.MethodGet, "/vms")
+	if p := decodeProblem(t, w); p.Code != Unauthenticated {
+		t.Fatalf("got: %+v, want code: %v", p, Unauthenticated)
+	}
+	if got, want := w.Header().Get("WWW-Authenticate"), `Bearer realm="test-vmbackend"`; got != want {
+		t.Fatalf("got WWW-Authenticate: %q, want: %q", got, want)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	s := NewAuthServer(t)
+	token := login(t, s, "viewer")
+	bearer := map[string]string{"Authorization": "Bearer " + token}
+	if w := serveWithHeaders(s, http.MethodGet, "/vms/1", bearer); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	w := serveWithHeaders(s, http.MethodPut, "/vms/1/launch", bearer)
+	if p := decodeProblem(t, w); p.Code != InsufficientScope || p.Status != http.StatusForbidden {
+		t.Fatalf("got: %+v, want code: %v", p, InsufficientScope)
+	}
+	want := `Bearer realm="test-vmbackend", error="insufficient_scope", scope="vms:write"`
+	if got := w.Header().Get("WWW-Authenticate"); got != want {
+		t.Fatalf("got WWW-Authenticate: %q, want: %q", got, want)
+	}
+
+	token = login(t, s, "admin")
+	bearer = map[string]string{"Authorization": "Bearer " + token}
+	if w := serveWithHeaders(s, http.MethodPut, "/vms/1/launch", bearer); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestBadTokens(t *testing.T) {
+	s := NewAuthServer(t)
+	expired, err := signHS256(Claims{Subject: "admin", Scope: ScopeRead, ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+		[]byte(testAuthConfig.TokenSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := signHS256(Claims{Subject: "admin", Scope: ScopeRead}, []byte("another secret, long enough"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, want := range map[string]string{
+		expired: `Bearer realm="test-vmbackend", error="invalid_token", error_description="token expired"`,
+		forged:  `Bearer realm="test-vmbackend", error="invalid_token", error_description="invalid token signature"`,
+		"x.y":   `Bearer realm="test-vmbackend", error="invalid_token", error_description="malformed token"`,
+	} {
+		w := serveWithHeaders(s, http.MethodGet, "/vms", map[string]string{"Authorization": "Bearer " + token})
+		if got := w.Header().Get("WWW-Authenticate"); w.Code != http.StatusUnauthorized || got != want {
+			t.Fatalf("got status: %d, WWW-Authenticate: %q, want: %q", w.Code, got, want)
+		}
+	}
+}
+
+func TestBadLogin(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader("username=admin&password=wrong"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serveRequest(NewAuthServer(t), r)
+	if p := decodeProblem(t, w); p.Code != InvalidCredentials {
+		t.Fatalf("got: %+v, want code: %v", p, InvalidCredentials)
+	}
+}
+
+func TestGraphQLMutationScope(t *testing.T) {
+	s := NewAuthServer(t)
+	token := login(t, s, "viewer")
+	for query, want := range map[string]int{
+		`{"query":"{ vm(id: 1) { id } }"}`:                   http.StatusOK,
+		`{"query":"mutation { launchVM(id: 1) { state } }"}`: http.StatusForbidden,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(query))
+		r.Header.Set("Authorization", "Bearer "+token)
+		if w := serveRequest(s, r); w.Code != want {
+			t.Fatalf("%s got status: %d, want: %d", query, w.Code, want)
+		}
+	}
+}
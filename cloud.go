@@ -4,34 +4,63 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"sync"
 	"time"
 )
 
 // Cloud can perform concurrent-safe operations on a bunch of VMs:
-// List all VMs, inspect a VM, start/stop a VM or remove it from the list
+// List all VMs, inspect a VM, start/stop a VM or remove it from the list.
+// The VMs are kept in a Store, the lock serializes the operations on them.
 type Cloud struct {
-	lock sync.RWMutex
-	vms  VMs
+	lock     sync.RWMutex
+	store    Store
+	projects []Project
+	events   broadcaster
+	onChange func()        // called on every mutation with the lock held, must not block
+	onEvent  func(VMEvent) // called on every VM event with the lock held, must not block
+	reloads  []ReloadReport
+	history  []VMEvent // since StartHistory
+
+	trash          VMs              // deleted VMs until purged
+	purged         map[int]bool     // ids of the purged VMs, never reused
+	retention      time.Duration    // of the deleted VMs in the trash, 0 purges them right away
+	snapshots      map[int]Snapshot // by snapshot id
+	lastSnapshotID int              // last snapshot id given, never reused
+	volumes        map[int]Volume   // by volume id
+	lastVolumeID   int              // last volume id given, never reused
+
+	pendingLock sync.Mutex
+	pending     map[*pendingTransition]struct{}
+}
+
+// Subscribe to VM changes on this Cloud.
+// The return includes a function to cancel the subscription.
+func (c *Cloud) Subscribe() (<-chan VMEvent, func()) {
+	return c.events.subscribe()
+}
+
+// CloseSubscriptions ends the current & future subscriptions to VM changes,
+// returning how many were ended
+func (c *Cloud) CloseSubscriptions() int {
+	return c.events.close()
 }
 
 // List the VMs handled under this Cloud
 func (c *Cloud) List() VMs {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	return c.vms.clone()
+	vms, now := c.store.List(), time.Now()
+	transitions := c.transitions()
+	for id, vm := range vms {
+		vms[id] = vm.withUptime(now).withProgress(transitions[id], now)
+	}
+	return vms
 }
 
 // Inspect a VM data by id (might not find it and return nil)
 func (c *Cloud) Inspect(id int) (VM, bool) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	vm, found := c.vms[id]
-	return vm, found
+	vm, found := c.store.Get(id)
+	now := time.Now()
+	return vm.withUptime(now).withProgress(c.transitions()[id], now), found
 }
 
 // Launch a VM by id.
@@ -41,7 +70,7 @@ func (c *Cloud) Launch(id int) (chan struct{}, error) {
 	if err := c.setVMState(id, STARTING); err != nil {
 		return nil, err
 	}
-	return c.delayedTransition(id, RUNNING, StartDelay), nil
+	return c.delayedTransition(id, RUNNING, StartDelay, nil), nil
 }
 
 // Stop a VM by id.
@@ -51,55 +80,294 @@ func (c *Cloud) Stop(id int) (chan struct{}, error) {
 	if err := c.setVMState(id, STOPPING); err != nil {
 		return nil, err
 	}
-	return c.delayedTransition(id, STOPPED, StopDelay), nil
+	return c.delayedTransition(id, STOPPED, StopDelay, nil), nil
+}
+
+// Reboot a VM by id, stopping it and launching it again.
+// The return includes a channel to optionally check completion of the whole
+// reboot process, apart from a possible error stopping the VM.
+func (c *Cloud) Reboot(id int) (chan struct{}, error) {
+	if err := c.setVMState(id, STOPPING); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	c.delayedTransition(id, STOPPED, StopDelay, func() {
+		launched, err := c.Launch(id)
+		if err != nil {
+			log.Printf("reboot error: %v", err)
+			close(done)
+			return
+		}
+		go func() {
+			<-launched
+			close(done) // signal reboot completion
+		}()
+	})
+	return done, nil
+}
+
+// Create a new VM with the given hardware spec, project & deletion
+// protection, always Stopped.
+// Returns the new VM id, or a CloudError if the spec or project are invalid
+// or the project quota is exceeded.
+func (c *Cloud) Create(spec VM) (int, error) {
+	if err := spec.Validate(); err != nil {
+		return NoVMID, &CloudError{Code: InvalidVM, ID: NoVMID, Err: err}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.findProjectLocked(spec.ProjectID()); !found {
+		return NoVMID, cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", spec.ProjectID())
+	}
+	requested := Usage{VCPUS: spec.VCPUS, RAM: spec.RAM, Storage: spec.Storage, VMs: 1}
+	if err := c.checkQuotaLocked(spec.ProjectID(), NoVMID, requested); err != nil {
+		return NoVMID, err
+	}
+	if spec.Project == DefaultProjectID {
+		spec.Project = "" // VMs without project belong to the default one
+	}
+	id := c.nextIDLocked()
+	spec = VM{VCPUS: spec.VCPUS, Clock: spec.Clock, RAM: spec.RAM, Storage: spec.Storage, Network: spec.Network,
+		State: STOPPED, Project: spec.Project, Protected: spec.Protected}.stamped(time.Now())
+	if err := c.store.Put(id, spec); err != nil {
+		return NoVMID, err
+	}
+	c.notify(VMCreated, id, spec)
+	return id, nil
+}
+
+// Resize a Stopped VM by id to the non-zero hardware fields of spec.
+// A CloudError is returned if the VM is missing or not Stopped, the new
+// spec is invalid or the project quota is exceeded.
+func (c *Cloud) Resize(id int, spec VM) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vm, found := c.store.Get(id)
+	if !found {
+		return cloudErrorf(VMNotFound, id, "resize error: not found VM %d", id)
+	}
+	if vm.State != STOPPED {
+		return cloudErrorf(VMNotStopped, id,
+			"resize error: VM %d must be in state %v for resizing but it is %v", id, STOPPED, vm.State)
+	}
+	resized := vm
+	for field, value := range map[*int]int{
+		&resized.VCPUS: spec.VCPUS, &resized.RAM: spec.RAM, &resized.Storage: spec.Storage, &resized.Network: spec.Network,
+	} {
+		if value != 0 {
+			*field = value
+		}
+	}
+	if spec.Clock != 0 {
+		resized.Clock = spec.Clock
+	}
+	if err := resized.Validate(); err != nil {
+		return &CloudError{Code: InvalidVM, ID: id, Err: err}
+	}
+	requested := Usage{VCPUS: resized.VCPUS - vm.VCPUS, RAM: resized.RAM - vm.RAM, Storage: resized.Storage - vm.Storage}
+	if err := c.checkQuotaLocked(vm.ProjectID(), id, requested); err != nil {
+		return err
+	}
+	if resized == vm {
+		return nil
+	}
+	now := time.Now()
+	resized.UpdatedAt = &now
+	if err := c.store.Put(id, resized); err != nil {
+		return err
+	}
+	c.notify(VMResized, id, resized)
+	return nil
+}
+
+// Protect VM by id from deletion, or clear its protection.
+// Returns the VM, or a CloudError if it is missing.
+func (c *Cloud) Protect(id int, protected bool) (VM, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vm, found := c.store.Get(id)
+	if !found {
+		return VM{}, c.notFoundLocked(id, "update error: not found VM %d", id)
+	}
+	if vm.Protected == protected {
+		return vm, nil
+	}
+	now := time.Now()
+	vm.Protected, vm.UpdatedAt = protected, &now
+	if err := c.store.Put(id, vm); err != nil {
+		return VM{}, err
+	}
+	c.notify(VMUpdated, id, vm)
+	return vm, nil
 }
 
-// Delete VM by id.
-// An error is returned if the VM is missing or not in the Stopped state.
+// Delete VM by id, moving it to the trash.
+// A CloudError is returned if the VM is missing, protected, not in the
+// Stopped state or has volumes attached.
 func (c *Cloud) Delete(id int) error {
+	return c.delete(id, false)
+}
+
+// ForceDelete VM by id like Delete, detaching its volumes first
+func (c *Cloud) ForceDelete(id int) error {
+	return c.delete(id, true)
+}
+
+func (c *Cloud) delete(id int, force bool) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	vm, found := c.vms[id]
+	vm, found := c.store.Get(id)
 	if !found {
-		return fmt.Errorf("delete error: not found VM %d", id)
+		return c.notFoundLocked(id, "delete error: not found VM %d", id)
+	}
+	if vm.Protected {
+		return cloudErrorf(VMProtected, id,
+			"delete error: VM %d is protected, clear its protection with PATCH {\"protected\":false} first", id)
 	}
 	if vm.State != STOPPED {
-		return fmt.Errorf("delete error: VM %d must be in state %v for deletion but it is %v", id, STOPPED, vm.State)
+		return cloudErrorf(VMNotStopped, id,
+			"delete error: VM %d must be in state %v for deletion but it is %v", id, STOPPED, vm.State)
+	}
+	if attached := len(c.attachedVolumesLocked(id)); attached > 0 && !force {
+		return cloudErrorf(VMHasVolumes, id,
+			"delete error: VM %d has %d volumes attached, detach them or force the deletion", id, attached)
 	}
-	delete(c.vms, id)
+	if err := c.store.Delete(id); err != nil {
+		return err
+	}
+	c.detachVolumesLocked(id)
+	c.trashLocked(id, vm)
 	return nil
 }
 
+// pendingTransition is a delayed transition waiting for its timer
+type pendingTransition struct {
+	once  sync.Once
+	run   func()
+	id    int
+	state VMState // the end state of a VM, empty for the transitions of other resources
+	start time.Time
+	delay time.Duration
+}
+
+// fire runs the transition unless it ran already, telling whether it did
+func (p *pendingTransition) fire() bool {
+	fired := false
+	p.once.Do(func() {
+		fired = true
+		p.run()
+	})
+	return fired
+}
+
 // delayedTransition set ups a timer in the background to move the VM
-// identified by the given id to state after the given delay has passed.
+// identified by the given id to state after the given delay has passed,
+// then calls then (if not nil) to chain further transitions.
 // Uses setVMState internally to handle a safe concurrent delayed transition.
-func (c *Cloud) delayedTransition(id int, state VMState, delay time.Duration) chan struct{} {
-	done := make(chan struct{})
-	time.AfterFunc(delay, func() {
+func (c *Cloud) delayedTransition(id int, state VMState, delay time.Duration, then func()) chan struct{} {
+	return c.schedule(&pendingTransition{id: id, state: state, delay: delay}, func() {
 		if err := c.setVMState(id, state); err != nil {
 			log.Println(err)
 		}
-		close(done) // signal delayed transition completion
+		if then != nil {
+			then()
+		}
 	})
+}
+
+// schedule runs transition in the background after the delay of p, keeping
+// p pending until then. Returns a channel closed once it ran.
+func (c *Cloud) schedule(p *pendingTransition, transition func()) chan struct{} {
+	done := make(chan struct{})
+	p.start = time.Now()
+	p.run = func() {
+		transition()
+		c.pendingLock.Lock()
+		delete(c.pending, p)
+		c.pendingLock.Unlock()
+		close(done) // signal delayed transition completion
+	}
+	c.pendingLock.Lock()
+	if c.pending == nil {
+		c.pending = make(map[*pendingTransition]struct{})
+	}
+	c.pending[p] = struct{}{}
+	c.pendingLock.Unlock()
+	time.AfterFunc(p.delay, func() { p.fire() })
 	return done
 }
 
+// ResolveTransitions runs the pending delayed transitions right away,
+// including the ones they chain (like the launch of a reboot).
+// Returns how many transitions were run.
+func (c *Cloud) ResolveTransitions() int {
+	resolved := 0
+	for {
+		c.pendingLock.Lock()
+		pending := make([]*pendingTransition, 0, len(c.pending))
+		for p := range c.pending {
+			pending = append(pending, p)
+		}
+		c.pendingLock.Unlock()
+		if len(pending) == 0 {
+			return resolved
+		}
+		for _, p := range pending {
+			if p.fire() {
+				resolved++
+			}
+		}
+	}
+}
+
 // setVMState sets the VM identified by the given id to the given state.
-// Might fail if the VM transition requested is illegal.
+// Might fail with a CloudError if the VM is missing, the transition
+// requested is illegal or starting it exceeds the project running VMs quota.
 // Do it in a locked transaction
 func (c *Cloud) setVMState(id int, state VMState) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	vm, found := c.vms[id]
+	vm, found := c.store.Get(id)
 	if !found {
-		return fmt.Errorf("not found VM with id %d", id)
+		return cloudErrorf(VMNotFound, id, "not found VM with id %d", id)
 	}
 	mutatedVM, err := vm.WithState(state)
+	if err != nil {
+		return &CloudError{Code: IllegalTransition, ID: id, Err: err}
+	}
+	if vm.State == STOPPED && mutatedVM.State == STARTING {
+		if err := c.checkQuotaLocked(vm.ProjectID(), id, Usage{RunningVMs: 1}); err != nil {
+			return err
+		}
+	}
+	if mutatedVM.State == vm.State {
+		return nil
+	}
+	now := time.Now()
+	mutatedVM.UpdatedAt, mutatedVM.LastStateChangeAt = &now, &now
+	if mutatedVM.State == STARTING {
+		mutatedVM.LaunchedAt = &now
+	}
+	swapped, err := c.store.CompareAndSwap(id, vm, mutatedVM)
 	if err != nil {
 		return err
 	}
-	c.vms[id] = mutatedVM
+	if !swapped { // written to the store behind this Cloud
+		return cloudErrorf(IllegalTransition, id, "VM %d changed while moving it to %v, retry", id, state)
+	}
+	c.notify(VMStateChanged, id, mutatedVM)
 	return nil
 }
+
+// notify subscribers about a change on VM id
+func (c *Cloud) notify(eventType VMEventType, id int, vm VM) {
+	event := VMEvent{Type: eventType, ID: id, VM: vm, Time: time.Now()}
+	c.record(event)
+	c.events.publish(event)
+	c.changed()
+}
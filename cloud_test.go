@@ -4,6 +4,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -22,7 +23,7 @@ const (
 )
 
 func NewDefaultCloud() Cloud {
-	return Cloud{vms: defaultVMs.clone()}
+	return Cloud{store: NewMemoryStore(defaultVMs.clone()), retention: DefaultTrashRetention}
 }
 
 // copyInState gets a copy of the VM identified by id from cloud,
@@ -42,14 +43,23 @@ func forceState(cloud *Cloud, id int, state VMState) error {
 	if err != nil {
 		return err
 	}
-	cloud.vms[id] = vm
-	return nil
+	return cloud.store.Put(id, vm)
+}
+
+// withoutTimes returns the VM without its timestamps & progress, to compare
+// VMs changed at unknown times
+func withoutTimes(vm VM) VM {
+	vm.CreatedAt, vm.UpdatedAt, vm.LastStateChangeAt, vm.LaunchedAt, vm.DeletedAt, vm.UptimeSeconds = nil, nil, nil, nil, nil, 0
+	vm.Progress = nil
+	return vm
 }
 
 // shrinkTime sets up shorter delays so that test can go faster
 func shrinkTime() {
 	StartDelay = 10 * time.Millisecond
 	StopDelay = 5 * time.Millisecond
+	SnapshotDelay = 5 * time.Millisecond
+	AttachDelay, DetachDelay = 5*time.Millisecond, 5*time.Millisecond
 }
 
 // waitDone waits for a done channel to finish or a timeout to occur
@@ -100,7 +110,7 @@ func TestLaunch(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to Launch VM %d: %v", GoodID, err)
 	}
-	if got, _ := c.Inspect(GoodID); got != want {
+	if got, _ := c.Inspect(GoodID); withoutTimes(got) != want {
 		t.Fatalf("got: %s, want: %s", got, want)
 	}
 	// Wait and test 2nd transition
@@ -149,7 +159,7 @@ func TestStop(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to Stop VM %d: %v", GoodID, err)
 	}
-	if got, _ := c.Inspect(GoodID); got != want {
+	if got, _ := c.Inspect(GoodID); withoutTimes(got) != want {
 		t.Fatalf("got: %v, want: %v", got, want)
 	}
 	// Wait and test 2nd transition
@@ -203,7 +213,7 @@ func TestReDelete(t *testing.T) {
 	if err := c.Delete(GoodID); err != nil {
 		t.Fatalf("Unexpected deletion error: %v", err)
 	}
-	want := fmt.Sprintf("delete error: not found VM %d", GoodID)
+	want := fmt.Sprintf("delete error: not found VM %d, it is in the trash until restored or purged", GoodID)
 	if got := c.Delete(GoodID); got == nil || got.Error() != want {
 		t.Fatalf("got: %q, want: %q", got, want)
 	}
@@ -218,3 +228,163 @@ func TestBadStateDelete(t *testing.T) {
 		t.Fatalf("got: %q, want: %q", got, want)
 	}
 }
+
+func TestProtectedDelete(t *testing.T) {
+	c := NewDefaultCloud()
+	if _, err := c.Protect(GoodID, true); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *CloudError
+	if err := c.Delete(GoodID); !errors.As(err, &cerr) || cerr.Code != VMProtected {
+		t.Fatalf("got: %v, want: %v", err, VMProtected)
+	}
+	vm, err := c.Protect(GoodID, false)
+	if err != nil || vm.Protected {
+		t.Fatalf("got: %v %v, want VM %d unprotected", vm, err, GoodID)
+	}
+	if err := c.Delete(GoodID); err != nil {
+		t.Fatalf("Unexpected deletion error: %v", err)
+	}
+	if _, err := c.Protect(BadID, true); err == nil {
+		t.Fatalf("got no error protecting VM %d", BadID)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	c := NewDefaultCloud()
+	codeOf := func(err error) ErrorCode {
+		var cerr *CloudError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("got: %v, want a CloudError", err)
+		}
+		return cerr.Code
+	}
+	if _, err := c.Launch(BadID); codeOf(err) != VMNotFound {
+		t.Fatalf("got: %v, want: %v", codeOf(err), VMNotFound)
+	}
+	if _, err := c.Stop(GoodID); codeOf(err) != IllegalTransition {
+		t.Fatalf("got: %v, want: %v", codeOf(err), IllegalTransition)
+	}
+	forceState(&c, GoodID, RUNNING)
+	if err := c.Delete(GoodID); codeOf(err) != VMNotStopped {
+		t.Fatalf("got: %v, want: %v", codeOf(err), VMNotStopped)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	c := NewDefaultCloud()
+	spec := VM{VCPUS: 8, Clock: 2400, RAM: 16384, Storage: 1024, Network: 10000, State: RUNNING}
+	id, err := c.Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != len(defaultVMs) {
+		t.Fatalf("got id: %d, want: %d", id, len(defaultVMs))
+	}
+	want := spec
+	want.State = STOPPED
+	if got, _ := c.Inspect(id); withoutTimes(got) != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	id, err := c.Create(VM{VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, _ := c.Inspect(id)
+	if created.CreatedAt == nil || *created.UpdatedAt != *created.CreatedAt || created.LaunchedAt != nil {
+		t.Fatalf("got: %v, want created, updated & state changed now", created)
+	}
+
+	done, err := c.Launch(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	starting, _ := c.Inspect(id)
+	if starting.LaunchedAt == nil || *starting.LaunchedAt != *starting.LastStateChangeAt ||
+		*starting.CreatedAt != *created.CreatedAt || !starting.UpdatedAt.After(*created.UpdatedAt) {
+		t.Fatalf("got: %v, want launched now", starting)
+	}
+	if err := waitDone(done, 10*StartDelay); err != nil {
+		t.Fatal(err)
+	}
+	running, _ := c.Inspect(id)
+	if *running.LaunchedAt != *starting.LaunchedAt || !running.LastStateChangeAt.After(*starting.LastStateChangeAt) {
+		t.Fatalf("got: %v, want Running since now", running)
+	}
+
+	vm, _ := c.store.Get(id)
+	hourAgo := time.Now().Add(-time.Hour)
+	vm.LastStateChangeAt = &hourAgo
+	c.store.Put(id, vm)
+	if got, _ := c.Inspect(id); got.UptimeSeconds != 3600 {
+		t.Errorf("got uptime: %v, want: %v", got.UptimeSeconds, 3600)
+	}
+	if stored, _ := c.store.Get(id); stored.UptimeSeconds != 0 {
+		t.Errorf("got stored uptime: %v, want it computed on read only", stored.UptimeSeconds)
+	}
+}
+
+func TestBadCreate(t *testing.T) {
+	c := NewDefaultCloud()
+	want := "invalid VM spec: vcpus must be positive, got 0"
+	if _, got := c.Create(VM{Clock: 1, RAM: 1, Storage: 1, Network: 1}); got == nil || got.Error() != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	events, cancel := c.Subscribe()
+	defer cancel()
+	done, err := c.Launch(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(done, 10*StartDelay); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []VMState{STARTING, RUNNING} {
+		got := <-events
+		if got.Type != VMStateChanged || got.ID != GoodID || got.VM.State != want {
+			t.Fatalf("got: %+v, want %v change of VM %d", got, want, GoodID)
+		}
+	}
+	cancel()
+	if _, open := <-events; open {
+		t.Fatalf("got open events channel after cancel")
+	}
+}
+
+func TestReboot(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	forceState(&c, GoodID, RUNNING)
+	events, cancel := c.Subscribe()
+	defer cancel()
+	done, err := c.Reboot(GoodID)
+	if err != nil {
+		t.Fatalf("Failed to Reboot VM %d: %v", GoodID, err)
+	}
+	if err := waitDone(done, 10*(StopDelay+StartDelay)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []VMState{STOPPING, STOPPED, STARTING, RUNNING} {
+		if got := <-events; got.VM.State != want {
+			t.Fatalf("got: %v, want: %v", got.VM.State, want)
+		}
+	}
+}
+
+func TestBadStateReboot(t *testing.T) {
+	c := NewDefaultCloud()
+	want := fmt.Sprintf("illegal transition from %q to %q", STOPPED, STOPPING)
+	if _, got := c.Reboot(GoodID); got == nil || got.Error() != want {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures Cross-Origin Resource Sharing for browser clients
+type CORSConfig struct {
+	AllowedOrigins   []string      // "*" allows any origin
+	AllowedMethods   []string      // empty allows the methods of each endpoint
+	AllowedHeaders   []string      // empty allows any header requested
+	ExposedHeaders   []string      // response headers readable by scripts
+	AllowCredentials bool          // allow cookies & Authorization
+	MaxAge           time.Duration // for browsers to cache preflight responses
+}
+
+// DefaultCORSConfig allows any origin to use the whole API
+var DefaultCORSConfig = CORSConfig{
+	AllowedOrigins: []string{"*"},
+	MaxAge:         10 * time.Minute,
+	ExposedHeaders: []string{"API-Version", "Deprecation", "Link", "WWW-Authenticate",
+		"Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Request-ID"},
+}
+
+// listFlag is a comma separated list flag value
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	*f.list = splitList(value)
+	return nil
+}
+
+// splitList splits a comma separated list, trimming spaces & empty items
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// RegisterFlags sets up flags for the config on the flag set,
+// using the current config values as defaults
+func (c *CORSConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(listFlag{&c.AllowedOrigins}, "cors-origins",
+		"Comma separated origins allowed for CORS requests, * for any")
+	fs.Var(listFlag{&c.AllowedMethods}, "cors-methods",
+		"Comma separated methods allowed for CORS requests (default: the ones of each endpoint)")
+	fs.Var(listFlag{&c.AllowedHeaders}, "cors-headers",
+		"Comma separated headers allowed for CORS requests (default: any requested)")
+	fs.Var(listFlag{&c.ExposedHeaders}, "cors-expose-headers",
+		"Comma separated response headers exposed to CORS requests")
+	fs.BoolVar(&c.AllowCredentials, "cors-credentials", c.AllowCredentials,
+		"Allow credentials (cookies, Authorization) on CORS requests")
+	fs.DurationVar(&c.MaxAge, "cors-max-age", c.MaxAge,
+		"How long browsers can cache CORS preflight responses")
+}
+
+// allowsOrigin checks whether the origin is allowed
+func (c *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOrigin tells whether responses are the same for any origin
+func (c *CORSConfig) anyOrigin() bool {
+	if c.AllowCredentials { // "*" is not valid with credentials
+		return false
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler wraps next with CORS handling, answering preflight requests
+// with the methods given by methodsFor (the ones of the endpoint requested)
+func (c *CORSConfig) Handler(next http.Handler, methodsFor func(r *http.Request) []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.anyOrigin() {
+			addVary(w.Header(), "Origin")
+		}
+		if preflight {
+			addVary(w.Header(), "Access-Control-Request-Method")
+			addVary(w.Header(), "Access-Control-Request-Headers")
+		}
+		if origin == "" || !c.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		if c.anyOrigin() {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(c.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		methods := c.AllowedMethods
+		if len(methods) == 0 {
+			methods = methodsFor(r)
+		}
+		if len(methods) == 0 { // unknown path
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveCORS runs a request through the CORS layer of config in front of a
+// default server
+func serveCORS(config CORSConfig, method, url string, headers map[string]string) *httptest.ResponseRecorder {
+	s := NewDefaultServer()
+	r := httptest.NewRequest(method, url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	config.Handler(http.HandlerFunc(s.ServeVM), s.MethodsFor).ServeHTTP(w, r)
+	return w
+}
+
+// checkHeaders fails the test unless all wanted headers have the values given
+func checkHeaders(t *testing.T, w *httptest.ResponseRecorder, want map[string]string) {
+	t.Helper()
+	for k, v := range want {
+		if got := w.Header().Get(k); got != v {
+			t.Fatalf("got %s: %q, want: %q (headers: %v)", k, got, v, w.Header())
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	w := serveCORS(DefaultCORSConfig, http.MethodOptions, "/v2/vms/1", map[string]string{
+		"Origin":                         "http://localhost:3000",
+		"Access-Control-Request-Method":  http.MethodDelete,
+		"Access-Control-Request-Headers": "Content-Type, X-Custom",
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusNoContent)
+	}
+	checkHeaders(t, w, map[string]string{
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Methods": "GET, PATCH, DELETE",
+		"Access-Control-Allow-Headers": "Content-Type, X-Custom",
+		"Access-Control-Max-Age":       "600",
+	})
+	if got := w.Header().Values("Vary"); len(got) != 2 {
+		t.Fatalf("got Vary: %v, want the request method & headers", got)
+	}
+}
+
+func TestCORSConfiguredOrigins(t *testing.T) {
+	config := CORSConfig{
+		AllowedOrigins:   []string{"http://localhost:3000"},
+		AllowedHeaders:   []string{"Authorization"},
+		AllowCredentials: true,
+		MaxAge:           time.Minute,
+	}
+	w := serveCORS(config, http.MethodOptions, "/vms/1/launch", map[string]string{
+		"Origin":                        "http://localhost:3000",
+		"Access-Control-Request-Method": http.MethodPut,
+	})
+	checkHeaders(t, w, map[string]string{
+		"Access-Control-Allow-Origin":      "http://localhost:3000",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "PUT",
+		"Access-Control-Allow-Headers":     "Authorization",
+		"Access-Control-Max-Age":           "60",
+		"Vary":                             "Origin",
+	})
+
+	w = serveCORS(config, http.MethodOptions, "/vms", map[string]string{
+		"Origin":                        "http://evil.example.com",
+		"Access-Control-Request-Method": http.MethodGet,
+	})
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("got status: %d, headers: %v, want rejected origin", w.Code, w.Header())
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	w := serveCORS(DefaultCORSConfig, http.MethodGet, "/vms", map[string]string{"Origin": "http://localhost:3000"})
+	if w.Code != http.StatusOK || w.Body.String() != defaultVMs.String() {
+		t.Fatalf("got status: %d, body: %s", w.Code, w.Body.String())
+	}
+	exposed := "API-Version, Deprecation, Link, WWW-Authenticate, " +
+		"Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-ID"
+	checkHeaders(t, w, map[string]string{
+		"Access-Control-Allow-Origin":   "*",
+		"Access-Control-Expose-Headers": exposed,
+	})
+}
+
+func TestOptionsWithoutCORS(t *testing.T) {
+	w := serve(NewDefaultServer(), http.MethodOptions, "/vms/1")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusNoContent)
+	}
+	checkHeaders(t, w, map[string]string{"Allow": "GET, PATCH, DELETE, OPTIONS"})
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ErrorCode is a stable, machine-readable identifier of an API error
+type ErrorCode string
+
+const (
+	// VMNotFound the VM id does not exist
+	VMNotFound ErrorCode = "VM_NOT_FOUND"
+
+	// IllegalTransition the requested state change is not allowed from the VM current state
+	IllegalTransition ErrorCode = "ILLEGAL_TRANSITION"
+
+	// VMNotStopped the operation requires the VM to be Stopped first
+	VMNotStopped ErrorCode = "VM_NOT_STOPPED"
+
+	// VMProtected the VM has deletion protection, to be cleared first
+	VMProtected ErrorCode = "VM_PROTECTED"
+
+	// SnapshotNotFound the snapshot id does not exist for the VM
+	SnapshotNotFound ErrorCode = "SNAPSHOT_NOT_FOUND"
+
+	// SnapshotNotAvailable the operation requires the snapshot to be Available first
+	SnapshotNotAvailable ErrorCode = "SNAPSHOT_NOT_AVAILABLE"
+
+	// VMHasVolumes the VM has volumes attached, to be detached first
+	VMHasVolumes ErrorCode = "VM_HAS_VOLUMES"
+
+	// VolumeNotFound the volume id does not exist
+	VolumeNotFound ErrorCode = "VOLUME_NOT_FOUND"
+
+	// VolumeAttached the volume is attached to a VM, to be detached first
+	VolumeAttached ErrorCode = "VOLUME_ATTACHED"
+
+	// InvalidVolume the volume spec given is not valid
+	InvalidVolume ErrorCode = "INVALID_VOLUME"
+
+	// InvalidVM the VM spec given is not valid
+	InvalidVM ErrorCode = "INVALID_VM"
+
+	// ProjectNotFound the project id does not exist, or the caller cannot see it
+	ProjectNotFound ErrorCode = "PROJECT_NOT_FOUND"
+
+	// ProjectExists the project id is already taken
+	ProjectExists ErrorCode = "PROJECT_EXISTS"
+
+	// ProjectNotEmpty the project still owns VMs
+	ProjectNotEmpty ErrorCode = "PROJECT_NOT_EMPTY"
+
+	// QuotaExceeded the request would take the project over a quota limit
+	QuotaExceeded ErrorCode = "QUOTA_EXCEEDED"
+
+	// InvalidProject the project given is not valid
+	InvalidProject ErrorCode = "INVALID_PROJECT"
+
+	// NotProjectMember the caller is not a member of the project
+	NotProjectMember ErrorCode = "NOT_PROJECT_MEMBER"
+
+	// BadRequest the request could not be understood (eg. a malformed VM id)
+	BadRequest ErrorCode = "BAD_REQUEST"
+
+	// MethodNotAllowed the method is not implemented for the requested path
+	MethodNotAllowed ErrorCode = "METHOD_NOT_ALLOWED"
+
+	// Unauthenticated the request lacks valid credentials
+	Unauthenticated ErrorCode = "UNAUTHENTICATED"
+
+	// InvalidCredentials the username or password are wrong
+	InvalidCredentials ErrorCode = "INVALID_CREDENTIALS"
+
+	// InsufficientScope the caller is not allowed to perform the request
+	InsufficientScope ErrorCode = "INSUFFICIENT_SCOPE"
+
+	// InsufficientRole the caller role does not allow the request
+	InsufficientRole ErrorCode = "INSUFFICIENT_ROLE"
+
+	// AuthDisabled the server runs without authentication
+	AuthDisabled ErrorCode = "AUTH_DISABLED"
+
+	// RateLimited the client sent too many requests to the endpoint
+	RateLimited ErrorCode = "RATE_LIMITED"
+
+	// UnsupportedAPIVersion the requested API version does not exist
+	UnsupportedAPIVersion ErrorCode = "UNSUPPORTED_API_VERSION"
+
+	// InternalError something unexpected failed on the server side
+	InternalError ErrorCode = "INTERNAL_ERROR"
+)
+
+// errorCodeSpec is the HTTP status and short human title of an ErrorCode
+type errorCodeSpec struct {
+	Status int
+	Title  string
+}
+
+// errorCodeSpecs maps every ErrorCode to its HTTP semantics
+var errorCodeSpecs = map[ErrorCode]errorCodeSpec{
+	VMNotFound:            {http.StatusNotFound, "VM not found"},
+	IllegalTransition:     {http.StatusConflict, "Illegal state transition"},
+	VMNotStopped:          {http.StatusConflict, "VM must be stopped"},
+	VMProtected:           {http.StatusConflict, "VM deletion protected"},
+	SnapshotNotFound:      {http.StatusNotFound, "Snapshot not found"},
+	SnapshotNotAvailable:  {http.StatusConflict, "Snapshot not available"},
+	VMHasVolumes:          {http.StatusConflict, "VM has volumes attached"},
+	VolumeNotFound:        {http.StatusNotFound, "Volume not found"},
+	VolumeAttached:        {http.StatusConflict, "Volume attached"},
+	InvalidVolume:         {http.StatusUnprocessableEntity, "Invalid volume"},
+	InvalidVM:             {http.StatusUnprocessableEntity, "Invalid VM spec"},
+	ProjectNotFound:       {http.StatusNotFound, "Project not found"},
+	ProjectExists:         {http.StatusConflict, "Project already exists"},
+	ProjectNotEmpty:       {http.StatusConflict, "Project not empty"},
+	QuotaExceeded:         {http.StatusConflict, "Quota exceeded"},
+	InvalidProject:        {http.StatusUnprocessableEntity, "Invalid project"},
+	NotProjectMember:      {http.StatusForbidden, "Not a project member"},
+	BadRequest:            {http.StatusBadRequest, "Bad request"},
+	MethodNotAllowed:      {http.StatusMethodNotAllowed, "Method not allowed"},
+	Unauthenticated:       {http.StatusUnauthorized, "Authentication required"},
+	InvalidCredentials:    {http.StatusUnauthorized, "Invalid credentials"},
+	InsufficientScope:     {http.StatusForbidden, "Insufficient scope"},
+	InsufficientRole:      {http.StatusForbidden, "Insufficient role"},
+	AuthDisabled:          {http.StatusNotFound, "Authentication disabled"},
+	RateLimited:           {http.StatusTooManyRequests, "Too many requests"},
+	UnsupportedAPIVersion: {http.StatusNotAcceptable, "Unsupported API version"},
+	InternalError:         {http.StatusInternalServerError, "Internal server error"},
+}
+
+// NoVMID is the CloudError ID of errors not related to an existing VM
+const NoVMID = -1
+
+// CloudError is an error from a Cloud operation on a given VM,
+// tagged with a stable ErrorCode
+type CloudError struct {
+	Code ErrorCode
+	ID   int
+	Err  error
+}
+
+func (e *CloudError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap exposes the underlying error to errors.Is and errors.As
+func (e *CloudError) Unwrap() error {
+	return e.Err
+}
+
+// cloudErrorf builds a CloudError for the VM id with a formatted message
+func cloudErrorf(code ErrorCode, id int, format string, args ...interface{}) *CloudError {
+	return &CloudError{Code: code, ID: id, Err: fmt.Errorf(format, args...)}
+}
+
+// ProblemContentType is the media type of RFC 7807 error responses
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object, extended with the
+// machine-readable code, the offending VM id and the quota exceeded (if any)
+type Problem struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Code     ErrorCode   `json:"code"`
+	VMID     *int        `json:"vm_id,omitempty"`
+	Quota    *QuotaError `json:"quota,omitempty"`
+}
+
+// NewProblem returns the Problem for the given code with a specific detail
+func NewProblem(code ErrorCode, detail string) Problem {
+	spec, found := errorCodeSpecs[code]
+	if !found {
+		spec = errorCodeSpecs[InternalError]
+	}
+	return Problem{
+		Type:   problemType(code),
+		Title:  spec.Title,
+		Status: spec.Status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// problemType returns a stable type URI for the code, such as
+// "/problems/vm-not-found"
+func problemType(code ErrorCode) string {
+	return "/problems/" + strings.ReplaceAll(strings.ToLower(string(code)), "_", "-")
+}
+
+// problemFor translates any error into a Problem,
+// CloudErrors keep their code, VM id & quota details, anything else is an
+// internal error
+func problemFor(err error) Problem {
+	var cerr *CloudError
+	if errors.As(err, &cerr) {
+		p := NewProblem(cerr.Code, cerr.Error())
+		if cerr.ID != NoVMID {
+			id := cerr.ID
+			p.VMID = &id
+		}
+		errors.As(err, &p.Quota)
+		return p
+	}
+	return NewProblem(InternalError, err.Error())
+}
+
+// writeProblem dumps the Problem as application/problem+json for request r
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Instance == "" {
+		p.Instance = originalPath(r)
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("error generating problem JSON for %#v: %v", p, err)
+		http.Error(w, p.Detail, p.Status)
+		return
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	fmt.Fprintln(w, string(body))
+}
+
+// writeError dumps err as a Problem for request r
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, r, problemFor(err))
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// VMEventType classifies the changes of a VM
+type VMEventType string
+
+const (
+	// VMCreated a new VM was added to the Cloud
+	VMCreated VMEventType = "created"
+
+	// VMStateChanged a VM moved to a new state
+	VMStateChanged VMEventType = "state_changed"
+
+	// VMResized a VM hardware spec changed
+	VMResized VMEventType = "resized"
+
+	// VMUpdated a VM setting changed, like its deletion protection
+	VMUpdated VMEventType = "updated"
+
+	// VMSnapshotRestored a VM disk was restored from a snapshot
+	VMSnapshotRestored VMEventType = "snapshot_restored"
+
+	// VMDeleted a VM was removed from the Cloud, to the trash
+	VMDeleted VMEventType = "deleted"
+
+	// VMRestored a VM was restored from the trash
+	VMRestored VMEventType = "restored"
+
+	// VMPurged a VM was purged from the trash, for good
+	VMPurged VMEventType = "purged"
+)
+
+// EventBufferSize is how many events a slow subscriber can lag behind before
+// events start being dropped for it
+const EventBufferSize = 64
+
+// VMEvent is a change on a VM as notified to Cloud subscribers
+type VMEvent struct {
+	Type VMEventType `json:"type"`
+	ID   int         `json:"id"`
+	VM   VM          `json:"vm"`
+	Time time.Time   `json:"time"`
+}
+
+// broadcaster fans out VMEvents to all current subscribers,
+// its zero value is ready to use
+type broadcaster struct {
+	lock        sync.Mutex
+	nextID      int
+	subscribers map[int]chan VMEvent
+	closed      bool
+}
+
+// subscribe returns a channel receiving all events from now on,
+// and a function to cancel the subscription (and close the channel)
+func (b *broadcaster) subscribe() (<-chan VMEvent, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	events := make(chan VMEvent, EventBufferSize)
+	if b.closed {
+		close(events)
+		return events, func() {}
+	}
+	if b.subscribers == nil {
+		b.subscribers = make(map[int]chan VMEvent)
+	}
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = events
+	return events, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		if _, found := b.subscribers[id]; found { // not closed already
+			delete(b.subscribers, id)
+			close(events)
+		}
+	}
+}
+
+// close ends all the subscriptions, closing their channels, and the ones
+// made from now on. Returns how many subscriptions were ended.
+func (b *broadcaster) close() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	ended := len(b.subscribers)
+	for id, events := range b.subscribers {
+		delete(b.subscribers, id)
+		close(events)
+	}
+	return ended
+}
+
+// publish sends the event to all subscribers without blocking,
+// subscribers lagging more than EventBufferSize events miss it
+func (b *broadcaster) publish(event VMEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for id, events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Dropped %v event of VM %d for slow subscriber %d", event.Type, event.ID, id)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Format is a representation of resources on the wire
+type Format string
+
+const (
+	// FormatJSON is the default format, as defined by the API version
+	FormatJSON Format = "json"
+
+	// FormatYAML dumps resources as a YAML document
+	FormatYAML Format = "yaml"
+
+	// FormatCSV dumps resources as a CSV table with a header and one row per VM
+	FormatCSV Format = "csv"
+
+	// FormatXML dumps resources as an XML document
+	FormatXML Format = "xml"
+)
+
+// FormatMediaTypes lists the media types of each Format, the first is the
+// one used as Content-Type in responses
+var FormatMediaTypes = map[Format][]string{
+	FormatJSON: {"application/json"},
+	FormatYAML: {"application/yaml", "application/x-yaml", "text/yaml"},
+	FormatCSV:  {"text/csv"},
+	FormatXML:  {"application/xml", "text/xml"},
+}
+
+// negotiateFormat picks the response Format, by ?format= query parameter or
+// else by Accept header. Unknown media types fall back to JSON, an unknown
+// format parameter is an error.
+func negotiateFormat(w http.ResponseWriter, r *http.Request) (Format, error) {
+	if value := r.URL.Query().Get("format"); value != "" {
+		format := Format(strings.ToLower(value))
+		if _, found := FormatMediaTypes[format]; !found {
+			return FormatJSON, fmt.Errorf("unsupported format %q, use one of %v", value, formatNames())
+		}
+		return format, nil
+	}
+	addVary(w.Header(), "Accept")
+	best, bestQ := FormatJSON, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if format, found := formatOf(mediaType); found && q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, nil
+}
+
+// formatOf returns the Format of a media type, if supported
+func formatOf(mediaType string) (Format, bool) {
+	if strings.HasPrefix(mediaType, VendorMediaTypePrefix) {
+		return FormatJSON, true
+	}
+	for format, mediaTypes := range FormatMediaTypes {
+		for _, t := range mediaTypes {
+			if t == mediaType {
+				return format, true
+			}
+		}
+	}
+	return "", false
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(FormatMediaTypes))
+	for format := range FormatMediaTypes {
+		names = append(names, string(format))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// orderedField is a member of an orderedObject
+type orderedField struct {
+	Key   string
+	Value interface{}
+}
+
+// orderedObject is a JSON object which keeps its keys order
+type orderedObject []orderedField
+
+// toOrdered normalizes v into plain JSON values (json.Number, string, bool,
+// nil, []interface{} and orderedObject), keeping the order of struct fields
+func toOrdered(v interface{}) (interface{}, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decodeOrdered(decoder)
+}
+
+func decodeOrdered(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := orderedObject{}
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, orderedField{key.(string), value})
+		}
+		_, err := decoder.Token() // }
+		return object, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrdered(decoder)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := decoder.Token() // ]
+		return list, err
+	}
+	return token, nil
+}
+
+// yamlPlain matches strings which can be written in YAML without quotes
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_ ./-]*$`)
+
+// yamlScalar writes a scalar JSON value in YAML
+func yamlScalar(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		lower := strings.ToLower(value)
+		if yamlPlain.MatchString(value) && !strings.HasSuffix(value, " ") &&
+			lower != "true" && lower != "false" && lower != "null" && lower != "yes" && lower != "no" {
+			return value
+		}
+		quoted, _ := json.Marshal(value) // JSON strings are valid YAML double-quoted strings
+		return string(quoted)
+	}
+	return fmt.Sprint(v)
+}
+
+// writeYAML dumps a value normalized by toOrdered as a YAML document
+func writeYAML(w io.Writer, v interface{}, indent string) {
+	switch value := v.(type) {
+	case orderedObject:
+		if len(value) == 0 {
+			fmt.Fprintf(w, "%s{}\n", indent)
+		}
+		for _, field := range value {
+			writeYAMLEntry(w, indent+yamlScalar(field.Key)+":", field.Value, indent+"  ")
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			fmt.Fprintf(w, "%s[]\n", indent)
+		}
+		for _, item := range value {
+			writeYAMLEntry(w, indent+"-", item, indent+"  ")
+		}
+	default:
+		fmt.Fprintf(w, "%s%s\n", indent, yamlScalar(v))
+	}
+}
+
+// writeYAMLEntry writes a map entry or list item with the given prefix
+func writeYAMLEntry(w io.Writer, prefix string, v interface{}, indent string) {
+	switch value := v.(type) {
+	case orderedObject:
+		if len(value) > 0 {
+			fmt.Fprintln(w, prefix)
+			writeYAML(w, value, indent)
+			return
+		}
+		fmt.Fprintf(w, "%s {}\n", prefix)
+	case []interface{}:
+		if len(value) > 0 {
+			fmt.Fprintln(w, prefix)
+			writeYAML(w, value, indent)
+			return
+		}
+		fmt.Fprintf(w, "%s []\n", prefix)
+	default:
+		fmt.Fprintf(w, "%s %s\n", prefix, yamlScalar(v))
+	}
+}
+
+// xmlName makes a valid XML element name out of a JSON key
+func xmlName(key string) string {
+	if key == "" || !(key[0] == '_' || isLetter(key[0])) {
+		return "_" + key
+	}
+	return key
+}
+
+// writeXMLElement dumps a value normalized by toOrdered as an XML element,
+// list items are named after item
+func writeXMLElement(e *xml.Encoder, name, item string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlName(name)}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case orderedObject:
+		for _, field := range value {
+			if err := writeXMLElement(e, field.Key, "item", field.Value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			if err := writeXMLElement(e, item, "item", element); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := e.EncodeToken(xml.CharData(fmt.Sprint(value))); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// writeXML dumps a value normalized by toOrdered as an XML document rooted
+// at name, with list items named after item
+func writeXML(w io.Writer, name, item string, v interface{}) error {
+	fmt.Fprint(w, xml.Header)
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := writeXMLElement(e, name, item, v); err != nil {
+		return err
+	}
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// writeCSV dumps a list of objects normalized by toOrdered as a CSV table,
+// one column per scalar field (nested objects & lists are skipped)
+func writeCSV(w io.Writer, records []interface{}) error {
+	columns := []string{}
+	seen := map[string]bool{}
+	for _, record := range records {
+		for _, field := range record.(orderedObject) {
+			if !seen[field.Key] && isScalar(field.Value) {
+				seen[field.Key] = true
+				columns = append(columns, field.Key)
+			}
+		}
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	for _, record := range records {
+		values := map[string]string{}
+		for _, field := range record.(orderedObject) {
+			if field.Value != nil {
+				values[field.Key] = fmt.Sprint(field.Value)
+			}
+		}
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = values[column]
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case orderedObject, []interface{}:
+		return false
+	}
+	return true
+}
+
+// writeFormatted dumps v in a non JSON format, v being either a single VM
+// or a list of VMs (CSV always gets a table)
+func writeFormatted(w http.ResponseWriter, r *http.Request, format Format, v interface{}) {
+	ordered, err := toOrdered(v)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	list, isList := ordered.([]interface{})
+	var buf bytes.Buffer
+	switch format {
+	case FormatYAML:
+		writeYAML(&buf, ordered, "")
+	case FormatCSV:
+		if !isList {
+			list = []interface{}{ordered}
+		}
+		err = writeCSV(&buf, list)
+	case FormatXML:
+		if isList {
+			err = writeXML(&buf, "vms", "vm", list)
+		} else {
+			err = writeXML(&buf, "vm", "item", ordered)
+		}
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", FormatMediaTypes[format][0]+"; charset=utf-8")
+	w.Write(buf.Bytes())
+}
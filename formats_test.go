@@ -0,0 +1,142 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var formatCases = []struct {
+	url         string
+	accept      string
+	contentType string
+	want        string
+}{
+	{
+		url:         "/vms/1?format=yaml",
+		contentType: "application/yaml; charset=utf-8",
+		want: `id: 1
+vcpus: 4
+clock: 3600
+ram: 32768
+storage: 512
+network: 10000
+state: Stopped
+`,
+	},
+	{
+		url:         "/vms",
+		accept:      "text/csv",
+		contentType: "text/csv; charset=utf-8",
+		want: `id,vcpus,clock,ram,storage,network,state
+0,1,1500,4096,128,1000,Stopped
+1,4,3600,32768,512,10000,Stopped
+2,2,2200,8192,256,1000,Stopped
+`,
+	},
+	{
+		url:         "/v2/vms/2",
+		accept:      "application/json;q=0.5, application/xml",
+		contentType: "application/xml; charset=utf-8",
+		want: `<?xml version="1.0" encoding="UTF-8"?>
+<vm>
+  <id>2</id>
+  <vcpus>2</vcpus>
+  <clock>2200</clock>
+  <ram>8192</ram>
+  <storage>256</storage>
+  <network>1000</network>
+  <state>Stopped</state>
+</vm>
+`,
+	},
+	{
+		url:         "/vms?format=XML",
+		accept:      "text/csv",
+		contentType: "application/xml; charset=utf-8",
+		want: `<?xml version="1.0" encoding="UTF-8"?>
+<vms>
+  <vm>
+    <id>0</id>
+    <vcpus>1</vcpus>
+    <clock>1500</clock>
+    <ram>4096</ram>
+    <storage>128</storage>
+    <network>1000</network>
+    <state>Stopped</state>
+  </vm>
+  <vm>
+    <id>1</id>
+    <vcpus>4</vcpus>
+    <clock>3600</clock>
+    <ram>32768</ram>
+    <storage>512</storage>
+    <network>10000</network>
+    <state>Stopped</state>
+  </vm>
+  <vm>
+    <id>2</id>
+    <vcpus>2</vcpus>
+    <clock>2200</clock>
+    <ram>8192</ram>
+    <storage>256</storage>
+    <network>1000</network>
+    <state>Stopped</state>
+  </vm>
+</vms>
+`,
+	},
+}
+
+func TestFormats(t *testing.T) {
+	for _, tc := range formatCases {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := serveRequest(NewDefaultServer(), r)
+		if got := w.Header().Get("Content-Type"); got != tc.contentType {
+			t.Fatalf("%s got Content-Type: %q, want: %q", tc.url, got, tc.contentType)
+		}
+		if got := w.Body.String(); got != tc.want {
+			t.Fatalf("%s got:\n%s\nwant:\n%s", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestUnknownAcceptFallsBackToJSON(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/vms", nil)
+	r.Header.Set("Accept", "text/html,*/*;q=0.8")
+	w := serveRequest(NewDefaultServer(), r)
+	if got, want := w.Body.String(), defaultVMs.String(); got != want {
+		t.Fatalf("got: %s, want: %s", got, want)
+	}
+}
+
+func TestBadFormat(t *testing.T) {
+	w := serve(NewDefaultServer(), http.MethodGet, "/vms?format=toml")
+	if p := decodeProblem(t, w); p.Code != BadRequest {
+		t.Fatalf("got: %+v, want code: %v", p, BadRequest)
+	}
+}
+
+var yamlScalarCases = map[interface{}]string{
+	"Running": "Running",
+	"":        `""`,
+	"true":    `"true"`,
+	"10:00":   `"10:00"`,
+	"a #b":    `"a #b"`,
+	nil:       "null",
+	false:     "false",
+}
+
+func TestYAMLScalar(t *testing.T) {
+	for v, want := range yamlScalarCases {
+		if got := yamlScalar(v); got != want {
+			t.Fatalf("%#v got: %s, want: %s", v, got, want)
+		}
+	}
+}
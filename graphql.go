@@ -0,0 +1,902 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This file holds a minimal GraphQL parser & executor, just enough to serve
+// the Cloud schema to GraphQL clients such as Apollo: operations, variables,
+// aliases, arguments, fragments and the @skip/@include directives.
+// There is no type system: root resolvers return gqlObjects (maps) and the
+// executor just projects the selected fields out of them.
+
+// gqlOperation is a query, mutation or subscription in a request document
+type gqlOperation struct {
+	Type       string
+	Name       string
+	Variables  []gqlVariableDefinition
+	Selections []gqlSelection
+}
+
+// gqlVariableDefinition declares an operation variable, such as ($id: Int! = 0)
+type gqlVariableDefinition struct {
+	Name       string
+	Type       string
+	Default    interface{}
+	HasDefault bool
+}
+
+// gqlFragment is a named fragment definition
+type gqlFragment struct {
+	Name          string
+	TypeCondition string
+	Selections    []gqlSelection
+}
+
+// gqlSelection is either a field, a fragment spread or an inline fragment
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Arguments  map[string]interface{}
+	Directives map[string]map[string]interface{}
+	Selections []gqlSelection
+
+	FragmentSpread string // name of the spread fragment, if a spread
+	InlineFragment bool
+	TypeCondition  string // of the inline fragment, if any
+}
+
+// gqlDocument is a parsed GraphQL request
+type gqlDocument struct {
+	Operations []*gqlOperation
+	Fragments  map[string]*gqlFragment
+}
+
+// gqlVariable is a reference to a variable in a value literal
+type gqlVariable string
+
+// gqlEnum is an enum value literal
+type gqlEnum string
+
+// gqlObject is a resolved GraphQL object, with its "__typename"
+type gqlObject map[string]interface{}
+
+// gqlResult is a completed object, marshalled in JSON with its fields in
+// the order they were selected
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGQLResult() *gqlResult {
+	return &gqlResult{values: map[string]interface{}{}}
+}
+
+func (o *gqlResult) set(key string, value interface{}) {
+	if _, found := o.values[key]; !found {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// MarshalJSON dumps the fields in selection order
+func (o *gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlError is a GraphQL error as returned in a response
+type gqlError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e gqlError) Error() string {
+	return e.Message
+}
+
+const (
+	tokenEOF = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+	pos   int
+}
+
+// gqlTokenize splits a GraphQL document in tokens, skipping ignored
+// characters (whitespace, commas & comments)
+func gqlTokenize(src string) ([]gqlToken, error) {
+	tokens := []gqlToken{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{tokenPunctuator, "...", i})
+			i += 3
+		case strings.ContainsRune("!$()[]{}:=@|&", rune(c)):
+			tokens = append(tokens, gqlToken{tokenPunctuator, string(c), i})
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || isLetter(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, gqlToken{tokenName, src[start:i], start})
+		case c == '-' || isDigit(c):
+			start := i
+			kind := tokenInt
+			i++
+			for i < len(src) && (isDigit(src[i]) || strings.IndexByte(".eE+-", src[i]) >= 0) {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = tokenFloat
+				}
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind, src[start:i], start})
+		case c == '"':
+			value, end, err := gqlScanString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, gqlToken{tokenString, value, i})
+			i = end
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("syntax error: unexpected character %q at %d", r, i)
+		}
+	}
+	return append(tokens, gqlToken{tokenEOF, "<EOF>", len(src)}), nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// gqlScanString reads the string starting at src[start], either a block
+// string (""") or a regular one, returning its value and end position
+func gqlScanString(src string, start int) (string, int, error) {
+	if strings.HasPrefix(src[start:], `"""`) {
+		end := strings.Index(src[start+3:], `"""`)
+		if end < 0 {
+			return "", 0, fmt.Errorf("syntax error: unterminated block string at %d", start)
+		}
+		return strings.TrimSpace(src[start+3 : start+3+end]), start + 3 + end + 3, nil
+	}
+	var sb strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			return sb.String(), i + 1, nil
+		case '\n', '\r':
+			return "", 0, fmt.Errorf("syntax error: unterminated string at %d", start)
+		case '\\':
+			if i+1 >= len(src) {
+				return "", 0, fmt.Errorf("syntax error: unterminated string at %d", start)
+			}
+			i++
+			switch e := src[i]; e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'u':
+				if i+4 >= len(src) {
+					return "", 0, fmt.Errorf("syntax error: bad unicode escape at %d", i)
+				}
+				code, err := strconv.ParseUint(src[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("syntax error: bad unicode escape at %d", i)
+				}
+				sb.WriteRune(rune(code))
+				i += 4
+			default:
+				sb.WriteByte(e)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("syntax error: unterminated string at %d", start)
+}
+
+// MaxGQLDepth is the deepest nesting of selection sets, values and types
+// accepted in a document
+const MaxGQLDepth = 32
+
+// MaxGQLFields is how many fields an operation can select once its
+// fragments are expanded
+const MaxGQLFields = 10000
+
+// gqlParser is a recursive descent parser over the document tokens
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+	depth  int // of nested selection sets, values and types
+}
+
+// parseGraphQL parses a GraphQL request document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := gqlTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{Fragments: map[string]*gqlFragment{}}
+	for !p.at(tokenEOF, "") {
+		if p.at(tokenName, "fragment") {
+			fragment, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			doc.Fragments[fragment.Name] = fragment
+			continue
+		}
+		op, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		doc.Operations = append(doc.Operations, op)
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("syntax error: the document has no operations")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+// at checks the kind and value (if not empty) of the current token
+func (p *gqlParser) at(kind int, value string) bool {
+	t := p.peek()
+	return t.kind == kind && (value == "" || t.value == value)
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// expect consumes a token of the given kind & value (if not empty)
+func (p *gqlParser) expect(kind int, value string) (gqlToken, error) {
+	if !p.at(kind, value) {
+		t := p.peek()
+		want := value
+		if want == "" {
+			want = "a name"
+		}
+		return t, fmt.Errorf("syntax error: expected %s, found %q at %d", want, t.value, t.pos)
+	}
+	return p.next(), nil
+}
+
+// nest enters a nested selection set, value or type, failing if too deep.
+// The caller must call the returned function when leaving it.
+func (p *gqlParser) nest() (func(), error) {
+	p.depth++
+	leave := func() { p.depth-- }
+	if p.depth > MaxGQLDepth {
+		return leave, fmt.Errorf("syntax error: nesting deeper than %d at %d", MaxGQLDepth, p.peek().pos)
+	}
+	return leave, nil
+}
+
+// skip consumes the current token if it is the given punctuator
+func (p *gqlParser) skip(punctuator string) bool {
+	if p.at(tokenPunctuator, punctuator) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) parseOperation() (*gqlOperation, error) {
+	op := &gqlOperation{Type: "query"}
+	if p.at(tokenPunctuator, "{") {
+		selections, err := p.parseSelectionSet()
+		op.Selections = selections
+		return op, err
+	}
+	t, err := p.expect(tokenName, "")
+	if err != nil {
+		return nil, err
+	}
+	switch t.value {
+	case "query", "mutation", "subscription":
+		op.Type = t.value
+	default:
+		return nil, fmt.Errorf("syntax error: unexpected %q at %d", t.value, t.pos)
+	}
+	if p.at(tokenName, "") {
+		op.Name = p.next().value
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			definition, err := p.parseVariableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			op.Variables = append(op.Variables, definition)
+		}
+	}
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	op.Selections, err = p.parseSelectionSet()
+	return op, err
+}
+
+func (p *gqlParser) parseVariableDefinition() (gqlVariableDefinition, error) {
+	definition := gqlVariableDefinition{}
+	if _, err := p.expect(tokenPunctuator, "$"); err != nil {
+		return definition, err
+	}
+	name, err := p.expect(tokenName, "")
+	if err != nil {
+		return definition, err
+	}
+	definition.Name = name.value
+	if _, err := p.expect(tokenPunctuator, ":"); err != nil {
+		return definition, err
+	}
+	if definition.Type, err = p.parseType(); err != nil {
+		return definition, err
+	}
+	if p.skip("=") {
+		definition.HasDefault = true
+		if definition.Default, err = p.parseValue(true); err != nil {
+			return definition, err
+		}
+	}
+	_, err = p.parseDirectives()
+	return definition, err
+}
+
+// parseType returns the textual form of a type reference, such as "[Int!]!"
+func (p *gqlParser) parseType() (string, error) {
+	leave, err := p.nest()
+	defer leave()
+	if err != nil {
+		return "", err
+	}
+	var typ string
+	if p.skip("[") {
+		inner, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		if _, err := p.expect(tokenPunctuator, "]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.expect(tokenName, "")
+		if err != nil {
+			return "", err
+		}
+		typ = name.value
+	}
+	if p.skip("!") {
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) parseFragment() (*gqlFragment, error) {
+	p.next() // fragment
+	name, err := p.expect(tokenName, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenName, "on"); err != nil {
+		return nil, err
+	}
+	typeCondition, err := p.expect(tokenName, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.parseSelectionSet()
+	return &gqlFragment{Name: name.value, TypeCondition: typeCondition.value, Selections: selections}, err
+}
+
+func (p *gqlParser) parseSelectionSet() ([]gqlSelection, error) {
+	leave, err := p.nest()
+	defer leave()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenPunctuator, "{"); err != nil {
+		return nil, err
+	}
+	selections := []gqlSelection{}
+	for !p.skip("}") {
+		selection, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) parseSelection() (gqlSelection, error) {
+	var err error
+	selection := gqlSelection{}
+	if p.skip("...") {
+		if p.at(tokenName, "") && !p.at(tokenName, "on") {
+			selection.FragmentSpread = p.next().value
+			selection.Directives, err = p.parseDirectives()
+			return selection, err
+		}
+		selection.InlineFragment = true
+		if p.at(tokenName, "on") {
+			p.next()
+			name, err := p.expect(tokenName, "")
+			if err != nil {
+				return selection, err
+			}
+			selection.TypeCondition = name.value
+		}
+		if selection.Directives, err = p.parseDirectives(); err != nil {
+			return selection, err
+		}
+		selection.Selections, err = p.parseSelectionSet()
+		return selection, err
+	}
+	name, err := p.expect(tokenName, "")
+	if err != nil {
+		return selection, err
+	}
+	selection.Name = name.value
+	if p.skip(":") {
+		field, err := p.expect(tokenName, "")
+		if err != nil {
+			return selection, err
+		}
+		selection.Alias, selection.Name = name.value, field.value
+	}
+	if selection.Arguments, err = p.parseArguments(); err != nil {
+		return selection, err
+	}
+	if selection.Directives, err = p.parseDirectives(); err != nil {
+		return selection, err
+	}
+	if p.at(tokenPunctuator, "{") {
+		selection.Selections, err = p.parseSelectionSet()
+	}
+	return selection, err
+}
+
+func (p *gqlParser) parseArguments() (map[string]interface{}, error) {
+	arguments := map[string]interface{}{}
+	if !p.skip("(") {
+		return arguments, nil
+	}
+	for !p.skip(")") {
+		name, err := p.expect(tokenName, "")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenPunctuator, ":"); err != nil {
+			return nil, err
+		}
+		if arguments[name.value], err = p.parseValue(false); err != nil {
+			return nil, err
+		}
+	}
+	return arguments, nil
+}
+
+func (p *gqlParser) parseDirectives() (map[string]map[string]interface{}, error) {
+	directives := map[string]map[string]interface{}{}
+	for p.skip("@") {
+		name, err := p.expect(tokenName, "")
+		if err != nil {
+			return nil, err
+		}
+		if directives[name.value], err = p.parseArguments(); err != nil {
+			return nil, err
+		}
+	}
+	return directives, nil
+}
+
+// parseValue parses a value literal, variables are not allowed on constants
+func (p *gqlParser) parseValue(constant bool) (interface{}, error) {
+	leave, err := p.nest()
+	defer leave()
+	if err != nil {
+		return nil, err
+	}
+	t := p.next()
+	switch t.kind {
+	case tokenInt:
+		return strconv.Atoi(t.value)
+	case tokenFloat:
+		return strconv.ParseFloat(t.value, 64)
+	case tokenString:
+		return t.value, nil
+	case tokenName:
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return gqlEnum(t.value), nil
+	case tokenPunctuator:
+		switch t.value {
+		case "$":
+			if constant {
+				break
+			}
+			name, err := p.expect(tokenName, "")
+			return gqlVariable(name.value), err
+		case "[":
+			list := []interface{}{}
+			for !p.skip("]") {
+				item, err := p.parseValue(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			return list, nil
+		case "{":
+			object := map[string]interface{}{}
+			for !p.skip("}") {
+				name, err := p.expect(tokenName, "")
+				if err != nil {
+					return nil, err
+				}
+				if _, err := p.expect(tokenPunctuator, ":"); err != nil {
+					return nil, err
+				}
+				if object[name.value], err = p.parseValue(constant); err != nil {
+					return nil, err
+				}
+			}
+			return object, nil
+		}
+	}
+	return nil, fmt.Errorf("syntax error: unexpected %q at %d", t.value, t.pos)
+}
+
+// checkFragmentCycles rejects fragments spreading themselves, directly or
+// through other fragments, which would never finish expanding
+func (doc *gqlDocument) checkFragmentCycles() error {
+	checked, spreading := map[string]bool{}, map[string]bool{}
+	var check func(name string) error
+	check = func(name string) error {
+		if spreading[name] {
+			return fmt.Errorf("cannot spread fragment %q within itself", name)
+		}
+		fragment, found := doc.Fragments[name]
+		if !found || checked[name] {
+			return nil
+		}
+		spreading[name] = true
+		for _, spread := range fragmentSpreads(fragment.Selections, nil) {
+			if err := check(spread); err != nil {
+				return err
+			}
+		}
+		spreading[name], checked[name] = false, true
+		return nil
+	}
+	for name := range doc.Fragments {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFieldCount rejects operations selecting more than MaxGQLFields
+// fields once their fragments are expanded, which spreading fragments many
+// times over could make explode. Fragment cycles must be rejected first.
+func (doc *gqlDocument) checkFieldCount(op *gqlOperation) error {
+	fragmentFields := map[string]int{}
+	var count func(selections []gqlSelection) int
+	count = func(selections []gqlSelection) int {
+		fields := 0
+		for _, selection := range selections {
+			switch {
+			case selection.FragmentSpread != "":
+				n, found := fragmentFields[selection.FragmentSpread]
+				if fragment, exists := doc.Fragments[selection.FragmentSpread]; !found && exists {
+					n = count(fragment.Selections)
+					fragmentFields[selection.FragmentSpread] = n
+				}
+				fields += n
+			case selection.InlineFragment:
+				fields += count(selection.Selections)
+			default:
+				fields += 1 + count(selection.Selections)
+			}
+			if fields > MaxGQLFields { // saturate, not to overflow
+				return MaxGQLFields + 1
+			}
+		}
+		return fields
+	}
+	if fields := count(op.Selections); fields > MaxGQLFields {
+		return fmt.Errorf("the operation selects more than %d fields once its fragments are expanded", MaxGQLFields)
+	}
+	return nil
+}
+
+// fragmentSpreads appends the names of the fragments spread in the
+// selections, at any level
+func fragmentSpreads(selections []gqlSelection, names []string) []string {
+	for _, selection := range selections {
+		if selection.FragmentSpread != "" {
+			names = append(names, selection.FragmentSpread)
+		}
+		names = fragmentSpreads(selection.Selections, names)
+	}
+	return names
+}
+
+// gqlResolver resolves a root field given its arguments
+type gqlResolver func(args map[string]interface{}) (interface{}, error)
+
+// gqlRequest is a GraphQL request as posted by clients
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// gqlResponse is the result of executing a GraphQL request
+type gqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// gqlExecution holds the state of a single operation execution
+type gqlExecution struct {
+	doc       *gqlDocument
+	variables map[string]interface{}
+	errors    []gqlError
+}
+
+// selectOperation picks the operation to run out of the document
+func (doc *gqlDocument) selectOperation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return nil, fmt.Errorf("operationName is required for documents with multiple operations")
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation named %q", name)
+}
+
+// coerceVariables applies defaults and checks required variables are given
+func (op *gqlOperation) coerceVariables(given map[string]interface{}) (map[string]interface{}, error) {
+	variables := map[string]interface{}{}
+	for _, definition := range op.Variables {
+		value, found := given[definition.Name]
+		if !found && definition.HasDefault {
+			value, found = definition.Default, true
+		}
+		if (!found || value == nil) && strings.HasSuffix(definition.Type, "!") {
+			return nil, fmt.Errorf("variable \"$%s\" of required type %q was not provided", definition.Name, definition.Type)
+		}
+		variables[definition.Name] = value
+	}
+	return variables, nil
+}
+
+// resolveValue replaces variables and enums in a value literal by plain values
+func (e *gqlExecution) resolveValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case gqlVariable:
+		return e.variables[string(v)]
+	case gqlEnum:
+		return string(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.resolveValue(item)
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			object[name] = e.resolveValue(item)
+		}
+		return object
+	}
+	return value
+}
+
+func (e *gqlExecution) resolveArguments(arguments map[string]interface{}) map[string]interface{} {
+	return e.resolveValue(arguments).(map[string]interface{})
+}
+
+// included evaluates the @skip and @include directives of a selection
+func (e *gqlExecution) included(selection gqlSelection) bool {
+	if skip, found := selection.Directives["skip"]; found && e.resolveValue(skip["if"]) == true {
+		return false
+	}
+	if include, found := selection.Directives["include"]; found && e.resolveValue(include["if"]) != true {
+		return false
+	}
+	return true
+}
+
+// gqlField is a selected field after fragments have been flattened
+type gqlField struct {
+	key       string // response key, the alias if any
+	selection gqlSelection
+}
+
+// collectFields flattens the fragments of a selection set applying to typename
+func (e *gqlExecution) collectFields(typename string, selections []gqlSelection) []gqlField {
+	fields := []gqlField{}
+	for _, selection := range selections {
+		if !e.included(selection) {
+			continue
+		}
+		switch {
+		case selection.FragmentSpread != "":
+			fragment, found := e.doc.Fragments[selection.FragmentSpread]
+			if found && (fragment.TypeCondition == typename || typename == "") {
+				fields = append(fields, e.collectFields(typename, fragment.Selections)...)
+			}
+		case selection.InlineFragment:
+			if selection.TypeCondition == "" || selection.TypeCondition == typename || typename == "" {
+				fields = append(fields, e.collectFields(typename, selection.Selections)...)
+			}
+		default:
+			key := selection.Name
+			if selection.Alias != "" {
+				key = selection.Alias
+			}
+			fields = append(fields, gqlField{key, selection})
+		}
+	}
+	return fields
+}
+
+// addError records an error for the field at path
+func (e *gqlExecution) addError(err error, path []interface{}) {
+	gerr, ok := err.(gqlError)
+	if !ok {
+		gerr = gqlError{Message: err.Error()}
+		if code := gqlErrorCode(err); code != "" {
+			gerr.Extensions = map[string]interface{}{"code": code}
+		}
+	}
+	gerr.Path = append([]interface{}{}, path...)
+	e.errors = append(e.errors, gerr)
+}
+
+// executeRoot resolves all root fields of the selection set with resolvers
+func (e *gqlExecution) executeRoot(typename string, selections []gqlSelection, resolvers map[string]gqlResolver) *gqlResult {
+	data := newGQLResult()
+	for _, field := range e.collectFields(typename, selections) {
+		path := []interface{}{field.key}
+		if field.selection.Name == "__typename" {
+			data.set(field.key, typename)
+			continue
+		}
+		resolver, found := resolvers[field.selection.Name]
+		if !found {
+			e.addError(fmt.Errorf("cannot query field %q on type %q", field.selection.Name, typename), path)
+			data.set(field.key, nil)
+			continue
+		}
+		value, err := resolver(e.resolveArguments(field.selection.Arguments))
+		if err != nil {
+			e.addError(err, path)
+			data.set(field.key, nil)
+			continue
+		}
+		data.set(field.key, e.complete(value, field.selection.Selections, path))
+	}
+	return data
+}
+
+// complete projects the selection set out of a resolved value
+func (e *gqlExecution) complete(value interface{}, selections []gqlSelection, path []interface{}) interface{} {
+	switch v := value.(type) {
+	case gqlObject:
+		if v == nil {
+			return nil
+		}
+		typename, _ := v["__typename"].(string)
+		if len(selections) == 0 {
+			e.addError(fmt.Errorf("field of type %q must have a selection of subfields", typename), path)
+			return nil
+		}
+		data := newGQLResult()
+		for _, field := range e.collectFields(typename, selections) {
+			fieldPath := append(append([]interface{}{}, path...), field.key)
+			fieldValue, found := v[field.selection.Name]
+			if !found {
+				e.addError(fmt.Errorf("cannot query field %q on type %q", field.selection.Name, typename), fieldPath)
+				data.set(field.key, nil)
+				continue
+			}
+			data.set(field.key, e.complete(fieldValue, field.selection.Selections, fieldPath))
+		}
+		return data
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.complete(item, selections, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	}
+	if len(selections) > 0 {
+		e.addError(fmt.Errorf("field must not have a selection since it is a scalar"), path)
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,582 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GraphQLSchema documents the GraphQL API served at /graphql
+const GraphQLSchema = `enum VMState { STOPPED STARTING RUNNING STOPPING DELETED }
+
+type VM {
+  id: Int!
+  vcpus: Int!
+  clock: Float!
+  ram: Int!
+  storage: Int!
+  network: Int!
+  state: VMState!
+  project: String!
+  protected: Boolean!
+}
+
+type Project {
+  id: String!
+  name: String
+  members: [String!]!
+}
+
+input VMFilter {
+  state: VMState
+  project: String
+  minVcpus: Int
+  maxVcpus: Int
+  minRam: Int
+  maxRam: Int
+}
+
+input VMInput {
+  vcpus: Int!
+  clock: Float!
+  ram: Int!
+  storage: Int!
+  network: Int!
+  project: String = "default"
+}
+
+type VMPage {
+  totalCount: Int!
+  offset: Int!
+  limit: Int!
+  hasNextPage: Boolean!
+  items: [VM!]!
+}
+
+enum VMEventType { CREATED STATE_CHANGED RESIZED UPDATED SNAPSHOT_RESTORED DELETED RESTORED PURGED }
+
+type VMEvent {
+  type: VMEventType!
+  id: Int!
+  time: String!
+  vm: VM!
+}
+
+type Query {
+  vms(filter: VMFilter, offset: Int = 0, limit: Int = 20): VMPage!
+  vm(id: Int!): VM
+  projects: [Project!]!
+}
+
+type Mutation {
+  launchVM(id: Int!): VM!
+  stopVM(id: Int!): VM!
+  deleteVM(id: Int!): Int!
+  createVM(input: VMInput!): VM!
+}
+
+type Subscription {
+  vmEvents(id: Int): VMEvent!
+}
+`
+
+// gqlVM returns the GraphQL object of a VM
+func gqlVM(id int, vm VM) gqlObject {
+	return gqlObject{
+		"__typename": "VM",
+		"id":         id,
+		"vcpus":      vm.VCPUS,
+		"clock":      float64(vm.Clock),
+		"ram":        vm.RAM,
+		"storage":    vm.Storage,
+		"network":    vm.Network,
+		"state":      strings.ToUpper(string(vm.State)),
+		"project":    vm.ProjectID(),
+		"protected":  vm.Protected,
+	}
+}
+
+// gqlProject returns the GraphQL object of a Project
+func gqlProject(p Project) gqlObject {
+	members := []interface{}{}
+	for _, member := range p.Members {
+		members = append(members, member)
+	}
+	return gqlObject{
+		"__typename": "Project",
+		"id":         p.ID,
+		"name":       p.Name,
+		"members":    members,
+	}
+}
+
+// gqlVMEvent returns the GraphQL object of a VMEvent
+func gqlVMEvent(event VMEvent) gqlObject {
+	return gqlObject{
+		"__typename": "VMEvent",
+		"type":       strings.ToUpper(string(event.Type)),
+		"id":         event.ID,
+		"time":       event.Time.Format(time.RFC3339Nano),
+		"vm":         gqlVM(event.ID, event.VM),
+	}
+}
+
+// gqlErrorCode returns the code for the "extensions" of a GraphQL error
+func gqlErrorCode(err error) ErrorCode {
+	var cerr *CloudError
+	if errors.As(err, &cerr) {
+		return cerr.Code
+	}
+	var aerr *AuthError
+	if errors.As(err, &aerr) {
+		return aerr.Code
+	}
+	return ""
+}
+
+// argInt reads an Int argument, or returns def if missing
+func argInt(args map[string]interface{}, name string, def int) (int, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return v, nil
+	case float64: // from JSON variables
+		if v == math.Trunc(v) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an Int, got %v", name, args[name])
+}
+
+// argFloat reads a Float argument, or returns def if missing
+func argFloat(args map[string]interface{}, name string, def float64) (float64, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("argument %q must be a Float, got %v", name, args[name])
+}
+
+// argString reads a String argument, or returns def if missing
+func argString(args map[string]interface{}, name string, def string) (string, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return def, nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %q must be a String, got %v", name, args[name])
+}
+
+// argObject reads an input object argument, which might be missing
+func argObject(args map[string]interface{}, name string) (map[string]interface{}, error) {
+	switch v := args[name].(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return v, nil
+	}
+	return nil, fmt.Errorf("argument %q must be an input object, got %v", name, args[name])
+}
+
+// argState reads a VMState enum argument, or returns "" if missing
+func argState(args map[string]interface{}, name string) (VMState, error) {
+	value, found := args[name]
+	if !found || value == nil {
+		return "", nil
+	}
+	for _, state := range VMStates {
+		if value == strings.ToUpper(string(state)) {
+			return state, nil
+		}
+	}
+	return "", fmt.Errorf("argument %q must be a VMState, got %v", name, value)
+}
+
+// gqlFilter matches VMs against a VMFilter input
+type gqlFilter struct {
+	state              VMState
+	project            string
+	minVCPUS, maxVCPUS int
+	minRAM, maxRAM     int
+}
+
+func newGQLFilter(input map[string]interface{}) (gqlFilter, error) {
+	var f gqlFilter
+	var err error
+	if f.state, err = argState(input, "state"); err != nil {
+		return f, err
+	}
+	if f.project, err = argString(input, "project", ""); err != nil {
+		return f, err
+	}
+	if f.minVCPUS, err = argInt(input, "minVcpus", 0); err != nil {
+		return f, err
+	}
+	if f.maxVCPUS, err = argInt(input, "maxVcpus", math.MaxInt32); err != nil {
+		return f, err
+	}
+	if f.minRAM, err = argInt(input, "minRam", 0); err != nil {
+		return f, err
+	}
+	f.maxRAM, err = argInt(input, "maxRam", math.MaxInt32)
+	return f, err
+}
+
+func (f gqlFilter) matches(vm VM) bool {
+	return (f.state == "" || vm.State == f.state) &&
+		(f.project == "" || vm.ProjectID() == f.project) &&
+		vm.VCPUS >= f.minVCPUS && vm.VCPUS <= f.maxVCPUS &&
+		vm.RAM >= f.minRAM && vm.RAM <= f.maxRAM
+}
+
+// gqlQueries returns the Query root resolvers over the Cloud,
+// limited to the projects access allows
+func (c *Cloud) gqlQueries(access func(projectID string) bool) map[string]gqlResolver {
+	return map[string]gqlResolver{
+		"vms": func(args map[string]interface{}) (interface{}, error) {
+			input, err := argObject(args, "filter")
+			if err != nil {
+				return nil, err
+			}
+			filter, err := newGQLFilter(input)
+			if err != nil {
+				return nil, err
+			}
+			offset, err := argInt(args, "offset", 0)
+			if err != nil {
+				return nil, err
+			}
+			limit, err := argInt(args, "limit", DefaultPageLimit)
+			if err != nil {
+				return nil, err
+			}
+			if offset < 0 || limit < 0 {
+				return nil, fmt.Errorf("offset and limit must be non negative")
+			}
+			vms := c.List()
+			if filter.state == DELETED {
+				vms = c.Trash()
+			}
+			ids := vms.sortedIDs()
+			items := []gqlObject{}
+			total := 0
+			for _, id := range ids {
+				if !filter.matches(vms[id]) || !access(vms[id].ProjectID()) {
+					continue
+				}
+				if total >= offset && len(items) < limit {
+					items = append(items, gqlVM(id, vms[id]))
+				}
+				total++
+			}
+			return gqlObject{
+				"__typename":  "VMPage",
+				"totalCount":  total,
+				"offset":      offset,
+				"limit":       limit,
+				"hasNextPage": offset+limit < total,
+				"items":       items,
+			}, nil
+		},
+		"vm": func(args map[string]interface{}) (interface{}, error) {
+			id, err := argInt(args, "id", NoVMID)
+			if err != nil {
+				return nil, err
+			}
+			if vm, found := c.Inspect(id); found && access(vm.ProjectID()) {
+				return gqlVM(id, vm), nil
+			}
+			return gqlObject(nil), nil
+		},
+		"projects": func(args map[string]interface{}) (interface{}, error) {
+			projects := []gqlObject{}
+			for _, p := range c.ListProjects() {
+				if access(p.ID) {
+					projects = append(projects, gqlProject(p))
+				}
+			}
+			return projects, nil
+		},
+	}
+}
+
+// gqlMutations returns the Mutation root resolvers over the Cloud,
+// limited to the projects access allows
+func (c *Cloud) gqlMutations(access func(projectID string) bool) map[string]gqlResolver {
+	// accessibleID reads the id argument of a VM access allows
+	accessibleID := func(args map[string]interface{}) (int, error) {
+		id, err := argInt(args, "id", NoVMID)
+		if err != nil {
+			return id, err
+		}
+		if vm, found := c.Inspect(id); found && !access(vm.ProjectID()) {
+			return id, cloudErrorf(VMNotFound, id, "not found VM with id %d", id)
+		}
+		return id, nil
+	}
+	// transition wraps Launch & Stop, returning the VM after the change
+	transition := func(f func(int) (chan struct{}, error)) gqlResolver {
+		return func(args map[string]interface{}) (interface{}, error) {
+			id, err := accessibleID(args)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := f(id); err != nil {
+				return nil, err
+			}
+			vm, _ := c.Inspect(id)
+			return gqlVM(id, vm), nil
+		}
+	}
+	return map[string]gqlResolver{
+		"launchVM": transition(c.Launch),
+		"stopVM":   transition(c.Stop),
+		"deleteVM": func(args map[string]interface{}) (interface{}, error) {
+			id, err := accessibleID(args)
+			if err != nil {
+				return nil, err
+			}
+			return id, c.Delete(id)
+		},
+		"createVM": func(args map[string]interface{}) (interface{}, error) {
+			input, err := argObject(args, "input")
+			if err != nil {
+				return nil, err
+			}
+			var spec VM
+			var clock float64
+			for name, field := range map[string]*int{
+				"vcpus": &spec.VCPUS, "ram": &spec.RAM, "storage": &spec.Storage, "network": &spec.Network,
+			} {
+				if *field, err = argInt(input, name, 0); err != nil {
+					return nil, err
+				}
+			}
+			if clock, err = argFloat(input, "clock", 0); err != nil {
+				return nil, err
+			}
+			spec.Clock = float32(clock)
+			if spec.Project, err = argString(input, "project", DefaultProjectID); err != nil {
+				return nil, err
+			}
+			if !access(spec.Project) {
+				return nil, cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", spec.Project)
+			}
+			id, err := c.Create(spec)
+			if err != nil {
+				return nil, err
+			}
+			vm, _ := c.Inspect(id)
+			return gqlVM(id, vm), nil
+		},
+	}
+}
+
+// gqlSubscriptions returns the Subscription root fields over the Cloud,
+// as filters of the Cloud VM events of the projects access allows
+func (c *Cloud) gqlSubscriptions(access func(projectID string) bool) map[string]func(args map[string]interface{}) (func(VMEvent) bool, error) {
+	return map[string]func(args map[string]interface{}) (func(VMEvent) bool, error){
+		"vmEvents": func(args map[string]interface{}) (func(VMEvent) bool, error) {
+			id, err := argInt(args, "id", NoVMID)
+			if err != nil {
+				return nil, err
+			}
+			return func(event VMEvent) bool {
+				return (id == NoVMID || event.ID == id) && access(event.VM.ProjectID())
+			}, nil
+		},
+	}
+}
+
+// writeGraphQL dumps a GraphQL response as JSON
+func writeGraphQL(w http.ResponseWriter, status int, response gqlResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("error generating GraphQL JSON for %#v: %v", response, err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"data":null,"errors":[{"message":"internal error"}]}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(body))
+}
+
+// requestFailed replies with a GraphQL request error (parsing, validation...)
+func requestFailed(w http.ResponseWriter, code string, err error) {
+	writeGraphQL(w, http.StatusBadRequest, gqlResponse{Errors: []gqlError{{
+		Message:    err.Error(),
+		Extensions: map[string]interface{}{"code": code},
+	}}})
+}
+
+// readGraphQLRequest gets the GraphQL request from a POST JSON body or GET query
+func readGraphQLRequest(r *http.Request) (gqlRequest, error) {
+	var req gqlRequest
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Query = query.Get("query")
+		req.OperationName = query.Get("operationName")
+		if variables := query.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				return req, fmt.Errorf("variables must be a JSON object: %v", err)
+			}
+		}
+		return req, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, fmt.Errorf("body must be a JSON GraphQL request: %v", err)
+	}
+	return req, nil
+}
+
+// graphql executes GraphQL requests against the server Cloud,
+// subscriptions are streamed as Server-Sent Events
+func (s *VMServer) graphql(w http.ResponseWriter, r *http.Request) {
+	req, err := readGraphQLRequest(r)
+	if err != nil {
+		requestFailed(w, "BAD_USER_INPUT", err)
+		return
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		requestFailed(w, "GRAPHQL_PARSE_FAILED", err)
+		return
+	}
+	if err := doc.checkFragmentCycles(); err != nil {
+		requestFailed(w, "GRAPHQL_VALIDATION_FAILED", err)
+		return
+	}
+	op, err := doc.selectOperation(req.OperationName)
+	if err == nil {
+		err = doc.checkFieldCount(op)
+	}
+	if err != nil {
+		requestFailed(w, "GRAPHQL_VALIDATION_FAILED", err)
+		return
+	}
+	if op.Type == "mutation" { // queries & subscriptions change nothing
+		auditRequest(w)
+	}
+	if op.Type != "query" && r.Method == http.MethodGet {
+		requestFailed(w, "GRAPHQL_VALIDATION_FAILED", fmt.Errorf("%s operations must use POST", op.Type))
+		return
+	}
+	variables, err := op.coerceVariables(req.Variables)
+	if err != nil {
+		requestFailed(w, "BAD_USER_INPUT", err)
+		return
+	}
+	e := &gqlExecution{doc: doc, variables: variables}
+	var data *gqlResult
+	switch op.Type {
+	case "query":
+		data = e.executeRoot("Query", op.Selections, s.vmm.gqlQueries(s.projectAccess(r)))
+	case "mutation":
+		mutations := s.vmm.gqlMutations(s.projectAccess(r))
+		if identity, found := identityOf(r); found && s.auth != nil {
+			if err := authorizeScope(identity, ScopeWrite); err != nil {
+				writeAuthError(w, r, err)
+				return
+			}
+			for name := range mutations {
+				if err := authorizeRole(identity, gqlMutationRoles[name]); err != nil {
+					mutations[name] = func(map[string]interface{}) (interface{}, error) {
+						return nil, err
+					}
+				}
+			}
+		}
+		data = e.executeRoot("Mutation", op.Selections, mutations)
+	case "subscription":
+		s.subscribe(w, r, e, op)
+		return
+	}
+	writeGraphQL(w, http.StatusOK, gqlResponse{Data: data, Errors: e.errors})
+}
+
+// subscribe streams the events selected by the subscription operation as
+// Server-Sent Events, until the client disconnects
+func (s *VMServer) subscribe(w http.ResponseWriter, r *http.Request, e *gqlExecution, op *gqlOperation) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		requestFailed(w, "GRAPHQL_VALIDATION_FAILED",
+			fmt.Errorf("subscriptions are streamed, they require an Accept: text/event-stream header"))
+		return
+	}
+	fields := e.collectFields("Subscription", op.Selections)
+	if len(fields) != 1 {
+		requestFailed(w, "GRAPHQL_VALIDATION_FAILED", fmt.Errorf("subscriptions must select exactly one root field"))
+		return
+	}
+	field := fields[0]
+	subscription, found := s.vmm.gqlSubscriptions(s.projectAccess(r))[field.selection.Name]
+	if !found {
+		requestFailed(w, "GRAPHQL_VALIDATION_FAILED",
+			fmt.Errorf("cannot query field %q on type %q", field.selection.Name, "Subscription"))
+		return
+	}
+	accepts, err := subscription(e.resolveArguments(field.selection.Arguments))
+	if err != nil {
+		requestFailed(w, "BAD_USER_INPUT", err)
+		return
+	}
+
+	events, cancel := s.vmm.Subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-events:
+			if !open {
+				fmt.Fprint(w, "event: complete\ndata:\n\n")
+				flusher.Flush()
+				return
+			}
+			if !accepts(event) {
+				continue
+			}
+			e.errors = nil
+			path := []interface{}{field.key}
+			data := newGQLResult()
+			data.set(field.key, e.complete(gqlVMEvent(event), field.selection.Selections, path))
+			body, err := json.Marshal(gqlResponse{Data: data, Errors: e.errors})
+			if err != nil {
+				log.Printf("error generating GraphQL JSON for event %#v: %v", event, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: next\ndata: %s\n\n", body)
+			flusher.Flush()
+		}
+	}
+}
+
+// graphqlSchema dumps the GraphQL schema in SDL
+func (s *VMServer) graphqlSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, GraphQLSchema)
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postGraphQL runs the GraphQL request against the server
+func postGraphQL(t *testing.T, s *VMServer, query string, variables map[string]interface{}) (int, gqlResponse) {
+	t.Helper()
+	body, err := json.Marshal(gqlRequest{Query: query, Variables: variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	w := serveRequest(s, r)
+	var response gqlResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse GraphQL response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, response
+}
+
+// toJSON normalizes a value to compare it against a parsed response
+func toJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	body, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+var graphqlCases = []struct {
+	query     string
+	variables map[string]interface{}
+	want      string
+}{
+	{
+		query: `{ vm(id: 1) { id state ram } }`,
+		want:  `{"vm":{"id":1,"ram":32768,"state":"STOPPED"}}`,
+	},
+	{
+		query:     `query One($id: Int!) { first: vm(id: $id) { __typename vcpus } missing: vm(id: 10000) { id } }`,
+		variables: map[string]interface{}{"id": 0},
+		want:      `{"first":{"__typename":"VM","vcpus":1},"missing":null}`,
+	},
+	{
+		query: `query {
+			vms(filter: {minVcpus: 2}, limit: 1) {
+				totalCount hasNextPage
+				items { ...Spec }
+			}
+		}
+		fragment Spec on VM { id vcpus ... on VM { clock } network @skip(if: true) }`,
+		want: `{"vms":{"hasNextPage":true,"items":[{"clock":3600,"id":1,"vcpus":4}],"totalCount":2}}`,
+	},
+	{
+		query: `query($all: Boolean = false) { vms(filter: {state: RUNNING}) { totalCount items @include(if: $all) { id } } }`,
+		want:  `{"vms":{"totalCount":0}}`,
+	},
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	for _, tc := range graphqlCases {
+		status, response := postGraphQL(t, NewDefaultServer(), tc.query, tc.variables)
+		if status != http.StatusOK || len(response.Errors) > 0 {
+			t.Fatalf("%s got status: %d, errors: %v", tc.query, status, response.Errors)
+		}
+		if got := toJSON(t, response.Data); got != tc.want {
+			t.Fatalf("%s got: %s, want: %s", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	shrinkTime()
+	s := NewDefaultServer()
+	_, response := postGraphQL(t, s, `mutation($spec: VMInput!) {
+		createVM(input: $spec) { id state }
+		launchVM(id: 1) { state }
+		deleteVM(id: 2)
+	}`, map[string]interface{}{
+		"spec": map[string]interface{}{"vcpus": 2, "clock": 1800.5, "ram": 2048, "storage": 64, "network": 1000},
+	})
+	want := `{"createVM":{"id":3,"state":"STOPPED"},"deleteVM":2,"launchVM":{"state":"STARTING"}}`
+	if got := toJSON(t, response.Data); got != want || len(response.Errors) > 0 {
+		t.Fatalf("got: %s, errors: %v, want: %s", got, response.Errors, want)
+	}
+	if vm, _ := s.vmm.Inspect(3); vm.Clock != 1800.5 {
+		t.Fatalf("got created: %v", vm)
+	}
+	_, response = postGraphQL(t, s, `{ vms(filter: {state: DELETED}) { items { id state } } }`, nil)
+	want = `{"vms":{"items":[{"id":2,"state":"DELETED"}]}}`
+	if got := toJSON(t, response.Data); got != want || len(response.Errors) > 0 {
+		t.Fatalf("got: %s, errors: %v, want: %s", got, response.Errors, want)
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	_, response := postGraphQL(t, NewDefaultServer(), `mutation { stopVM(id: 1) { state } }`, nil)
+	want := `[{"message":"illegal transition from \"Stopped\" to \"Stopping\"","path":["stopVM"],"extensions":{"code":"ILLEGAL_TRANSITION"}}]`
+	if got := toJSON(t, response.Errors); got != want || toJSON(t, response.Data) != `{"stopVM":null}` {
+		t.Fatalf("got: %s, data: %v, want: %s", got, response.Data, want)
+	}
+
+	status, response := postGraphQL(t, NewDefaultServer(), `{ vm(id: 1) { id `, nil)
+	if status != http.StatusBadRequest || len(response.Errors) != 1 || response.Data != nil {
+		t.Fatalf("got status: %d, response: %+v", status, response)
+	}
+	if code := response.Errors[0].Extensions["code"]; code != "GRAPHQL_PARSE_FAILED" {
+		t.Fatalf("got code: %v, want: GRAPHQL_PARSE_FAILED", code)
+	}
+
+	status, response = postGraphQL(t, NewDefaultServer(), `{ ...A } fragment A on Query { ...A }`, nil)
+	if status != http.StatusBadRequest || len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "GRAPHQL_VALIDATION_FAILED" {
+		t.Fatalf("got status: %d, response: %+v, want the fragment cycle rejected", status, response)
+	}
+	status, response = postGraphQL(t, NewDefaultServer(), `{ vm(id: 1) { ...A } } fragment A on VM { id ...B } fragment B on VM { ... on VM { ...A } }`, nil)
+	if status != http.StatusBadRequest || len(response.Errors) != 1 {
+		t.Fatalf("got status: %d, response: %+v, want the indirect fragment cycle rejected", status, response)
+	}
+	wide := `{ vm(id: 1) { ...F0 } }`
+	for i := 0; i < 10; i++ {
+		wide += fmt.Sprintf(" fragment F%d on VM { %s}", i, strings.Repeat(fmt.Sprintf("...F%d ", i+1), 10))
+	}
+	wide += " fragment F10 on VM { id }"
+	if status, response = postGraphQL(t, NewDefaultServer(), wide, nil); status != http.StatusBadRequest ||
+		len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "GRAPHQL_VALIDATION_FAILED" {
+		t.Fatalf("got status: %d, response: %+v, want the exploding fragments rejected", status, response)
+	}
+	deep := `{ vms(filter: ` + strings.Repeat("[", MaxGQLDepth) + strings.Repeat("]", MaxGQLDepth) + `) { totalCount } }`
+	if status, response = postGraphQL(t, NewDefaultServer(), deep, nil); status != http.StatusBadRequest ||
+		len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != "GRAPHQL_PARSE_FAILED" {
+		t.Fatalf("got status: %d, response: %+v, want the deep value rejected", status, response)
+	}
+	deep = "{ " + strings.Repeat("vm(id: 1) { ", MaxGQLDepth) + "id" + strings.Repeat(" }", MaxGQLDepth+1)
+	if status, response = postGraphQL(t, NewDefaultServer(), deep, nil); status != http.StatusBadRequest ||
+		!strings.Contains(response.Errors[0].Message, "nesting deeper") {
+		t.Fatalf("got status: %d, want the deep selection sets rejected", status)
+	}
+
+	_, response = postGraphQL(t, NewDefaultServer(), `{ vm(id: 1) { cpus } }`, nil)
+	want = `[{"message":"cannot query field \"cpus\" on type \"VM\"","path":["vm","cpus"]}]`
+	if got := toJSON(t, response.Errors); got != want {
+		t.Fatalf("got: %s, want: %s", got, want)
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	shrinkTime()
+	s := NewDefaultServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.ServeVM))
+	defer ts.Close()
+
+	body := `{"query":"subscription { vmEvents(id: 1) { type vm { state } } }"}`
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/graphql", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type: %q, want: text/event-stream", ct)
+	}
+
+	if _, err := s.vmm.Launch(2); err != nil { // filtered out
+		t.Fatal(err)
+	}
+	done, err := s.vmm.Launch(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(done, 10*StartDelay); err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				lines <- strings.TrimPrefix(scanner.Text(), "data: ")
+			}
+		}
+	}()
+	for _, want := range []string{
+		`{"data":{"vmEvents":{"type":"STATE_CHANGED","vm":{"state":"STARTING"}}}}`,
+		`{"data":{"vmEvents":{"type":"STATE_CHANGED","vm":{"state":"RUNNING"}}}}`,
+	} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("got: %s, want: %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for %s", want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// HALLink is a HAL link object, extended with the HTTP method to use
+type HALLink struct {
+	Href   string `json:"href"`
+	Method string `json:"method,omitempty"`
+}
+
+// VMAction is an action which can be performed on a VM through the API
+type VMAction struct {
+	Rel    string
+	Method string
+	Suffix string // of the VM path
+	Legal  func(vm VM) bool
+}
+
+// VMActions lists the actions on a VM linked from its representation
+var VMActions = []VMAction{
+	{"launch", http.MethodPut, "/launch", func(vm VM) bool {
+		return AllowedTransition[vm.State] == STARTING
+	}},
+	{"stop", http.MethodPut, "/stop", func(vm VM) bool {
+		return AllowedTransition[vm.State] == STOPPING
+	}},
+	{"reboot", http.MethodPut, "/reboot", func(vm VM) bool {
+		return AllowedTransition[vm.State] == STOPPING
+	}},
+	{"resize", http.MethodPut, "/resize", func(vm VM) bool {
+		return vm.State == STOPPED
+	}},
+	{"delete", http.MethodDelete, "", func(vm VM) bool {
+		return vm.State == STOPPED && !vm.Protected
+	}},
+}
+
+// vmLinks returns the HAL links of VM id: self and the actions legal
+// in the VM current state, with attached volumes
+func vmLinks(r *http.Request, id int, vm VM, attached int) map[string]HALLink {
+	self := versionedPath(r, fmt.Sprintf("/vms/%d", id))
+	links := map[string]HALLink{"self": {Href: self}}
+	for _, action := range VMActions {
+		if action.Legal(vm) {
+			href := self + action.Suffix
+			if action.Method == http.MethodDelete && attached > 0 {
+				href += "?force=true" // detaching the volumes, not to fail
+			}
+			links[action.Rel] = HALLink{Href: href, Method: action.Method}
+		}
+	}
+	return links
+}
+
+// withLinks adds the HAL links to the VM resource
+func (s *VMServer) withLinks(r *http.Request, resource VMResource) VMResource {
+	resource.Links = vmLinks(r, resource.ID, resource.VM, s.vmm.AttachedVolumes(resource.ID))
+	return resource
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryLog is the default file of the -history event log
+const HistoryLog = "vms-history.log"
+
+// MaxHistoryEvents is how many events are kept in memory, the -history
+// event log keeps them all. Older ones are compacted into the creation of
+// the VMs they resulted in.
+const MaxHistoryEvents = 10000
+
+// StartHistory starts recording the VM events of this Cloud after the
+// given past ones, or after the creation of its current VMs right now if
+// there are none. Returns the creation events recorded, if any.
+func (c *Cloud) StartHistory(events []VMEvent) []VMEvent {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(events) > 0 {
+		c.history = append([]VMEvent{}, events...)
+		c.compactLocked()
+		return nil
+	}
+	now := time.Now()
+	vms := c.store.List()
+	ids := make([]int, 0, len(vms))
+	for id := range vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	c.history = make([]VMEvent, 0, len(ids))
+	for _, id := range ids {
+		c.history = append(c.history, VMEvent{Type: VMCreated, ID: id, VM: vms[id], Time: now})
+	}
+	return append([]VMEvent{}, c.history...)
+}
+
+// record the event in the history, if started, the caller must hold the lock
+func (c *Cloud) record(event VMEvent) {
+	if c.history == nil {
+		return
+	}
+	c.history = append(c.history, event)
+	c.compactLocked()
+	if c.onEvent != nil {
+		c.onEvent(event)
+	}
+}
+
+// compactLocked folds the oldest events, down to half MaxHistoryEvents
+// once exceeded, into the creation of the VMs they resulted in at the time
+// of the last one folded, where the history starts from then on.
+// The caller must hold the lock.
+func (c *Cloud) compactLocked() {
+	if len(c.history) <= MaxHistoryEvents {
+		return
+	}
+	folded := c.history[:len(c.history)-MaxHistoryEvents/2]
+	start := folded[len(folded)-1].Time
+	vms := replayEvents(folded, time.Time{})
+	history := make([]VMEvent, 0, len(vms)+MaxHistoryEvents/2)
+	for _, id := range vms.sortedIDs() {
+		history = append(history, VMEvent{Type: VMCreated, ID: id, VM: vms[id], Time: start})
+	}
+	c.history = append(history, c.history[len(folded):]...)
+}
+
+// ListAt returns the VMs as they were at the given time, replaying the
+// history up to then. A CloudError is returned for times before the history.
+func (c *Cloud) ListAt(at time.Time) (VMs, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if len(c.history) == 0 || at.Before(c.history[0].Time) {
+		return nil, cloudErrorf(BadRequest, NoVMID, "no history before %v", c.historyStartLocked().Format(time.RFC3339))
+	}
+	return replayEvents(c.history, at).withUptime(at), nil
+}
+
+// historyStartLocked is the time of the first event, now if there is none
+func (c *Cloud) historyStartLocked() time.Time {
+	if len(c.history) == 0 {
+		return time.Now()
+	}
+	return c.history[0].Time
+}
+
+// History returns the events of VM id, oldest first, even if it was deleted.
+// Returns false if the VM has no events.
+func (c *Cloud) History(id int) ([]VMEvent, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	events := []VMEvent{}
+	for _, event := range c.history {
+		if event.ID == id {
+			events = append(events, event)
+		}
+	}
+	return events, len(events) > 0
+}
+
+// replayEvents returns the VMs resulting from the events up to the given
+// time, all of them if it is zero
+func replayEvents(events []VMEvent, at time.Time) VMs {
+	vms := make(VMs)
+	for _, event := range events {
+		if !at.IsZero() && event.Time.After(at) {
+			break
+		}
+		switch event.Type {
+		case VMDeleted, VMPurged:
+			delete(vms, event.ID)
+		default:
+			vms[event.ID] = event.VM
+		}
+	}
+	return vms
+}
+
+// EventLog appends VM events as JSON lines to a file
+type EventLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// OpenEventLog opens the event log in filename for appending, creating it
+// if missing. Returns the events logged so far too, skipping broken lines
+// (like the last one of a crash).
+func OpenEventLog(filename string) (*EventLog, []VMEvent, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("error reading event log %q: %v", filename, err)
+	}
+	events := []VMEvent{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		var event VMEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Type == "" {
+			log.Printf("Skipping broken line %d of event log %q", line, filename)
+			continue
+		}
+		events = append(events, event)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening event log %q: %v", filename, err)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' { // end the broken line
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("error appending to event log %q: %v", filename, err)
+		}
+	}
+	return &EventLog{file: file}, events, nil
+}
+
+// Append the events to the log
+func (l *EventLog) Append(events ...VMEvent) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error appending to event log %q: %v", l.file.Name(), err)
+	}
+	return nil
+}
+
+// Close the log file
+func (l *EventLog) Close() error {
+	return l.file.Close()
+}
+
+// listAt replies the VMs at the time of the at query parameter
+func (s *VMServer) listAt(r *http.Request) (VMs, error) {
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		return nil, cloudErrorf(BadRequest, NoVMID, "bad at time, use RFC 3339 like 2026-01-01T10:00:00Z: %v", err)
+	}
+	return s.vmm.ListAt(at)
+}
+
+func (s *VMServer) history(id int, w http.ResponseWriter, r *http.Request) {
+	events, found := s.vmm.History(id)
+	if !found || events[len(events)-1].VM.ProjectID() != projectOf(r) {
+		writeError(w, r, cloudErrorf(VMNotFound, id, "not found history of VM %d", id))
+		return
+	}
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, events)
+		return
+	}
+	links := map[string]string{"self": versionedPath(r, fmt.Sprintf("/vms/%d/history", id))}
+	if last := events[len(events)-1].Type; last != VMDeleted && last != VMPurged {
+		links["vm"] = versionedPath(r, fmt.Sprintf("/vms/%d", id))
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: events, Links: links})
+}
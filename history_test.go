@@ -0,0 +1,191 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// eventTypes lists the types of the events
+func eventTypes(events []VMEvent) []VMEventType {
+	types := []VMEventType{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestHistory(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	if _, err := c.ListAt(time.Now()); err == nil {
+		t.Fatalf("got no error, want no history before StartHistory")
+	}
+	if created := c.StartHistory(nil); len(created) != len(defaultVMs) {
+		t.Fatalf("got %d creation events, want %d", len(created), len(defaultVMs))
+	}
+	started := time.Now()
+	done, err := c.Launch(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := waitDone(done, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	past, err := c.ListAt(started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(past, defaultVMs) {
+		t.Errorf("got: %v, want: %v", past, defaultVMs)
+	}
+	if now, _ := c.ListAt(time.Now()); !reflect.DeepEqual(now, c.List()) {
+		t.Errorf("got: %v, want: %v", now, c.List())
+	}
+	var cerr *CloudError
+	if _, err := c.ListAt(started.Add(-time.Hour)); !errors.As(err, &cerr) || cerr.Code != BadRequest {
+		t.Errorf("got: %v, want a %v error before the history", err, BadRequest)
+	}
+
+	events, _ := c.History(GoodID)
+	if got, want := eventTypes(events), []VMEventType{VMCreated, VMStateChanged, VMStateChanged}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+	if events[2].VM.State != RUNNING {
+		t.Errorf("got: %v, want: %v", events[2].VM.State, RUNNING)
+	}
+	if events, found := c.History(0); !found || events[len(events)-1].Type != VMDeleted {
+		t.Errorf("got: %v, want the deletion of VM 0 last", events)
+	}
+	if _, found := c.History(BadID); found {
+		t.Errorf("got history of VM %d, want none", BadID)
+	}
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	c := NewDefaultCloud()
+	c.StartHistory(nil)
+	started := time.Now()
+	if err := c.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < MaxHistoryEvents; i++ {
+		if _, err := c.Protect(GoodID, i%2 == 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.history) > MaxHistoryEvents {
+		t.Fatalf("got %d events, want at most %d", len(c.history), MaxHistoryEvents)
+	}
+	if got := eventTypes(c.history[:len(defaultVMs)-1]); !reflect.DeepEqual(got, []VMEventType{VMCreated, VMCreated}) {
+		t.Fatalf("got: %v, want the remaining VMs created first", got)
+	}
+	if now, _ := c.ListAt(time.Now()); !reflect.DeepEqual(now, c.List()) {
+		t.Errorf("got: %v, want: %v", now, c.List())
+	}
+	if _, err := c.ListAt(started); err == nil {
+		t.Errorf("got no error, want no history before the compaction")
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, HistoryLog)
+	eventLog, events, err := OpenEventLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("got: %v, want no events", events)
+	}
+	now := time.Now().UTC().Round(0)
+	vm := defaultVMs[GoodID]
+	starting, _ := vm.WithState(STARTING)
+	want := []VMEvent{
+		{Type: VMCreated, ID: GoodID, VM: vm, Time: now},
+		{Type: VMStateChanged, ID: GoodID, VM: starting, Time: now.Add(time.Second)},
+	}
+	if err := eventLog.Append(want...); err != nil {
+		t.Fatal(err)
+	}
+	eventLog.file.WriteString(`{"type":"deleted","id":`) // a crash
+	eventLog.Close()
+
+	eventLog, events, err = OpenEventLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got: %v, want: %v", events, want)
+	}
+	if got := replayEvents(events, time.Time{}); got[GoodID] != starting {
+		t.Errorf("got: %v, want VM %d %v", got, GoodID, STARTING)
+	}
+	if got := replayEvents(events, now); got[GoodID] != vm {
+		t.Errorf("got: %v, want VM %d %v", got, GoodID, STOPPED)
+	}
+}
+
+func TestHistoryAPI(t *testing.T) {
+	s := NewDefaultServer()
+	s.vmm.StartHistory(nil)
+	started := time.Now().UTC()
+	if err := s.vmm.Delete(GoodID); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(s, http.MethodGet, "/vms?at="+started.Format(time.RFC3339Nano))
+	var vms VMs
+	if err := json.Unmarshal(w.Body.Bytes(), &vms); err != nil {
+		t.Fatalf("Failed to parse VMs %q: %v", w.Body.String(), err)
+	}
+	if _, found := vms[GoodID]; !found || len(vms) != len(defaultVMs) {
+		t.Errorf("got: %v, want VM %d before its deletion", vms, GoodID)
+	}
+	ids := []int{}
+	for next := "/v2/vms?limit=2&at=" + url.QueryEscape(started.Format(time.RFC3339Nano)); next != ""; {
+		var page []VMResource
+		envelope := decodeEnvelope(t, serve(s, http.MethodGet, next), &page)
+		for _, vm := range page {
+			ids = append(ids, vm.ID)
+		}
+		next = envelope.Links["next"]
+	}
+	if want := defaultVMs.sortedIDs(); !reflect.DeepEqual(ids, want) {
+		t.Errorf("got paged ids: %v, want: %v before the deletion", ids, want)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodGet, "/vms?at=yesterday")); p.Code != BadRequest {
+		t.Errorf("got: %v, want: %v", p.Code, BadRequest)
+	}
+
+	var events []VMEvent
+	envelope := decodeEnvelope(t, serve(s, http.MethodGet, "/v2/vms/1/history"), &events)
+	if got, want := eventTypes(events), []VMEventType{VMCreated, VMDeleted}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+	if _, found := envelope.Links["vm"]; found {
+		t.Errorf("got links: %v, want no link to the deleted VM", envelope.Links)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodGet, "/vms/99/history")); p.Code != VMNotFound {
+		t.Errorf("got: %v, want: %v", p.Code, VMNotFound)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims are the JWT claims of bearer tokens
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud,omitempty"`
+	Scope     string `json:"scope,omitempty"` // space separated
+	Roles     []Role `json:"roles,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// ErrTokenExpired is returned when verifying an expired token
+var ErrTokenExpired = errors.New("token expired")
+
+var b64 = base64.RawURLEncoding
+
+// encodeJWT returns the compact serialization of a JWT, signed by sign
+func encodeJWT(header jwtHeader, claims interface{}, sign func(input []byte) ([]byte, error)) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64.EncodeToString(headerJSON) + "." + b64.EncodeToString(claimsJSON)
+	signature, err := sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64.EncodeToString(signature), nil
+}
+
+// decodeJWT splits a compact JWT, checking its signature with verify and
+// parsing its claims into claims
+func decodeJWT(token string, claims interface{}, verify func(header jwtHeader, input, signature []byte) error) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("malformed token header: %v", err)
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed token signature: %v", err)
+	}
+	if err := verify(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return err
+	}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return fmt.Errorf("malformed token claims: %v", err)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	raw, err := b64.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// hs256 signs JWTs with HMAC SHA-256
+type hs256 []byte
+
+func (key hs256) sign(input []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(input)
+	return mac.Sum(nil), nil
+}
+
+func (key hs256) verify(header jwtHeader, input, signature []byte) error {
+	if header.Algorithm != "HS256" {
+		return fmt.Errorf("unexpected token algorithm %q", header.Algorithm)
+	}
+	expected, _ := key.sign(input)
+	if !hmac.Equal(expected, signature) {
+		return fmt.Errorf("invalid token signature")
+	}
+	return nil
+}
+
+// rs256 signs JWTs with RSASSA-PKCS1-v1_5 SHA-256
+type rs256 struct {
+	key   *rsa.PrivateKey
+	keyID string
+}
+
+func (k rs256) sign(input []byte) ([]byte, error) {
+	digest := sha256.Sum256(input)
+	return rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+}
+
+func (k rs256) verify(header jwtHeader, input, signature []byte) error {
+	if header.Algorithm != "RS256" {
+		return fmt.Errorf("unexpected token algorithm %q", header.Algorithm)
+	}
+	if header.KeyID != k.keyID {
+		return fmt.Errorf("unknown token key %q", header.KeyID)
+	}
+	digest := sha256.Sum256(input)
+	if err := rsa.VerifyPKCS1v15(&k.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return fmt.Errorf("invalid token signature")
+	}
+	return nil
+}
+
+// signHS256 returns a HS256 JWT with the given claims
+func signHS256(claims Claims, secret []byte) (string, error) {
+	return encodeJWT(jwtHeader{Algorithm: "HS256", Type: "JWT"}, claims, hs256(secret).sign)
+}
+
+// validAt checks the claims time window
+func (c Claims) validAt(now time.Time) error {
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return ErrTokenExpired
+	}
+	return nil
+}
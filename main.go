@@ -13,7 +13,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Version of the program.
@@ -21,47 +24,54 @@ import (
 // '2020.09.10.0'
 var Version = "Development"
 
-// loadVMs loads the VM list from a JSON file (VMS_JSON)
-func loadVMs() (VMs, error) {
+// loadState loads the projects & VM list from a JSON file (VMS_JSON)
+func loadState() (CloudState, error) {
+	var state CloudState
 	log.Printf("Loading fake Cloud state from local file %q", VMsJSON)
 	_, err := os.Stat(VMsJSON)
 	if errors.Is(err, os.ErrNotExist) {
 		log.Printf("Missing %q, generating one...", VMsJSON)
-		if err := saveVMs(defaultVMs); err != nil {
-			return nil, fmt.Errorf("error generating default %q: %v", VMsJSON, err)
+		generated, now := CloudState{Projects: defaultState.Projects, VMs: make(VMs)}, time.Now()
+		for id, vm := range defaultVMs {
+			generated.VMs[id] = vm.stamped(now)
 		}
-		log.Printf("Tip: You can tweak %q adding VMs or changing states for next run.", VMsJSON)
+		if err := saveState(generated); err != nil {
+			return state, fmt.Errorf("error generating default %q: %v", VMsJSON, err)
+		}
+		log.Printf("Tip: You can tweak %q adding VMs, projects or changing states for next run.", VMsJSON)
 	} else if err != nil {
-		return nil, fmt.Errorf("error stating %q: %v", VMsJSON, err)
+		return state, fmt.Errorf("error stating %q: %v", VMsJSON, err)
 	}
 	f, err := os.Open(VMsJSON)
 	if err != nil {
-		return nil, fmt.Errorf("error opening %q: %v", VMsJSON, err)
+		return state, fmt.Errorf("error opening %q: %v", VMsJSON, err)
 	}
 
 	defer f.Close()
 	vmsJSON, err := ioutil.ReadAll(f)
 	if err != nil {
-		return nil, fmt.Errorf("error reading %q: %v", VMsJSON, err)
+		return state, fmt.Errorf("error reading %q: %v", VMsJSON, err)
 	}
 
-	vms := make(VMs, 0)
-	err = json.Unmarshal(vmsJSON, &vms)
+	err = json.Unmarshal(vmsJSON, &state)
 	if err != nil {
-		return nil, fmt.Errorf("error JSON-parsing %q: %v", VMsJSON, err)
+		return state, fmt.Errorf("error JSON-parsing %q: %v", VMsJSON, err)
+	}
+	if state.VMs == nil {
+		state.VMs = make(VMs)
 	}
 
-	return vms, nil
+	return state, nil
 }
 
-// saveVMs saves the VM list to a JSON file (VMS_JSON)
-func saveVMs(vms VMs) error {
-	vmsJSON, err := json.Marshal(vms)
+// saveState saves the projects & VM list to a JSON file (VMS_JSON)
+func saveState(state CloudState) error {
+	vmsJSON, err := json.Marshal(state)
 	if err != nil {
 		return fmt.Errorf("error writing JSON for %q: %v", VMsJSON, err)
 	}
 
-	err = ioutil.WriteFile(VMsJSON, vmsJSON, 0644)
+	err = writeFileAtomic(VMsJSON, vmsJSON, 0644)
 	if err != nil {
 		return fmt.Errorf("error saving %q: %v", VMsJSON, err)
 	}
@@ -80,23 +90,167 @@ func mainE() error {
 	log.Printf("Test-VMBackend version %s", Version)
 	var address string
 	flag.StringVar(&address, "address", ":8080", "Listen address for the backend")
+	var auth bool
+	var authConfig string
+	flag.BoolVar(&auth, "auth", false, "Require API keys or bearer tokens")
+	flag.StringVar(&authConfig, "auth-config", AuthJSON, "Authentication config file, used with -auth")
+	cors := DefaultCORSConfig
+	cors.RegisterFlags(flag.CommandLine)
+	rateLimit := DefaultRateLimitConfig
+	rateLimit.RegisterFlags(flag.CommandLine)
+	var tlsConfig TLSConfig
+	tlsConfig.RegisterFlags(flag.CommandLine)
+	var persist bool
+	var persistInterval time.Duration
+	flag.BoolVar(&persist, "persist", false, "Save state changes back to the state file")
+	flag.DurationVar(&persistInterval, "persist-interval", 0,
+		"Save state changes at most once per interval, with -persist (default: after every change)")
+	var watch bool
+	var watchInterval time.Duration
+	flag.BoolVar(&watch, "watch", false, "Reload changes of the state file while running")
+	flag.DurationVar(&watchInterval, "watch-interval", DefaultWatchInterval,
+		"How often the state file is checked for changes, with -watch")
+	var saveOnExit bool
+	var shutdownTimeout time.Duration
+	flag.BoolVar(&saveOnExit, "save-on-exit", false, "Save the state to the state file on shutdown")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout,
+		"How long in-flight requests are waited for on shutdown")
+	var storeKind, storeFile string
+	flag.StringVar(&storeKind, "store", MemoryStoreKind,
+		"Where VMs are kept: memory (from the state file), file (a JSON file) or log (an append-only log)")
+	flag.StringVar(&storeFile, "store-file", "",
+		fmt.Sprintf("File of the file or log stores, created from the state file VMs if missing (default %q or %q)", StoreJSON, StoreLog))
+	var history string
+	flag.StringVar(&history, "history", "",
+		fmt.Sprintf("Event log to record VM changes to & rebuild the VMs from on start, eg. %q", HistoryLog))
+	var trashRetention time.Duration
+	flag.DurationVar(&trashRetention, "trash-retention", DefaultTrashRetention,
+		"How long deleted VMs are kept in the trash for restoring, 0 purges them right away")
+	var auditLog string
+	flag.StringVar(&auditLog, "audit-log", "", "File to append the audit log of mutating requests to, as JSON lines")
 	flag.Parse()
-	vms, err := loadVMs()
+	state, err := loadState()
 	if err != nil {
 		return fmt.Errorf("error loading VMs initial state: %v", err)
 	}
-	server := VMServer{Cloud{vms: vms}, address}
+	var events []VMEvent
+	var eventLog *EventLog
+	if history != "" {
+		if storeKind != MemoryStoreKind {
+			return fmt.Errorf("-history cannot be used with -store %s, which keeps the VMs already", storeKind)
+		}
+		if eventLog, events, err = OpenEventLog(history); err != nil {
+			return err
+		}
+		defer eventLog.Close()
+		if len(events) > 0 {
+			state.VMs = replayEvents(events, time.Time{})
+			state.Trash, state.Purged = replayTrash(events)
+			log.Printf("Rebuilt %d VMs from %d events of %q", len(state.VMs), len(events), history)
+		}
+	}
+	store, err := OpenStore(storeKind, storeFile, state.VMs)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	server := VMServer{vmm: Cloud{store: store, projects: state.Projects, retention: trashRetention}, address: address, audit: NewAuditLog()}
+	server.vmm.LoadTrash(state.Trash, state.Purged)
+	server.vmm.LoadSnapshots(state.Snapshots, state.LastSnapshotID)
+	server.vmm.LoadVolumes(state.Volumes, state.LastVolumeID)
+	if auditLog != "" {
+		if server.audit, err = OpenAuditLog(auditLog); err != nil {
+			return err
+		}
+		defer server.audit.Close()
+		log.Printf("Appending the audit log to %q", auditLog)
+	}
+	created := server.vmm.StartHistory(events)
+	if eventLog != nil {
+		if err := eventLog.Append(created...); err != nil {
+			return err
+		}
+		server.vmm.onEvent = func(event VMEvent) {
+			if err := eventLog.Append(event); err != nil {
+				log.Println(err)
+			}
+		}
+		log.Printf("Recording VM events to %q", history)
+	}
+	if auth {
+		config, err := loadAuthConfig(authConfig)
+		if err != nil {
+			return fmt.Errorf("error loading authentication config: %v", err)
+		}
+		if server.auth, err = NewAuthenticator(config); err != nil {
+			return fmt.Errorf("bad authentication config %q: %v", authConfig, err)
+		}
+		log.Printf("Authentication is on, see %q for API keys and users", authConfig)
+	}
+	saveTo := saveState
+	if watch {
+		watcher := NewWatcher(&server.vmm, VMsJSON, loadState)
+		saveTo = func(state CloudState) error { // not to be reloaded
+			return watcher.Write(func() error { return saveState(state) })
+		}
+		go watcher.Run(watchInterval, nil)
+		log.Printf("Watching %q for changes every %v", VMsJSON, watchInterval)
+	}
+	var save func() error // on shutdown
+	if persist {
+		persister := NewPersister(&server.vmm, persistInterval, saveTo)
+		go persister.Run(nil)
+		save = persister.Save
+		log.Printf("Persisting state changes to %q", VMsJSON)
+	} else if saveOnExit {
+		save = func() error { return saveTo(server.vmm.State()) }
+	}
+	if persist || len(events) > 0 || storeKind != MemoryStoreKind { // VMs kept across runs
+		server.vmm.Resume()
+	}
+
+	var handler http.Handler = http.HandlerFunc(server.ServeVM)
+	limiter, err := NewRateLimiter(rateLimit)
+	if err != nil {
+		return err
+	}
+	if limiter != nil {
+		handler = server.Authenticating(limiter.Handler(handler, server.ClientFor, server.EndpointFor))
+		log.Printf("Rate limiting is on, %v requests per second with bursts of %d", rateLimit.Rate, rateLimit.Burst)
+	}
 
 	log.Printf("Server listening at %v", server.address)
 	server.WriteAPIDoc(os.Stdout)
-	http.HandleFunc("/", server.ServeVM)
-	err = http.ListenAndServe(server.address, nil)
+	srv := &http.Server{Addr: server.address, Handler: cors.Handler(handler, server.MethodsFor)}
+	var certFile, keyFile string
+	if tlsConfig.Enabled {
+		if certFile, keyFile, err = tlsConfig.Files(server.address); err != nil {
+			return fmt.Errorf("error setting up TLS: %v", err)
+		}
+		log.Printf("Serving HTTPS & HTTP/2 with certificate %q", certFile)
+	}
+	served := make(chan error, 1)
+	go func() {
+		if tlsConfig.Enabled {
+			served <- srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			served <- srv.ListenAndServe()
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("Got %v, shutting down...", sig)
+		return server.Shutdown(srv, shutdownTimeout, save)
+	case err = <-served:
+	}
 	if err != nil && strings.Contains(err.Error(), "address already in use") {
 		var sb strings.Builder
 		fmt.Fprintln(&sb, err.Error())
 		fmt.Fprintf(&sb, "^ You can avoid binding issues by using the address flag:\n")
 		printDefaultsTo(&sb, flag.CommandLine)
-		return fmt.Errorf(sb.String())
+		return errors.New(sb.String())
 	}
 	return err
 }
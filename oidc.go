@@ -0,0 +1,505 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCClient is a client application allowed to use the OIDC provider
+type OIDCClient struct {
+	ClientID     string   `json:"client_id"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// AuthCodeTTL is how long authorization codes can be exchanged for tokens
+const AuthCodeTTL = time.Minute
+
+// AccessTokenType is the JWT type of OIDC access tokens, see RFC 9068
+const AccessTokenType = "at+jwt"
+
+// OIDC scopes, besides ScopeRead & ScopeWrite
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// IDTokenClaims are the claims of OIDC ID tokens
+type IDTokenClaims struct {
+	Claims
+	Nonce             string `json:"nonce,omitempty"`
+	Name              string `json:"name,omitempty"`
+	Email             string `json:"email,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// authRequest are the parameters of an authorization code request
+type authRequest struct {
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// authCode is an issued authorization code, pending to be exchanged
+type authCode struct {
+	authRequest
+	Username string
+	Expires  time.Time
+}
+
+// OIDCProvider is a minimal OpenID Connect provider for the authorization
+// code flow with PKCE, logging in the Authenticator users
+type OIDCProvider struct {
+	auth    *Authenticator
+	keyOnce sync.Once
+	key     rs256
+	mutex   sync.Mutex
+	codes   map[string]authCode
+}
+
+func newOIDCProvider(auth *Authenticator) *OIDCProvider {
+	return &OIDCProvider{auth: auth, codes: map[string]authCode{}}
+}
+
+// signer returns the token signing key, generated on first use,
+// so tokens are only valid until the server restarts
+func (p *OIDCProvider) signer() rs256 {
+	p.keyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Fatalf("error generating OIDC signing key: %v", err)
+		}
+		sum := sha256.Sum256(key.N.Bytes())
+		p.key = rs256{key: key, keyID: hex.EncodeToString(sum[:8])}
+	})
+	return p.key
+}
+
+// verifyAccessToken checks a RS256 access token signature
+func (p *OIDCProvider) verifyAccessToken(header jwtHeader, input, signature []byte) error {
+	if header.Type != AccessTokenType {
+		return fmt.Errorf("not an access token")
+	}
+	return p.signer().verify(header, input, signature)
+}
+
+// issuer returns the issuer URL, by default the URL the server was reached at
+func (p *OIDCProvider) issuer(r *http.Request) string {
+	if p.auth.config.Issuer != "" {
+		return strings.TrimSuffix(p.auth.config.Issuer, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// Discovery returns the OpenID provider metadata
+func (p *OIDCProvider) Discovery(r *http.Request) map[string]interface{} {
+	issuer := p.issuer(r)
+	return map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/oauth/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"none"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"scopes_supported":                      []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeRead, ScopeWrite},
+		"claims_supported":                      []string{"sub", "name", "email", "preferred_username", "nonce"},
+	}
+}
+
+// JWKS returns the public keys to verify the provider tokens
+func (p *OIDCProvider) JWKS() map[string]interface{} {
+	key := p.signer()
+	return map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": key.keyID,
+				"n":   b64.EncodeToString(key.key.N.Bytes()),
+				"e":   b64.EncodeToString(big.NewInt(int64(key.key.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// OAuthError is an OAuth2 error response (RFC 6749, section 5.2)
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthErrorf(code, format string, a ...interface{}) *OAuthError {
+	return &OAuthError{Code: code, Description: fmt.Sprintf(format, a...)}
+}
+
+// parseAuthRequest reads the authorization request parameters, checking the
+// client & redirect URI first, as errors on those cannot be redirected
+func (p *OIDCProvider) parseAuthRequest(r *http.Request) (authRequest, error) {
+	req := authRequest{
+		ClientID:            r.FormValue("client_id"),
+		RedirectURI:         r.FormValue("redirect_uri"),
+		Scope:               r.FormValue("scope"),
+		State:               r.FormValue("state"),
+		Nonce:               r.FormValue("nonce"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+	if req.CodeChallengeMethod == "" {
+		req.CodeChallengeMethod = "plain"
+	}
+	if req.ClientID == "" {
+		return req, fmt.Errorf("missing client_id")
+	}
+	if u, err := url.Parse(req.RedirectURI); err != nil || !u.IsAbs() || u.Fragment != "" {
+		return req, fmt.Errorf("redirect_uri must be an absolute URL without fragment")
+	}
+	if !p.allowsRedirect(req.ClientID, req.RedirectURI) {
+		return req, fmt.Errorf("redirect_uri %q not allowed for client %q", req.RedirectURI, req.ClientID)
+	}
+	return req, nil
+}
+
+// allowsRedirect checks the client is configured with the redirect URI,
+// any are allowed when no clients are configured
+func (p *OIDCProvider) allowsRedirect(clientID, redirectURI string) bool {
+	if len(p.auth.config.Clients) == 0 {
+		return true
+	}
+	for _, client := range p.auth.config.Clients {
+		if client.ClientID != clientID {
+			continue
+		}
+		for _, uri := range client.RedirectURIs {
+			if uri == redirectURI {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validate checks the request parameters which are reported by redirection
+func (req authRequest) validate(r *http.Request) *OAuthError {
+	if responseType := r.FormValue("response_type"); responseType != "code" {
+		return oauthErrorf("unsupported_response_type", "only response_type=code is supported, got %q", responseType)
+	}
+	if req.CodeChallenge == "" {
+		return oauthErrorf("invalid_request", "PKCE code_challenge is required")
+	}
+	if req.CodeChallengeMethod != "S256" && req.CodeChallengeMethod != "plain" {
+		return oauthErrorf("invalid_request", "unsupported code_challenge_method %q", req.CodeChallengeMethod)
+	}
+	return nil
+}
+
+// redirect sends the user agent back to the client with the given parameters
+func (req authRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// verifier checks a PKCE code verifier against the code challenge
+func (req authRequest) verifier(codeVerifier string) bool {
+	challenge := codeVerifier
+	if req.CodeChallengeMethod == "S256" {
+		sum := sha256.Sum256([]byte(codeVerifier))
+		challenge = b64.EncodeToString(sum[:])
+	}
+	return codeVerifier != "" && subtle.ConstantTimeCompare([]byte(challenge), []byte(req.CodeChallenge)) == 1
+}
+
+// grantedScopes returns the requested scopes the user is allowed to, or all
+// the user scopes when no API scope is requested
+func grantedScopes(requested string, user User) []string {
+	granted := []string{}
+	apiScopes := false
+	for _, scope := range strings.Fields(requested) {
+		switch scope {
+		case ScopeOpenID, ScopeProfile, ScopeEmail:
+			granted = append(granted, scope)
+		case ScopeRead, ScopeWrite:
+			apiScopes = true
+			for _, s := range user.Scopes {
+				if s == scope {
+					granted = append(granted, scope)
+				}
+			}
+		}
+	}
+	if !apiScopes {
+		granted = append(granted, user.Scopes...)
+	}
+	return granted
+}
+
+// newCode issues an authorization code for the user
+func (p *OIDCProvider) newCode(req authRequest, user User) string {
+	code := randomHex(16)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := p.auth.now()
+	for c, pending := range p.codes {
+		if now.After(pending.Expires) {
+			delete(p.codes, c)
+		}
+	}
+	req.Scope = strings.Join(grantedScopes(req.Scope, user), " ")
+	p.codes[code] = authCode{authRequest: req, Username: user.Username, Expires: now.Add(AuthCodeTTL)}
+	return code
+}
+
+// redeemCode takes a pending authorization code, codes can only be used once
+func (p *OIDCProvider) redeemCode(code string) (authCode, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pending, found := p.codes[code]
+	delete(p.codes, code)
+	if !found || p.auth.now().After(pending.Expires) {
+		return authCode{}, false
+	}
+	return pending, true
+}
+
+// Exchange trades an authorization code & its PKCE verifier for tokens
+func (p *OIDCProvider) Exchange(r *http.Request) (TokenResponse, error) {
+	if grantType := r.PostFormValue("grant_type"); grantType != "authorization_code" {
+		return TokenResponse{}, oauthErrorf("unsupported_grant_type", "only authorization_code is supported, got %q", grantType)
+	}
+	pending, ok := p.redeemCode(r.PostFormValue("code"))
+	if !ok {
+		return TokenResponse{}, oauthErrorf("invalid_grant", "unknown, used or expired code")
+	}
+	if pending.ClientID != r.PostFormValue("client_id") || pending.RedirectURI != r.PostFormValue("redirect_uri") {
+		return TokenResponse{}, oauthErrorf("invalid_grant", "client_id or redirect_uri do not match the authorization request")
+	}
+	if !pending.verifier(r.PostFormValue("code_verifier")) {
+		return TokenResponse{}, oauthErrorf("invalid_grant", "PKCE code_verifier does not match the code_challenge")
+	}
+	user, found := p.auth.user(pending.Username)
+	if !found {
+		return TokenResponse{}, oauthErrorf("invalid_grant", "user %q no longer exists", pending.Username)
+	}
+
+	now := p.auth.now()
+	key := p.signer()
+	claims := Claims{
+		Issuer:    p.issuer(r),
+		Subject:   user.Username,
+		Audience:  pending.ClientID,
+		Scope:     pending.Scope,
+		Roles:     rolesOf(user.Roles, user.Scopes),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(p.auth.ttl).Unix(),
+	}
+	header := jwtHeader{Algorithm: "RS256", Type: AccessTokenType, KeyID: key.keyID}
+	accessToken, err := encodeJWT(header, claims, key.sign)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	token := TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(p.auth.ttl.Seconds()),
+		Scope:       pending.Scope,
+	}
+	scopes := Identity{Scopes: strings.Fields(pending.Scope)}
+	if scopes.HasScope(ScopeOpenID) {
+		idClaims := userClaims(user, scopes)
+		idClaims.Claims = claims
+		idClaims.Scope = ""
+		idClaims.Nonce = pending.Nonce
+		header.Type = "JWT"
+		if token.IDToken, err = encodeJWT(header, idClaims, key.sign); err != nil {
+			return TokenResponse{}, err
+		}
+	}
+	return token, nil
+}
+
+// userClaims returns the user claims allowed by the scopes
+func userClaims(user User, scopes Identity) IDTokenClaims {
+	claims := IDTokenClaims{Claims: Claims{Subject: user.Username}}
+	if scopes.HasScope(ScopeProfile) {
+		claims.Name = user.Name
+		claims.PreferredUsername = user.Username
+	}
+	if scopes.HasScope(ScopeEmail) {
+		claims.Email = user.Email
+	}
+	return claims
+}
+
+// loginPage is the HTML form of the authorization endpoint
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Log in - test-vmbackend</title></head>
+<body>
+<h1>Log in to test-vmbackend</h1>
+<p><b>{{.ClientID}}</b> wants to access your VMs.</p>
+{{if .Error}}<p style="color: red">{{.Error}}</p>{{end}}
+<form method="post" action="authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<p><label>Username <input name="username" autofocus></label></p>
+<p><label>Password <input name="password" type="password"></label></p>
+<p><button type="submit">Log in</button></p>
+</form>
+<p>Fake users: {{range $i, $user := .Users}}{{if $i}}, {{end}}<code>{{$user}}</code>{{end}}</p>
+</body>
+</html>
+`))
+
+// renderLogin writes the login page for the authorization request
+func (p *OIDCProvider) renderLogin(w http.ResponseWriter, r *http.Request, req authRequest, status int, loginError string) {
+	params := map[string]string{"response_type": "code"}
+	for name, value := range map[string]string{
+		"client_id":             req.ClientID,
+		"redirect_uri":          req.RedirectURI,
+		"scope":                 req.Scope,
+		"state":                 req.State,
+		"nonce":                 req.Nonce,
+		"code_challenge":        req.CodeChallenge,
+		"code_challenge_method": req.CodeChallengeMethod,
+	} {
+		if value != "" {
+			params[name] = value
+		}
+	}
+	users := make([]string, 0, len(p.auth.config.Users))
+	for _, user := range p.auth.config.Users {
+		users = append(users, user.Username)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := loginPage.Execute(w, map[string]interface{}{
+		"ClientID": req.ClientID,
+		"Error":    loginError,
+		"Params":   params,
+		"Users":    users,
+	})
+	if err != nil {
+		log.Printf("error rendering login page: %v", err)
+	}
+}
+
+// oidcEnabled replies AUTH_DISABLED unless authentication is on
+func (s *VMServer) oidcEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if s.auth == nil {
+		writeProblem(w, r, NewProblem(AuthDisabled, "authentication is disabled, run with -auth to enable it"))
+		return false
+	}
+	return true
+}
+
+func (s *VMServer) oidcDiscovery(w http.ResponseWriter, r *http.Request) {
+	if s.oidcEnabled(w, r) {
+		writeJSON(w, r, http.StatusOK, s.auth.oidc.Discovery(r))
+	}
+}
+
+func (s *VMServer) oidcJWKS(w http.ResponseWriter, r *http.Request) {
+	if s.oidcEnabled(w, r) {
+		writeJSON(w, r, http.StatusOK, s.auth.oidc.JWKS())
+	}
+}
+
+// oidcAuthorize shows the login page on GET, and logs the user in on POST
+// redirecting back to the client with an authorization code
+func (s *VMServer) oidcAuthorize(w http.ResponseWriter, r *http.Request) {
+	if !s.oidcEnabled(w, r) {
+		return
+	}
+	p := s.auth.oidc
+	req, err := p.parseAuthRequest(r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	if oerr := req.validate(r); oerr != nil {
+		req.redirect(w, r, url.Values{"error": {oerr.Code}, "error_description": {oerr.Description}})
+		return
+	}
+	if r.Method == http.MethodGet {
+		p.renderLogin(w, r, req, http.StatusOK, "")
+		return
+	}
+	user, ok := s.auth.checkPassword(r.PostFormValue("username"), r.PostFormValue("password"))
+	if !ok {
+		p.renderLogin(w, r, req, http.StatusUnauthorized, "Invalid username or password")
+		return
+	}
+	req.redirect(w, r, url.Values{"code": {p.newCode(req, user)}})
+}
+
+func (s *VMServer) oidcToken(w http.ResponseWriter, r *http.Request) {
+	if !s.oidcEnabled(w, r) {
+		return
+	}
+	token, err := s.auth.oidc.Exchange(r)
+	w.Header().Set("Cache-Control", "no-store")
+	if oerr, ok := err.(*OAuthError); ok {
+		writeJSON(w, r, http.StatusBadRequest, oerr)
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, token)
+}
+
+func (s *VMServer) oidcUserInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.oidcEnabled(w, r) {
+		return
+	}
+	identity, _ := identityOf(r)
+	user, found := s.auth.user(identity.Subject)
+	if !found {
+		writeAuthError(w, r, unauthenticated("unknown user", `error="invalid_token"`))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, userClaims(user, identity))
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testClientID    = "spa"
+	testRedirectURI = "http://localhost:3000/callback"
+	testVerifier    = "a-code-verifier-long-enough-to-be-unguessable-0123456789"
+)
+
+func testChallenge() string {
+	sum := sha256.Sum256([]byte(testVerifier))
+	return b64.EncodeToString(sum[:])
+}
+
+func authorizeParams(scope string) url.Values {
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {testClientID},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {testChallenge()},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+func postForm(s *VMServer, path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveRequest(s, r)
+}
+
+// oidcLogin logs the user in and returns the redirect URL
+func oidcLogin(t *testing.T, s *VMServer, username, scope string) *url.URL {
+	t.Helper()
+	form := authorizeParams(scope)
+	form.Set("username", username)
+	form.Set("password", "secret")
+	w := postForm(s, "/oauth/authorize", form)
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status: %d, want: %d, %s", w.Code, http.StatusFound, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func exchange(s *VMServer, code, verifier string) *httptest.ResponseRecorder {
+	return postForm(s, "/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"client_id":     {testClientID},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	w := serve(NewAuthServer(t), http.MethodGet, "/.well-known/openid-configuration")
+	var discovery map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil {
+		t.Fatalf("Failed to decode discovery %s: %v", w.Body.String(), err)
+	}
+	if got, want := discovery["token_endpoint"], "http://example.com/oauth/token"; got != want {
+		t.Fatalf("got token_endpoint: %v, want: %v", got, want)
+	}
+	if w := serve(NewDefaultServer(), http.MethodGet, "/oauth/jwks"); w.Code != http.StatusNotFound {
+		t.Fatalf("got status: %d without -auth, want: %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestOIDCLoginPage(t *testing.T) {
+	s := NewAuthServer(t)
+	w := serve(s, http.MethodGet, "/oauth/authorize?"+authorizeParams("openid").Encode())
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, `name="code_challenge"`) {
+		t.Fatalf("got status: %d, body: %s", w.Code, body)
+	}
+
+	form := authorizeParams("openid")
+	form.Set("username", "admin")
+	form.Set("password", "wrong")
+	if w := postForm(s, "/oauth/authorize", form); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusUnauthorized)
+	}
+
+	form = authorizeParams("openid")
+	form.Del("code_challenge")
+	w = serve(s, http.MethodGet, "/oauth/authorize?"+form.Encode())
+	want := testRedirectURI + "?error=invalid_request&error_description=PKCE+code_challenge+is+required&state=xyz"
+	if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != want {
+		t.Fatalf("got status: %d, Location: %s, want: %s", w.Code, got, want)
+	}
+
+	form.Set("redirect_uri", "not/absolute")
+	w = serve(s, http.MethodGet, "/oauth/authorize?"+form.Encode())
+	if p := decodeProblem(t, w); p.Code != BadRequest {
+		t.Fatalf("got: %+v, want code: %v", p, BadRequest)
+	}
+}
+
+func TestOIDCCodeFlow(t *testing.T) {
+	s := NewAuthServer(t)
+	location := oidcLogin(t, s, "viewer", "openid profile email vms:read vms:write")
+	if got := location.Query().Get("state"); got != "xyz" {
+		t.Fatalf("got state: %q, want: xyz", got)
+	}
+	code := location.Query().Get("code")
+	w := exchange(s, code, testVerifier)
+	var token TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, body: %s", w.Code, w.Body.String())
+	}
+	if got, want := token.Scope, "openid profile email vms:read"; got != want {
+		t.Fatalf("got scope: %q, want: %q", got, want)
+	}
+
+	bearer := map[string]string{"Authorization": "Bearer " + token.AccessToken}
+	if w := serveWithHeaders(s, http.MethodGet, "/vms", bearer); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	if w := serveWithHeaders(s, http.MethodPut, "/vms/1/launch", bearer); w.Code != http.StatusForbidden {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusForbidden)
+	}
+	w = serveWithHeaders(s, http.MethodGet, "/oauth/userinfo", bearer)
+	if got, want := strings.TrimSpace(w.Body.String()),
+		`{"sub":"viewer","name":"Viewer","email":"viewer@example.com","preferred_username":"viewer"}`; got != want {
+		t.Fatalf("got userinfo: %s, want: %s", got, want)
+	}
+
+	// ID tokens are not access tokens
+	bearer = map[string]string{"Authorization": "Bearer " + token.IDToken}
+	if w := serveWithHeaders(s, http.MethodGet, "/vms", bearer); w.Code != http.StatusUnauthorized {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Codes can only be used once
+	w = exchange(s, code, testVerifier)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"error":"invalid_grant"`) {
+		t.Fatalf("got status: %d, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCBadVerifier(t *testing.T) {
+	s := NewAuthServer(t)
+	code := oidcLogin(t, s, "admin", "openid").Query().Get("code")
+	w := exchange(s, code, "another verifier")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "code_verifier") {
+		t.Fatalf("got status: %d, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCIDTokenSignature(t *testing.T) {
+	s := NewAuthServer(t)
+	code := oidcLogin(t, s, "admin", "openid").Query().Get("code")
+	var token TokenResponse
+	json.Unmarshal(exchange(s, code, testVerifier).Body.Bytes(), &token)
+
+	var jwks struct {
+		Keys []struct{ Kid, N, E string }
+	}
+	json.Unmarshal(serve(s, http.MethodGet, "/oauth/jwks").Body.Bytes(), &jwks)
+	n, _ := b64.DecodeString(jwks.Keys[0].N)
+	e, _ := b64.DecodeString(jwks.Keys[0].E)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	var claims IDTokenClaims
+	err := decodeJWT(token.IDToken, &claims, func(header jwtHeader, input, signature []byte) error {
+		if header.KeyID != jwks.Keys[0].Kid {
+			t.Fatalf("got kid: %q, want: %q", header.KeyID, jwks.Keys[0].Kid)
+		}
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	})
+	if err != nil {
+		t.Fatalf("Failed to verify ID token: %v", err)
+	}
+	if claims.Subject != "admin" || claims.Audience != testClientID || claims.Nonce != "n-0S6" {
+		t.Fatalf("got claims: %+v", claims)
+	}
+}
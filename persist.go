@@ -0,0 +1,153 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// writeFileAtomic writes data to a temporary file next to filename and
+// renames it over filename, so readers never see a partial file
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // a no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// State returns a snapshot of the projects, VMs, trash, VM snapshots &
+// volumes of this Cloud
+func (c *Cloud) State() CloudState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	state := CloudState{Projects: c.projectsLocked(), VMs: c.store.List(), Trash: c.trash.clone(), Purged: c.purgedIDsLocked()}
+	if len(c.snapshots) > 0 {
+		state.Snapshots = c.snapshotsLocked(NoVMID)
+	}
+	state.LastSnapshotID = c.lastSnapshotID
+	if len(c.volumes) > 0 {
+		state.Volumes = c.volumesLocked(func(v Volume) bool { return true })
+	}
+	state.LastVolumeID = c.lastVolumeID
+	return state
+}
+
+// changed signals a mutation of the Cloud to the onChange hook, if any
+func (c *Cloud) changed() {
+	if c.onChange != nil {
+		c.onChange()
+	}
+}
+
+// Resume the transitions in flight when the state was saved:
+// Starting VMs get Running, Stopping VMs get Stopped, Creating snapshots
+// get Available and volumes end their attachment or detachment after the
+// usual delays
+func (c *Cloud) Resume() {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for id, vm := range c.store.List() {
+		switch vm.State {
+		case STARTING:
+			c.delayedTransition(id, RUNNING, StartDelay, nil)
+		case STOPPING:
+			c.delayedTransition(id, STOPPED, StopDelay, nil)
+		default:
+			continue
+		}
+		log.Printf("Resuming VM %d transition from %v", id, vm.State)
+	}
+	c.resumeSnapshotsLocked()
+	c.resumeVolumesLocked()
+}
+
+// Persister saves the Cloud state whenever it changes, at most once per
+// interval if given
+type Persister struct {
+	cloud    *Cloud
+	interval time.Duration
+	save     func(CloudState) error
+	signal   chan struct{}
+	lock     sync.Mutex // one save at a time, so the last one is the latest state
+}
+
+// NewPersister hooks a Persister on the Cloud mutations, call Run to
+// start saving
+func NewPersister(c *Cloud, interval time.Duration, save func(CloudState) error) *Persister {
+	p := &Persister{cloud: c, interval: interval, save: save, signal: make(chan struct{}, 1)}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.onChange = func() {
+		select {
+		case p.signal <- struct{}{}:
+		default: // a save is pending already
+		}
+	}
+	return p
+}
+
+// Run saves the Cloud state after changes, until stop is closed
+func (p *Persister) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-p.signal:
+		}
+		stopped := false
+		if p.interval > 0 {
+			select {
+			case <-stop: // still save the changes pending
+				stopped = true
+			case <-time.After(p.interval): // gather the changes meanwhile
+			}
+			select {
+			case <-p.signal:
+			default:
+			}
+		}
+		if err := p.Save(); err != nil {
+			log.Println(err)
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// Save the current Cloud state
+func (p *Persister) Save() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.save(p.cloud.State()); err != nil {
+		return fmt.Errorf("error persisting Cloud state: %v", err)
+	}
+	return nil
+}
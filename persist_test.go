@@ -0,0 +1,113 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, VMsJSON)
+	for _, data := range []string{"first", "second"} {
+		if err := writeFileAtomic(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(filename); string(got) != data {
+			t.Fatalf("got: %q, want: %q", got, data)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("got %d files, want no temporary files left", len(files))
+	}
+}
+
+// startPersister runs a Persister of c sending the states saved to the
+// returned channel, until the returned stop channel is closed
+func startPersister(c *Cloud, interval time.Duration) (<-chan CloudState, chan struct{}) {
+	saved := make(chan CloudState, 10)
+	p := NewPersister(c, interval, func(state CloudState) error {
+		saved <- state
+		return nil
+	})
+	stop := make(chan struct{})
+	go p.Run(stop)
+	return saved, stop
+}
+
+// nextState waits for the next state saved or fails the test
+func nextState(t *testing.T, saved <-chan CloudState) CloudState {
+	t.Helper()
+	select {
+	case state := <-saved:
+		return state
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for the state to be saved")
+	}
+	return CloudState{}
+}
+
+func TestPersister(t *testing.T) {
+	c := NewDefaultCloud()
+	saved, stop := startPersister(&c, 0)
+	defer close(stop)
+	if err := c.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if state := nextState(t, saved); len(state.VMs) != 2 {
+		t.Fatalf("got: %v, want VM 2 deleted", state.VMs)
+	}
+	if err := c.CreateProject(teamA); err != nil {
+		t.Fatal(err)
+	}
+	if state := nextState(t, saved); len(state.Projects) != 2 {
+		t.Fatalf("got: %+v, want project %q saved", state.Projects, teamA.ID)
+	}
+}
+
+func TestPersisterInterval(t *testing.T) {
+	c := NewDefaultCloud()
+	saved, stop := startPersister(&c, 50*time.Millisecond)
+	defer close(stop)
+	c.Delete(0)
+	c.Delete(2)
+	if state := nextState(t, saved); len(state.VMs) != 1 {
+		t.Fatalf("got: %v, want VMs 0 & 2 deleted at once", state.VMs)
+	}
+	select {
+	case state := <-saved:
+		t.Fatalf("got another save: %v", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResume(t *testing.T) {
+	shrinkTime()
+	c := NewDefaultCloud()
+	forceState(&c, 0, STARTING)
+	forceState(&c, 1, STOPPING)
+	events, cancel := c.Subscribe()
+	defer cancel()
+	c.Resume()
+	want := map[int]VMState{0: RUNNING, 1: STOPPED}
+	for len(want) > 0 {
+		select {
+		case event := <-events:
+			if event.VM.State != want[event.ID] {
+				t.Fatalf("got: %+v, want VM %d %v", event, event.ID, want[event.ID])
+			}
+			delete(want, event.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v", want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"time"
+)
+
+// Progress of a VM transition, estimated from its elapsed time
+type Progress struct {
+	Percent     int       `json:"percent"` // 0 to 99, the transition ends at 100
+	Phase       string    `json:"phase"`
+	CompletesAt time.Time `json:"estimated_completion_at"`
+}
+
+// TransitionPhases lists the phases of the transitions by VM state,
+// each taking the same share of the transition time
+var TransitionPhases = map[VMState][]string{
+	STARTING: {"allocating", "booting kernel", "running cloud-init"},
+	STOPPING: {"stopping services", "powering off"},
+}
+
+// transitions returns the pending VM transitions by VM id, the latest
+// scheduled if several
+func (c *Cloud) transitions() map[int]*pendingTransition {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	transitions := make(map[int]*pendingTransition, len(c.pending))
+	for p := range c.pending {
+		if p.state == "" {
+			continue
+		}
+		if latest, found := transitions[p.id]; !found || p.start.After(latest.start) {
+			transitions[p.id] = p
+		}
+	}
+	return transitions
+}
+
+// withProgress returns the VM with the progress of its pending transition
+// at the given time, if any
+func (vm VM) withProgress(p *pendingTransition, now time.Time) VM {
+	vm.Progress = nil
+	phases := TransitionPhases[vm.State]
+	if p == nil || len(phases) == 0 || AllowedTransition[vm.State] != p.state {
+		return vm
+	}
+	percent := 0
+	if p.delay > 0 {
+		percent = int(now.Sub(p.start) * 100 / p.delay)
+	}
+	if percent < 0 {
+		percent = 0
+	} else if percent > 99 { // until the timer fires
+		percent = 99
+	}
+	vm.Progress = &Progress{
+		Percent:     percent,
+		Phase:       phases[percent*len(phases)/100],
+		CompletesAt: p.start.Add(p.delay),
+	}
+	return vm
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithProgress(t *testing.T) {
+	start := time.Now()
+	p := &pendingTransition{id: GoodID, state: RUNNING, start: start, delay: 10 * time.Second}
+	starting := VM{State: STARTING}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		percent int
+		phase   string
+	}{
+		{0, 0, "allocating"},
+		{3 * time.Second, 30, "allocating"},
+		{5 * time.Second, 50, "booting kernel"},
+		{9 * time.Second, 90, "running cloud-init"},
+		{time.Minute, 99, "running cloud-init"},
+	} {
+		got := starting.withProgress(p, start.Add(tc.elapsed)).Progress
+		if got == nil || got.Percent != tc.percent || got.Phase != tc.phase || !got.CompletesAt.Equal(start.Add(10*time.Second)) {
+			t.Errorf("after %v got: %+v, want %d%% %s", tc.elapsed, got, tc.percent, tc.phase)
+		}
+	}
+	if got := (VM{State: RUNNING}).withProgress(p, start); got.Progress != nil {
+		t.Errorf("got: %+v, want no progress once Running", got.Progress)
+	}
+	if got := starting.withProgress(nil, start); got.Progress != nil {
+		t.Errorf("got: %+v, want no progress without transition", got.Progress)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	if _, err := c.Launch(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	vm, _ := c.Inspect(GoodID)
+	if vm.Progress == nil || vm.Progress.Phase != "allocating" || time.Until(vm.Progress.CompletesAt) <= 59*time.Minute {
+		t.Fatalf("got: %+v, want the launch just started", vm.Progress)
+	}
+	if vms := c.List(); vms[GoodID].Progress == nil || vms[0].Progress != nil {
+		t.Errorf("got: %v, want progress of VM %d only", vms, GoodID)
+	}
+	if stored, _ := c.store.Get(GoodID); stored.Progress != nil {
+		t.Errorf("got stored progress: %+v, want it computed on read only", stored.Progress)
+	}
+	c.ResolveTransitions()
+	if vm, _ := c.Inspect(GoodID); vm.State != RUNNING || vm.Progress != nil {
+		t.Errorf("got: %v, want Running without progress", vm)
+	}
+}
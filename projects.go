@@ -0,0 +1,373 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultProjectID is the project of VMs without one
+const DefaultProjectID = "default"
+
+// DefaultProject owns the VMs without project, open to everyone
+var DefaultProject = Project{ID: DefaultProjectID, Name: "Default"}
+
+// Project is a tenant owning VMs, its members are usernames or API key
+// subjects. A project without members is open to everyone, and a project
+// without quota is unlimited.
+type Project struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Members []string `json:"members,omitempty"`
+	Quota   *Quota   `json:"quota,omitempty"`
+}
+
+var projectIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Validate checks the project id is usable in paths
+func (p Project) Validate() error {
+	if !projectIDPattern.MatchString(p.ID) {
+		return fmt.Errorf("invalid project id %q, use lowercase letters, digits & dashes", p.ID)
+	}
+	return nil
+}
+
+// HasMember checks whether the subject is a member of the project
+func (p Project) HasMember(subject string) bool {
+	if len(p.Members) == 0 {
+		return true
+	}
+	for _, member := range p.Members {
+		if member == subject {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectID returns the project of the VM
+func (vm VM) ProjectID() string {
+	if vm.Project == "" {
+		return DefaultProjectID
+	}
+	return vm.Project
+}
+
+// inProject returns the VMs of the project
+func (vms VMs) inProject(projectID string) VMs {
+	filtered := make(VMs)
+	for id, vm := range vms {
+		if vm.ProjectID() == projectID {
+			filtered[id] = vm
+		}
+	}
+	return filtered
+}
+
+// CloudState is the format of the state file: projects & their VMs
+type CloudState struct {
+	Projects []Project `json:"projects"`
+	VMs      VMs       `json:"vms"`
+	Trash    VMs       `json:"trash,omitempty"`  // deleted VMs until purged
+	Purged   []int     `json:"purged,omitempty"` // ids of the purged VMs
+
+	Snapshots      []Snapshot `json:"snapshots,omitempty"`
+	LastSnapshotID int        `json:"last_snapshot_id,omitempty"` // not to reuse the ids of deleted ones
+	Volumes        []Volume   `json:"volumes,omitempty"`
+	LastVolumeID   int        `json:"last_volume_id,omitempty"` // not to reuse the ids of deleted ones
+}
+
+// UnmarshalJSON also accepts the former state format, just the VMs
+func (s *CloudState) UnmarshalJSON(data []byte) error {
+	type state CloudState // without methods, to avoid recursion
+	var decoded state
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.VMs == nil && decoded.Projects == nil {
+		return json.Unmarshal(data, &s.VMs)
+	}
+	*s = CloudState(decoded)
+	return nil
+}
+
+var defaultState = CloudState{Projects: []Project{DefaultProject}, VMs: defaultVMs}
+
+// projectsLocked returns the projects, starting by the default one,
+// the caller must hold the lock
+func (c *Cloud) projectsLocked() []Project {
+	projects := []Project{DefaultProject}
+	for _, p := range c.projects {
+		if p.ID == DefaultProjectID {
+			projects[0] = p
+		} else {
+			projects = append(projects, p)
+		}
+	}
+	return projects
+}
+
+// findProjectLocked finds a project by id, the caller must hold the lock
+func (c *Cloud) findProjectLocked(id string) (Project, bool) {
+	for _, p := range c.projectsLocked() {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Project{}, false
+}
+
+// ListProjects returns the projects of this Cloud, starting by the default one
+func (c *Cloud) ListProjects() []Project {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.projectsLocked()
+}
+
+// InspectProject finds a project by id
+func (c *Cloud) InspectProject(id string) (Project, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.findProjectLocked(id)
+}
+
+// CreateProject adds a new project, failing if the id is taken or invalid
+func (c *Cloud) CreateProject(p Project) error {
+	if err := p.Validate(); err != nil {
+		return &CloudError{Code: InvalidProject, ID: NoVMID, Err: err}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.findProjectLocked(p.ID); found {
+		return cloudErrorf(ProjectExists, NoVMID, "project %q already exists", p.ID)
+	}
+	c.projects = append(c.projects, p)
+	c.changed()
+	return nil
+}
+
+// UpdateProject replaces the name, members & quota of an existing project
+func (c *Cloud) UpdateProject(p Project) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.findProjectLocked(p.ID); !found {
+		return cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", p.ID)
+	}
+	c.replaceProjectLocked(p)
+	return nil
+}
+
+// replaceProjectLocked replaces the project with the id of p, or adds it
+// (like the implicit default project), the caller must hold the lock
+func (c *Cloud) replaceProjectLocked(p Project) {
+	for i := range c.projects {
+		if c.projects[i].ID == p.ID {
+			c.projects[i] = p
+			c.changed()
+			return
+		}
+	}
+	c.projects = append(c.projects, p)
+	c.changed()
+}
+
+// DeleteProject removes a project, which must not own VMs (even in the
+// trash) nor volumes
+func (c *Cloud) DeleteProject(id string) error {
+	if id == DefaultProjectID {
+		return cloudErrorf(InvalidProject, NoVMID, "the %q project cannot be deleted", id)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.findProjectLocked(id); !found {
+		return cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", id)
+	}
+	if owned := len(c.store.List().inProject(id)); owned > 0 {
+		return cloudErrorf(ProjectNotEmpty, NoVMID, "project %q still owns %d VMs", id, owned)
+	}
+	c.purgeLocked(time.Now())
+	if owned := len(c.trash.inProject(id)); owned > 0 {
+		return cloudErrorf(ProjectNotEmpty, NoVMID, "project %q still owns %d VMs in the trash, purge them first", id, owned)
+	}
+	if owned := len(c.volumesLocked(func(v Volume) bool { return v.ProjectID() == id })); owned > 0 {
+		return cloudErrorf(ProjectNotEmpty, NoVMID, "project %q still owns %d volumes", id, owned)
+	}
+	for i := range c.projects {
+		if c.projects[i].ID == id {
+			c.projects = append(c.projects[:i], c.projects[i+1:]...)
+			break
+		}
+	}
+	c.changed()
+	return nil
+}
+
+const projectKey contextKey = "project"
+
+var projectPrefix = regexp.MustCompile(`^/projects/([^/]+)(/(?:vms|trash|volumes)(/.*)?)$`)
+
+// routeProject strips the /projects/{project_id} prefix of VM, trash &
+// volume paths,
+// keeping the project in the request context
+func routeProject(r *http.Request) *http.Request {
+	m := projectPrefix.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return r
+	}
+	routed := r.WithContext(context.WithValue(r.Context(), projectKey, m[1]))
+	url := *r.URL
+	url.Path = m[2]
+	routed.URL = &url
+	return routed
+}
+
+// projectOf returns the project of the request, the default one if not
+// routed by project
+func projectOf(r *http.Request) string {
+	if project, ok := r.Context().Value(projectKey).(string); ok {
+		return project
+	}
+	return DefaultProjectID
+}
+
+// projectScoped tells whether the request path had a project prefix
+func projectScoped(r *http.Request) bool {
+	_, ok := r.Context().Value(projectKey).(string)
+	return ok
+}
+
+// projectPath returns path under the project prefix, if the request had one
+func projectPath(r *http.Request, path string) string {
+	if !projectScoped(r) {
+		return path
+	}
+	return "/projects/" + projectOf(r) + path
+}
+
+// canAccess checks whether the caller of r can use the project: any
+// caller without authentication, admins, or else project members
+func canAccess(r *http.Request, p Project) bool {
+	identity, found := identityOf(r)
+	return !found || identity.HasRole(RoleAdmin) || p.HasMember(identity.Subject)
+}
+
+// projectAccess returns a check of the projects the caller of r can use
+func (s *VMServer) projectAccess(r *http.Request) func(projectID string) bool {
+	return func(projectID string) bool {
+		p, found := s.vmm.InspectProject(projectID)
+		return found && canAccess(r, p)
+	}
+}
+
+// checkProject fails unless the project of r exists and the caller can use it
+func (s *VMServer) checkProject(r *http.Request) error {
+	id := projectOf(r)
+	p, found := s.vmm.InspectProject(id)
+	if !found {
+		return cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", id)
+	}
+	if !canAccess(r, p) {
+		identity, _ := identityOf(r)
+		return cloudErrorf(NotProjectMember, NoVMID, "%s is not a member of project %q", identity.Subject, id)
+	}
+	return nil
+}
+
+// projectIDAt returns the project id at position pos of the request path
+func projectIDAt(r *http.Request, pos int) string {
+	return strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")[pos]
+}
+
+func (s *VMServer) listProjects(w http.ResponseWriter, r *http.Request) {
+	projects := []Project{}
+	for _, p := range s.vmm.ListProjects() {
+		if canAccess(r, p) {
+			projects = append(projects, p)
+		}
+	}
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, projects)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: projects, Links: map[string]string{"self": versionedPath(r, "/projects")}})
+}
+
+// writeProject replies with the project, wrapped in an Envelope for v2
+func writeProject(w http.ResponseWriter, r *http.Request, status int, p Project) {
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, status, p)
+		return
+	}
+	links := map[string]string{
+		"self": versionedPath(r, "/projects/"+p.ID),
+		"vms":  versionedPath(r, "/projects/"+p.ID+"/vms"),
+	}
+	writeJSON(w, r, status, Envelope{Data: p, Links: links})
+}
+
+// readProject decodes a project from the request JSON body
+func readProject(r *http.Request) (Project, error) {
+	var p Project
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return p, fmt.Errorf("bad JSON project: %v", err)
+	}
+	return p, nil
+}
+
+func (s *VMServer) createProject(w http.ResponseWriter, r *http.Request) {
+	p, err := readProject(r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	if err := s.vmm.CreateProject(p); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", versionedPath(r, "/projects/"+p.ID))
+	writeProject(w, r, http.StatusCreated, p)
+}
+
+func (s *VMServer) inspectProject(w http.ResponseWriter, r *http.Request) {
+	id := projectIDAt(r, 2)
+	p, found := s.vmm.InspectProject(id)
+	if !found || !canAccess(r, p) {
+		writeError(w, r, cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", id))
+		return
+	}
+	writeProject(w, r, http.StatusOK, p)
+}
+
+func (s *VMServer) updateProject(w http.ResponseWriter, r *http.Request) {
+	p, err := readProject(r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	p.ID = projectIDAt(r, 2)
+	if err := s.vmm.UpdateProject(p); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeProject(w, r, http.StatusOK, p)
+}
+
+func (s *VMServer) deleteProject(w http.ResponseWriter, r *http.Request) {
+	if err := s.vmm.DeleteProject(projectIDAt(r, 2)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var teamA = Project{ID: "team-a", Name: "Team A", Members: []string{"operator"}}
+
+// NewProjectsServer returns a server with VM 3 in project team-a
+func NewProjectsServer() *VMServer {
+	s := NewDefaultServer()
+	s.vmm.projects = []Project{DefaultProject, teamA}
+	s.vmm.store.Put(3, VM{VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100, State: STOPPED, Project: teamA.ID})
+	return s
+}
+
+var projectRoutingCases = []struct {
+	method string
+	url    string
+	want   int
+	code   ErrorCode
+}{
+	{http.MethodGet, "/projects/team-a/vms/3", http.StatusOK, ""},
+	{http.MethodGet, "/v2/projects/team-a/vms/3", http.StatusOK, ""},
+	{http.MethodGet, "/projects/default/vms/1", http.StatusOK, ""},
+	{http.MethodGet, "/vms/3", http.StatusNotFound, VMNotFound},
+	{http.MethodGet, "/projects/team-a/vms/1", http.StatusNotFound, VMNotFound},
+	{http.MethodPut, "/projects/team-a/vms/1/launch", http.StatusNotFound, VMNotFound},
+	{http.MethodGet, "/projects/team-b/vms", http.StatusNotFound, ProjectNotFound},
+	{http.MethodPost, "/projects/team-a/graphql", http.StatusMethodNotAllowed, MethodNotAllowed},
+}
+
+func TestProjectRouting(t *testing.T) {
+	for _, tc := range projectRoutingCases {
+		w := serve(NewProjectsServer(), tc.method, tc.url)
+		if w.Code != tc.want {
+			t.Fatalf("%s %s got status: %d, want: %d", tc.method, tc.url, w.Code, tc.want)
+		}
+		if tc.code != "" {
+			if p := decodeProblem(t, w); p.Code != tc.code {
+				t.Fatalf("%s %s got: %+v, want code: %v", tc.method, tc.url, p, tc.code)
+			}
+		}
+	}
+}
+
+func TestProjectList(t *testing.T) {
+	s := NewProjectsServer()
+	w := serve(s, http.MethodGet, "/projects/team-a/vms")
+	if got, want := w.Body.String(), s.vmm.List().inProject(teamA.ID).String(); got != want {
+		t.Fatalf("got: %s, want: %s", got, want)
+	}
+	w = serve(s, http.MethodGet, "/vms")
+	if got, want := w.Body.String(), defaultVMs.String(); got != want {
+		t.Fatalf("got: %s, want: %s", got, want)
+	}
+	var data []VMResource
+	envelope := decodeEnvelope(t, serve(s, http.MethodGet, "/v2/projects/team-a/vms"), &data)
+	if got, want := envelope.Links["self"], "/v2/projects/team-a/vms?offset=0&limit=20"; got != want {
+		t.Fatalf("got self link: %v, want: %v", got, want)
+	}
+}
+
+func TestProjectCRUD(t *testing.T) {
+	s := NewProjectsServer()
+	r := httptest.NewRequest(http.MethodPost, "/projects", strings.NewReader(`{"id":"team-b","name":"Team B"}`))
+	if w := serveRequest(s, r); w.Code != http.StatusCreated || w.Header().Get("Location") != "/v1/projects/team-b" {
+		t.Fatalf("got status: %d, Location: %q", w.Code, w.Header().Get("Location"))
+	}
+	r = httptest.NewRequest(http.MethodPost, "/projects", strings.NewReader(`{"id":"team-b"}`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != ProjectExists {
+		t.Fatalf("got: %+v, want code: %v", p, ProjectExists)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/projects", strings.NewReader(`{"id":"Team C"}`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != InvalidProject {
+		t.Fatalf("got: %+v, want code: %v", p, InvalidProject)
+	}
+	r = httptest.NewRequest(http.MethodPut, "/projects/team-b", strings.NewReader(`{"name":"B team","members":["viewer"]}`))
+	if w := serveRequest(s, r); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	want := Project{ID: "team-b", Name: "B team", Members: []string{"viewer"}}
+	if got, _ := s.vmm.InspectProject("team-b"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %+v, want: %+v", got, want)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodDelete, "/projects/team-a")); p.Code != ProjectNotEmpty {
+		t.Fatalf("got: %+v, want code: %v", p, ProjectNotEmpty)
+	}
+	if w := serve(s, http.MethodDelete, "/projects/team-b"); w.Code != http.StatusNoContent {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestDeleteProjectWithTrash(t *testing.T) {
+	s := NewProjectsServer()
+	serveRequest(s, httptest.NewRequest(http.MethodPost, "/projects", strings.NewReader(`{"id":"team-c"}`)))
+	r := httptest.NewRequest(http.MethodPost, "/projects/team-c/vms", strings.NewReader(`{"vcpus":1,"clock":1000,"ram":1024,"storage":10,"network":100}`))
+	w := serveRequest(s, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusCreated)
+	}
+	serve(s, http.MethodDelete, w.Header().Get("Location"))
+	p := decodeProblem(t, serve(s, http.MethodDelete, "/projects/team-c"))
+	if p.Code != ProjectNotEmpty || !strings.Contains(p.Detail, "trash") {
+		t.Fatalf("got: %+v, want code: %v about the trash", p, ProjectNotEmpty)
+	}
+
+	s.vmm.lock.Lock()
+	s.vmm.retention = 0
+	s.vmm.lock.Unlock()
+	if w := serve(s, http.MethodDelete, "/projects/team-c"); w.Code != http.StatusNoContent {
+		t.Fatalf("got status: %d, want: %d once the trash is purged", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestProjectMembers(t *testing.T) {
+	s := NewProjectsServer()
+	auth, err := NewAuthenticator(testAuthConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth = auth
+	for username, want := range map[string]int{"operator": http.StatusOK, "viewer": http.StatusForbidden, "admin": http.StatusOK} {
+		bearer := map[string]string{"Authorization": "Bearer " + login(t, s, username)}
+		w := serveWithHeaders(s, http.MethodGet, "/projects/team-a/vms", bearer)
+		if w.Code != want {
+			t.Fatalf("%s got status: %d, want: %d", username, w.Code, want)
+		}
+	}
+
+	bearer := map[string]string{"Authorization": "Bearer " + login(t, s, "viewer")}
+	w := serveWithHeaders(s, http.MethodGet, "/projects", bearer)
+	var projects []Project
+	if err := json.Unmarshal(w.Body.Bytes(), &projects); err != nil {
+		t.Fatalf("Failed to decode %s: %v", w.Body.String(), err)
+	}
+	if want := []Project{DefaultProject}; !reflect.DeepEqual(projects, want) {
+		t.Fatalf("got: %+v, want: %+v", projects, want)
+	}
+}
+
+func TestGraphQLProjects(t *testing.T) {
+	s := NewProjectsServer()
+	_, response := postGraphQL(t, s, `{ vms(filter: {project: "team-a"}) { items { id project } } projects { id } }`, nil)
+	want := toJSON(t, map[string]interface{}{
+		"vms":      map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": 3, "project": "team-a"}}},
+		"projects": []interface{}{map[string]interface{}{"id": "default"}, map[string]interface{}{"id": "team-a"}},
+	})
+	if got := toJSON(t, response.Data); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %v, want: %v", got, want)
+	}
+}
+
+func TestLegacyState(t *testing.T) {
+	var state CloudState
+	if err := json.Unmarshal([]byte(defaultVMs.String()), &state); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state.VMs, defaultVMs) || state.Projects != nil {
+		t.Fatalf("got: %+v", state)
+	}
+	body, _ := json.Marshal(defaultState)
+	state = CloudState{}
+	if err := json.Unmarshal(body, &state); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, defaultState) {
+		t.Fatalf("got: %+v, want: %+v", state, defaultState)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Quota limits the resources of the VMs of a project, zero means unlimited
+type Quota struct {
+	VCPUS      int `json:"vcpus,omitempty"`       // Processors of all the VMs
+	RAM        int `json:"ram,omitempty"`         // Internal memory of all the VMs, in MB
+	Storage    int `json:"storage,omitempty"`     // Persistent storage of all the VMs & volumes, in GB
+	VMs        int `json:"vms,omitempty"`         // Number of VMs
+	RunningVMs int `json:"running_vms,omitempty"` // Number of VMs not Stopped
+}
+
+// Usage is the amount of the Quota resources taken by the VMs (and volumes
+// for the storage) of a project
+type Usage struct {
+	VCPUS      int `json:"vcpus"`
+	RAM        int `json:"ram"`
+	Storage    int `json:"storage"`
+	VMs        int `json:"vms"`
+	RunningVMs int `json:"running_vms"`
+}
+
+// usage adds up the resources taken by the VMs
+func (vms VMs) usage() Usage {
+	var u Usage
+	for _, vm := range vms {
+		u.VCPUS += vm.VCPUS
+		u.RAM += vm.RAM
+		u.Storage += vm.Storage
+		u.VMs++
+		if vm.State != STOPPED {
+			u.RunningVMs++
+		}
+	}
+	return u
+}
+
+// QuotaError details which quota limit a request would exceed
+type QuotaError struct {
+	Project   string `json:"project"`
+	Resource  string `json:"resource"`
+	Limit     int    `json:"limit"`
+	Used      int    `json:"used"`
+	Requested int    `json:"requested"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded on project %q: %d %s used, %d more requested, limit is %d",
+		e.Project, e.Used, e.Resource, e.Requested, e.Limit)
+}
+
+// check fails with a QuotaError if adding requested to used goes over a
+// limit. Only increased resources are checked, so projects over a lowered
+// quota can still shrink.
+func (q Quota) check(projectID string, used, requested Usage) error {
+	for _, r := range []struct {
+		name                   string
+		limit, used, requested int
+	}{
+		{"vcpus", q.VCPUS, used.VCPUS, requested.VCPUS},
+		{"ram", q.RAM, used.RAM, requested.RAM},
+		{"storage", q.Storage, used.Storage, requested.Storage},
+		{"vms", q.VMs, used.VMs, requested.VMs},
+		{"running_vms", q.RunningVMs, used.RunningVMs, requested.RunningVMs},
+	} {
+		if r.limit > 0 && r.requested > 0 && r.used+r.requested > r.limit {
+			return &QuotaError{Project: projectID, Resource: r.name, Limit: r.limit, Used: r.used, Requested: r.requested}
+		}
+	}
+	return nil
+}
+
+// usageLocked adds up the resources taken by the VMs & volumes of the
+// project, the caller must hold the lock
+func (c *Cloud) usageLocked(projectID string) Usage {
+	u := c.store.List().inProject(projectID).usage()
+	for _, volume := range c.volumesLocked(func(v Volume) bool { return v.ProjectID() == projectID }) {
+		u.Storage += volume.Size
+	}
+	return u
+}
+
+// checkQuotaLocked fails with a QuotaExceeded CloudError for VM id if the
+// project cannot take the requested resources, the caller must hold the lock
+func (c *Cloud) checkQuotaLocked(projectID string, id int, requested Usage) error {
+	p, _ := c.findProjectLocked(projectID)
+	if p.Quota == nil {
+		return nil
+	}
+	if err := p.Quota.check(projectID, c.usageLocked(projectID), requested); err != nil {
+		return &CloudError{Code: QuotaExceeded, ID: id, Err: err}
+	}
+	return nil
+}
+
+// QuotaReport is the usage vs the limits of a project
+type QuotaReport struct {
+	Project string `json:"project"`
+	Limits  Quota  `json:"limits"`
+	Usage   Usage  `json:"usage"`
+}
+
+// Quotas reports the quota usage of every project
+func (c *Cloud) Quotas() []QuotaReport {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	reports := []QuotaReport{}
+	for _, p := range c.projectsLocked() {
+		report := QuotaReport{Project: p.ID, Usage: c.usageLocked(p.ID)}
+		if p.Quota != nil {
+			report.Limits = *p.Quota
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// writeQuotas replies with the reports, wrapped in an Envelope for v2
+func writeQuotas(w http.ResponseWriter, r *http.Request, self string, reports interface{}) {
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, reports)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: reports, Links: map[string]string{"self": versionedPath(r, self)}})
+}
+
+func (s *VMServer) listQuotas(w http.ResponseWriter, r *http.Request) {
+	access := s.projectAccess(r)
+	reports := []QuotaReport{}
+	for _, report := range s.vmm.Quotas() {
+		if access(report.Project) {
+			reports = append(reports, report)
+		}
+	}
+	writeQuotas(w, r, "/quotas", reports)
+}
+
+func (s *VMServer) inspectQuota(w http.ResponseWriter, r *http.Request) {
+	id := projectIDAt(r, 2)
+	if s.projectAccess(r)(id) {
+		for _, report := range s.vmm.Quotas() {
+			if report.Project == id {
+				writeQuotas(w, r, "/projects/"+id+"/quota", report)
+				return
+			}
+		}
+	}
+	writeError(w, r, cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", id))
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// NewQuotaServer returns a projects server with team-a limited to 2 VMs,
+// 4 vcpus & 1 running VM
+func NewQuotaServer() *VMServer {
+	s := NewProjectsServer()
+	limited := teamA
+	limited.Quota = &Quota{VCPUS: 4, VMs: 2, RunningVMs: 1}
+	s.vmm.projects = []Project{DefaultProject, limited}
+	return s
+}
+
+var quotaCases = []struct {
+	method   string
+	url      string
+	body     string
+	resource string
+}{
+	{http.MethodPost, "/projects/team-a/vms", `{"vcpus":4,"clock":1000,"ram":1024,"storage":10,"network":100}`, "vcpus"},
+	{http.MethodPut, "/projects/team-a/vms/4/resize", `{"vcpus":5}`, "vcpus"},
+	{http.MethodPut, "/projects/team-a/vms/4/launch", "", "running_vms"},
+	{http.MethodPost, "/projects/team-a/vms", `{"vcpus":1,"clock":1000,"ram":1024,"storage":10,"network":100}`, "vms"},
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	s := NewQuotaServer()
+	s.vmm.store.Put(4, VM{VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100, State: STOPPED, Project: teamA.ID})
+	forceState(&s.vmm, 3, RUNNING)
+	for _, tc := range quotaCases {
+		r := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		w := serveRequest(s, r)
+		if w.Code != http.StatusConflict {
+			t.Fatalf("%s %s got status: %d, want: %d", tc.method, tc.url, w.Code, http.StatusConflict)
+		}
+		p := decodeProblem(t, w)
+		if p.Code != QuotaExceeded || p.Quota == nil || p.Quota.Resource != tc.resource || p.Quota.Project != teamA.ID {
+			t.Fatalf("%s %s got: %+v, want %s quota exceeded", tc.method, tc.url, p, tc.resource)
+		}
+	}
+	if w := serve(s, http.MethodPost, "/vms"); w.Code == http.StatusConflict {
+		t.Fatalf("got a quota error on the default project")
+	}
+}
+
+func TestQuotaShrink(t *testing.T) {
+	s := NewQuotaServer()
+	s.vmm.store.Put(4, VM{VCPUS: 8, Clock: 1000, RAM: 1024, Storage: 10, Network: 100, State: STOPPED, Project: teamA.ID})
+	if err := s.vmm.Resize(4, VM{VCPUS: 2, RAM: 2048}); err != nil {
+		t.Fatalf("got: %v, want shrinking allowed over quota", err)
+	}
+	if err := s.vmm.Resize(4, VM{VCPUS: 5}); err == nil {
+		t.Fatalf("got no error growing over quota")
+	}
+}
+
+func TestVolumeQuota(t *testing.T) {
+	s := NewQuotaServer()
+	s.vmm.projects[1].Quota.Storage = 30 // VM 3 takes 10
+	volume, err := s.vmm.CreateVolume(Volume{Size: 15, Project: teamA.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.vmm.CreateVolume(Volume{Size: 10, Project: teamA.ID}); codeOf(t, err) != QuotaExceeded {
+		t.Fatalf("got: %v, want: %v", err, QuotaExceeded)
+	}
+	size := 21
+	if _, err := s.vmm.UpdateVolume(volume.ID, nil, &size); codeOf(t, err) != QuotaExceeded {
+		t.Fatalf("got: %v, want: %v growing the volume", err, QuotaExceeded)
+	}
+	size = 20
+	if _, err := s.vmm.UpdateVolume(volume.ID, nil, &size); err != nil {
+		t.Fatalf("got: %v, want the volume grown up to the quota", err)
+	}
+	if got := s.vmm.Quotas()[1].Usage.Storage; got != 30 {
+		t.Fatalf("got storage usage: %d, want: %d", got, 30)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	s := NewQuotaServer()
+	var reports []QuotaReport
+	w := serve(s, http.MethodGet, "/quotas")
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("Failed to decode %s: %v", w.Body.String(), err)
+	}
+	want := []QuotaReport{
+		{Project: DefaultProjectID, Usage: defaultVMs.usage()},
+		{Project: teamA.ID, Limits: Quota{VCPUS: 4, VMs: 2, RunningVMs: 1}, Usage: Usage{VCPUS: 1, RAM: 1024, Storage: 10, VMs: 1}},
+	}
+	if !reflect.DeepEqual(reports, want) {
+		t.Fatalf("got: %+v, want: %+v", reports, want)
+	}
+	var report QuotaReport
+	envelope := decodeEnvelope(t, serve(s, http.MethodGet, "/v2/projects/team-a/quota"), &report)
+	if !reflect.DeepEqual(report, want[1]) || envelope.Links["self"] != "/v2/projects/team-a/quota" {
+		t.Fatalf("got: %+v, links: %v", report, envelope.Links)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodGet, "/projects/team-b/quota")); p.Code != ProjectNotFound {
+		t.Fatalf("got: %+v, want code: %v", p, ProjectNotFound)
+	}
+}
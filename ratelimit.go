@@ -0,0 +1,191 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig configures the token buckets of each client & endpoint
+type RateLimitConfig struct {
+	Rate  float64 // requests per second refilled, 0 disables rate limiting
+	Burst int     // requests allowed at once, the bucket size
+}
+
+// DefaultRateLimitConfig disables rate limiting, with a burst of 10
+// requests once a rate is given
+var DefaultRateLimitConfig = RateLimitConfig{Burst: 10}
+
+// RegisterFlags sets up flags for the config on the flag set,
+// using the current config values as defaults
+func (c *RateLimitConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&c.Rate, "rate-limit", c.Rate,
+		"Requests per second allowed to each client on each endpoint, 0 for no limit")
+	fs.IntVar(&c.Burst, "rate-burst", c.Burst,
+		"Requests each client can burst on each endpoint, with -rate-limit")
+}
+
+const (
+	// maxBuckets is how many buckets are kept at most, a tenth of them, the
+	// least recently used, are dropped once reached
+	maxBuckets = 10000
+
+	// pruneInterval is how often the idle buckets, full again by now, are
+	// dropped
+	pruneInterval = time.Minute
+)
+
+// bucket is a token bucket, refilled lazily when taken from
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the requests of every client on every endpoint
+type RateLimiter struct {
+	config  RateLimitConfig
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time // last time idle buckets were dropped
+	now     func() time.Time
+}
+
+// NewRateLimiter returns a limiter for the config, nil if rate limiting is
+// disabled
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	if config.Rate == 0 {
+		return nil, nil
+	}
+	if config.Rate < 0 || config.Burst < 1 {
+		return nil, fmt.Errorf("invalid rate limit %v/s with burst %d, both must be positive", config.Rate, config.Burst)
+	}
+	return &RateLimiter{config: config, buckets: make(map[string]*bucket), now: time.Now}, nil
+}
+
+// rateLimit is the outcome of taking a token from a bucket
+type rateLimit struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until the next token, if not allowed
+	reset      time.Duration // until the bucket is full again
+}
+
+// take a token from the bucket of key, if there is any left
+func (l *RateLimiter) take(key string) rateLimit {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	burst := float64(l.config.Burst)
+	if now.Sub(l.pruned) >= pruneInterval {
+		l.pruneLocked(now)
+	}
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxBuckets {
+			l.pruneLocked(now)
+			l.evictLocked(len(l.buckets) - maxBuckets + maxBuckets/10) // not to evict on every new client
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.config.Rate)
+	b.last = now
+	limit := rateLimit{allowed: b.tokens >= 1}
+	if limit.allowed {
+		b.tokens--
+	} else {
+		limit.retryAfter = l.refill(1 - b.tokens)
+	}
+	limit.remaining = int(b.tokens)
+	limit.reset = l.refill(burst - b.tokens)
+	return limit
+}
+
+// refill returns how long it takes to refill the given tokens
+func (l *RateLimiter) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / l.config.Rate * float64(time.Second))
+}
+
+// pruneLocked drops the buckets idle long enough to be full by now, as
+// new ones would be, the caller must hold the lock
+func (l *RateLimiter) pruneLocked(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.config.Rate >= float64(l.config.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruned = now
+}
+
+// evictLocked drops the n least recently used buckets, the caller must
+// hold the lock
+func (l *RateLimiter) evictLocked(n int) {
+	keys := make([]string, 0, len(l.buckets))
+	for key := range l.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return l.buckets[keys[i]].last.Before(l.buckets[keys[j]].last) })
+	for i := 0; i < n && i < len(keys); i++ {
+		delete(l.buckets, keys[i])
+	}
+}
+
+// ClientFor identifies the caller of r by the subject authenticated (up
+// front by Authenticating), or by source IP if auth is off or the
+// credentials are missing or invalid, so unverified headers never get
+// buckets of their own
+func (s *VMServer) ClientFor(r *http.Request) string {
+	if s.auth != nil {
+		if identity, err := s.authenticated(r); err == nil {
+			return "subject " + identity.Subject
+		}
+	}
+	return "ip " + sourceIP(r)
+}
+
+// seconds rounds d up to whole seconds, for headers
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Handler wraps next with rate limiting, with a bucket per client and
+// endpoint as named by clientFor & endpointFor, answering 429 when it is
+// empty
+func (l *RateLimiter) Handler(next http.Handler, clientFor, endpointFor func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := l.take(clientFor(r) + "\n" + endpointFor(r))
+		h := w.Header()
+		h.Set("X-RateLimit-Limit", strconv.Itoa(l.config.Burst))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(limit.remaining))
+		h.Set("X-RateLimit-Reset", seconds(limit.reset))
+		if !limit.allowed {
+			h.Set("Retry-After", seconds(limit.retryAfter))
+			msg := fmt.Sprintf("rate limit of %v requests per second exceeded, retry in %ss",
+				l.config.Rate, seconds(limit.retryAfter))
+			writeProblem(w, r, NewProblem(RateLimited, msg))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EndpointFor names the endpoint requested, such as "PUT /vms/{vm_id}/launch"
+func (s *VMServer) EndpointFor(r *http.Request) string {
+	routed, _, err := negotiateVersion(r)
+	if err == nil {
+		routed = routeProject(routed)
+		if endpoint, found := matchEndpoint(routed); found {
+			return r.Method + " " + endpoint.DisplayPath
+		}
+	}
+	return r.Method + " " + r.URL.Path
+}
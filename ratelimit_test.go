@@ -0,0 +1,113 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveLimited runs a request through the limiter in front of the server
+func serveLimited(l *RateLimiter, s *VMServer, method, url string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.Authenticating(l.Handler(http.HandlerFunc(s.ServeVM), s.ClientFor, s.EndpointFor)).ServeHTTP(w, r)
+	return w
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewDefaultServer()
+	l, err := NewRateLimiter(RateLimitConfig{Rate: 0.5, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i, url := range []string{"/vms", "/v2/vms"} { // same endpoint
+		w := serveLimited(l, s, http.MethodGet, url, nil)
+		checkHeaders(t, w, map[string]string{"X-RateLimit-Limit": "2", "X-RateLimit-Remaining": []string{"1", "0"}[i]})
+	}
+	w := serveLimited(l, s, http.MethodGet, "/vms", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusTooManyRequests)
+	}
+	checkHeaders(t, w, map[string]string{"Retry-After": "2", "X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "4"})
+	if p := decodeProblem(t, w); p.Code != RateLimited {
+		t.Fatalf("got: %+v, want code: %v", p, RateLimited)
+	}
+
+	if w := serveLimited(l, s, http.MethodGet, "/vms/1", nil); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d on another endpoint", w.Code)
+	}
+	if w := serveLimited(l, s, http.MethodGet, "/vms", map[string]string{"X-API-Key": testAPIKey}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status: %d for an API key while auth is off", w.Code)
+	}
+	now = now.Add(2 * time.Second)
+	if w := serveLimited(l, s, http.MethodGet, "/vms", nil); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d after the retry delay", w.Code)
+	}
+}
+
+func TestRateLimitClients(t *testing.T) {
+	s := NewAuthServer(t)
+	l, _ := NewRateLimiter(RateLimitConfig{Rate: 0.5, Burst: 1})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for _, key := range []string{"random-1", "random-2"} {
+		serveLimited(l, s, http.MethodGet, "/vms", map[string]string{"X-API-Key": key})
+	}
+	if w := serveLimited(l, s, http.MethodGet, "/vms", map[string]string{"Authorization": "Bearer random-3"}); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status: %d, want invalid credentials limited by IP", w.Code)
+	}
+	if w := serveLimited(l, s, http.MethodGet, "/vms", map[string]string{"X-API-Key": testAPIKey}); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d for an authenticated client", w.Code)
+	}
+	token := login(t, s, "admin")
+	if w := serveLimited(l, s, http.MethodGet, "/vms", map[string]string{"Authorization": "Bearer " + token}); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d for another authenticated client", w.Code)
+	}
+	if len(l.buckets) != 3 {
+		t.Fatalf("got %d buckets, want 3", len(l.buckets))
+	}
+
+	var client string
+	r := httptest.NewRequest(http.MethodGet, "/vms", nil)
+	r.Header.Set("X-API-Key", testAPIKey)
+	s.Authenticating(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-API-Key") // authenticated already
+		client = s.ClientFor(r)
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	if client != "subject ci" {
+		t.Fatalf("got client: %q, want the subject authenticated up front", client)
+	}
+
+	now = now.Add(pruneInterval)
+	serveLimited(l, s, http.MethodGet, "/vms", nil)
+	if len(l.buckets) != 1 {
+		t.Fatalf("got %d buckets, want the idle ones dropped", len(l.buckets))
+	}
+	for i := 0; i < maxBuckets+1; i++ {
+		l.take(strconv.Itoa(i))
+	}
+	if len(l.buckets) > maxBuckets {
+		t.Fatalf("got %d buckets, want at most %d", len(l.buckets), maxBuckets)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	if l, err := NewRateLimiter(DefaultRateLimitConfig); l != nil || err != nil {
+		t.Fatalf("got: %v, %v, want rate limiting off by default", l, err)
+	}
+	if _, err := NewRateLimiter(RateLimitConfig{Rate: 1}); err == nil {
+		t.Fatalf("got no error without burst")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Role grants access to API methods, each role includes the previous ones
+type Role string
+
+const (
+	// RoleViewer can list & inspect VMs
+	RoleViewer Role = "viewer"
+
+	// RoleOperator can also launch, stop & reboot VMs
+	RoleOperator Role = "operator"
+
+	// RoleAdmin can also create, delete & resize VMs
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists all roles, from least to most privileged
+var Roles = []Role{RoleViewer, RoleOperator, RoleAdmin}
+
+// rank returns the privilege level of the role, 0 if unknown
+func (role Role) rank() int {
+	for i, r := range Roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// includes checks whether the role grants the permissions of required
+func (role Role) includes(required Role) bool {
+	return role.rank() >= required.rank()
+}
+
+// checkRoles fails on unknown role names
+func checkRoles(roles []Role) error {
+	for _, role := range roles {
+		if role.rank() == 0 {
+			return fmt.Errorf("unknown role %q, use one of %v", role, Roles)
+		}
+	}
+	return nil
+}
+
+// rolesOf returns the configured roles, or when missing the role implied by
+// the scopes (admin with vms:write, viewer otherwise)
+func rolesOf(roles []Role, scopes []string) []Role {
+	if len(roles) > 0 {
+		return roles
+	}
+	if (Identity{Scopes: scopes}).HasScope(ScopeWrite) {
+		return []Role{RoleAdmin}
+	}
+	return []Role{RoleViewer}
+}
+
+// HasRole checks whether any of the identity roles includes required
+func (id Identity) HasRole(required Role) bool {
+	if required == "" {
+		return true
+	}
+	for _, role := range id.Roles {
+		if role.includes(required) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeRole fails with a 403 unless the identity has the role
+func authorizeRole(identity Identity, required Role) error {
+	if identity.HasRole(required) {
+		return nil
+	}
+	return &AuthError{
+		Code:   InsufficientRole,
+		Detail: fmt.Sprintf("%s needs the %q role, has %v", identity.Subject, required, identity.Roles),
+	}
+}
+
+// gqlMutationRoles are the roles needed by GraphQL mutations
+var gqlMutationRoles = map[string]Role{
+	"launchVM": RoleOperator,
+	"stopVM":   RoleOperator,
+	"createVM": RoleAdmin,
+	"deleteVM": RoleAdmin,
+}
+
+// the /me endpoint is added on init as it lists APISpec itself
+func init() {
+	APISpec = append(APISpec, EndpointSpec{
+		DisplayPath: "/me",
+		Path:        mustCompileAnchored(`/me[/]?`),
+		Unversioned: true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Me JSON", Doc: "caller identity, roles & permissions",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.me(w, r)
+				},
+			},
+		},
+	})
+}
+
+// Me describes the caller and what it is allowed to do
+type Me struct {
+	Identity
+	Permissions []string `json:"permissions"` // allowed API methods, eg. "PUT /vms/{vm_id}/launch"
+	Mutations   []string `json:"mutations"`   // allowed GraphQL mutations
+}
+
+// anonymous is the identity of callers when authentication is disabled
+var anonymous = Identity{
+	Subject: "anonymous",
+	Scopes:  []string{ScopeRead, ScopeWrite},
+	Method:  "none",
+	Roles:   []Role{RoleAdmin},
+}
+
+// permissionsOf returns what the identity is allowed to do
+func (s *VMServer) permissionsOf(identity Identity) Me {
+	me := Me{Identity: identity, Permissions: []string{}, Mutations: []string{}}
+	for _, endpoint := range APISpec {
+		for _, m := range endpoint.Methods {
+			if endpoint.Public || authorize(identity, m) == nil {
+				me.Permissions = append(me.Permissions, m.Method+" "+endpoint.DisplayPath)
+			}
+		}
+	}
+	if identity.HasScope(ScopeWrite) {
+		for mutation, role := range gqlMutationRoles {
+			if identity.HasRole(role) {
+				me.Mutations = append(me.Mutations, mutation)
+			}
+		}
+	}
+	sort.Strings(me.Mutations)
+	return me
+}
+
+// me replies with the caller identity and permissions
+func (s *VMServer) me(w http.ResponseWriter, r *http.Request) {
+	identity, found := identityOf(r)
+	if !found {
+		identity = anonymous
+	}
+	writeJSON(w, r, http.StatusOK, s.permissionsOf(identity))
+}
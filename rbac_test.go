@@ -0,0 +1,117 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var roleCases = []struct {
+	username string
+	method   string
+	url      string
+	want     int
+}{
+	{"viewer", http.MethodGet, "/vms/1", http.StatusOK},
+	{"operator", http.MethodPut, "/vms/1/launch", http.StatusOK},
+	{"operator", http.MethodDelete, "/vms/2", http.StatusForbidden},
+	{"admin", http.MethodDelete, "/vms/2", http.StatusOK}, // no roles, admin after its scopes
+}
+
+func TestRoles(t *testing.T) {
+	for _, tc := range roleCases {
+		s := NewAuthServer(t)
+		bearer := map[string]string{"Authorization": "Bearer " + login(t, s, tc.username)}
+		w := serveWithHeaders(s, tc.method, tc.url, bearer)
+		if w.Code != tc.want {
+			t.Fatalf("%s %s %s got status: %d, want: %d", tc.username, tc.method, tc.url, w.Code, tc.want)
+		}
+		if tc.want == http.StatusForbidden {
+			if p := decodeProblem(t, w); p.Code != InsufficientRole {
+				t.Fatalf("got: %+v, want code: %v", p, InsufficientRole)
+			}
+		}
+	}
+}
+
+func TestTokenWithoutRoles(t *testing.T) {
+	s := NewAuthServer(t)
+	for _, tc := range []struct {
+		scope, method, url string
+	}{
+		{ScopeRead, http.MethodGet, "/vms/1"},                       // viewer after its scopes
+		{ScopeRead + " " + ScopeWrite, http.MethodDelete, "/vms/2"}, // admin after its scopes
+	} {
+		token, err := signHS256(Claims{Subject: "script", Scope: tc.scope}, []byte(testAuthConfig.TokenSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serveWithHeaders(s, tc.method, tc.url, map[string]string{"Authorization": "Bearer " + token})
+		if w.Code != http.StatusOK {
+			t.Errorf("%q %s %s got status: %d, want: %d", tc.scope, tc.method, tc.url, w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestBadRole(t *testing.T) {
+	config := testAuthConfig
+	config.Users = []User{{Username: "root", Password: "secret", Roles: []Role{"root"}}}
+	if _, err := NewAuthenticator(config); err == nil {
+		t.Fatalf("got no error for an unknown role")
+	}
+}
+
+func TestMe(t *testing.T) {
+	s := NewAuthServer(t)
+	bearer := map[string]string{"Authorization": "Bearer " + login(t, s, "operator")}
+	w := serveWithHeaders(s, http.MethodGet, "/me", bearer)
+	var me Me
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil {
+		t.Fatalf("Failed to decode %s: %v", w.Body.String(), err)
+	}
+	if me.Subject != "operator" || !reflect.DeepEqual(me.Roles, []Role{RoleOperator}) {
+		t.Fatalf("got: %+v", me)
+	}
+	permissions := strings.Join(me.Permissions, "\n")
+	if !strings.Contains(permissions, "PUT /vms/{vm_id}/launch") || strings.Contains(permissions, "DELETE /vms/{vm_id}") {
+		t.Fatalf("got permissions: %v", me.Permissions)
+	}
+	if want := []string{"launchVM", "stopVM"}; !reflect.DeepEqual(me.Mutations, want) {
+		t.Fatalf("got mutations: %v, want: %v", me.Mutations, want)
+	}
+}
+
+func TestMeWithoutAuth(t *testing.T) {
+	w := serve(NewDefaultServer(), http.MethodGet, "/me")
+	var me Me
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil {
+		t.Fatalf("Failed to decode %s: %v", w.Body.String(), err)
+	}
+	if me.Subject != "anonymous" || len(me.Mutations) != len(gqlMutationRoles) {
+		t.Fatalf("got: %+v", me)
+	}
+}
+
+func TestGraphQLMutationRoles(t *testing.T) {
+	s := NewAuthServer(t)
+	query := `{"query":"mutation { launchVM(id: 1) { state } deleteVM(id: 2) }"}`
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(query))
+	r.Header.Set("Authorization", "Bearer "+login(t, s, "operator"))
+	w := serveRequest(s, r)
+	var response gqlResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse GraphQL response %q: %v", w.Body.String(), err)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Extensions["code"] != string(InsufficientRole) {
+		t.Fatalf("got errors: %+v", response.Errors)
+	}
+	if vm, _ := s.vmm.Inspect(1); vm.State == STOPPED {
+		t.Fatalf("VM 1 was not launched")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWatchInterval is how often the state file is checked for changes
+const DefaultWatchInterval = 2 * time.Second
+
+// MaxReloads is how many reload reports are kept
+const MaxReloads = 20
+
+// ReloadReport tells what a reload of the state file changed
+type ReloadReport struct {
+	Time      time.Time `json:"time"`
+	Added     []int     `json:"added"`     // new VMs
+	Updated   []int     `json:"updated"`   // Stopped VMs with new hardware specs
+	Projects  []string  `json:"projects"`  // new or updated projects
+	Conflicts []string  `json:"conflicts"` // changes which could not be applied
+}
+
+// changes tells whether the reload changed or tried to change anything
+func (r ReloadReport) changes() bool {
+	return len(r.Added)+len(r.Updated)+len(r.Projects)+len(r.Conflicts) > 0
+}
+
+func (r ReloadReport) String() string {
+	s := fmt.Sprintf("%d VMs added %v, %d updated %v, %d projects changed %v",
+		len(r.Added), r.Added, len(r.Updated), r.Updated, len(r.Projects), r.Projects)
+	if len(r.Conflicts) > 0 {
+		s += fmt.Sprintf(", %d conflicts: %s", len(r.Conflicts), strings.Join(r.Conflicts, "; "))
+	}
+	return s
+}
+
+// sameHardware tells whether both VMs have the same hardware spec
+func sameHardware(a, b VM) bool {
+	return a.VCPUS == b.VCPUS && a.Clock == b.Clock && a.RAM == b.RAM &&
+		a.Storage == b.Storage && a.Network == b.Network
+}
+
+// Merge the state into this Cloud: projects are added or updated, new VMs
+// added and Stopped VMs get their new hardware specs. VMs missing in the
+// state are kept, and VM states are left alone. The rest are conflicts.
+func (c *Cloud) Merge(state CloudState) ReloadReport {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	report := ReloadReport{Time: time.Now(), Added: []int{}, Updated: []int{}, Projects: []string{}, Conflicts: []string{}}
+	for _, p := range state.Projects {
+		if err := p.Validate(); err != nil {
+			report.Conflicts = append(report.Conflicts, err.Error())
+			continue
+		}
+		current, found := c.findProjectLocked(p.ID)
+		if found && reflect.DeepEqual(current, p) {
+			continue
+		}
+		c.replaceProjectLocked(p)
+		report.Projects = append(report.Projects, p.ID)
+	}
+
+	ids := make([]int, 0, len(state.VMs))
+	for id := range state.VMs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		vm := state.VMs[id]
+		if vm.Project == DefaultProjectID {
+			vm.Project = ""
+		}
+		if err := vm.Validate(); err != nil {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("VM %d: %v", id, err))
+			continue
+		}
+		current, found := c.store.Get(id)
+		switch {
+		case !found && c.deletedLocked(id):
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("VM %d: deleted, restore it from the trash", id))
+		case !found:
+			if _, found := c.findProjectLocked(vm.ProjectID()); !found {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("VM %d: not found project %q", id, vm.ProjectID()))
+				continue
+			}
+			if vm.State == "" {
+				vm.State = STOPPED
+			}
+			vm = vm.stamped(time.Now())
+			if err := c.store.Put(id, vm); err != nil {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("VM %d: %v", id, err))
+				continue
+			}
+			c.notify(VMCreated, id, vm)
+			report.Added = append(report.Added, id)
+		case current.ProjectID() != vm.ProjectID():
+			report.Conflicts = append(report.Conflicts,
+				fmt.Sprintf("VM %d: cannot move from project %q to %q", id, current.ProjectID(), vm.ProjectID()))
+		case sameHardware(current, vm):
+		case current.State != STOPPED:
+			report.Conflicts = append(report.Conflicts,
+				fmt.Sprintf("VM %d: must be %v to change its hardware but it is %v", id, STOPPED, current.State))
+		default:
+			now := time.Now()
+			vm.State, vm.Protected, vm.UpdatedAt, vm.UptimeSeconds, vm.Progress = current.State, current.Protected, &now, 0, nil
+			vm.CreatedAt, vm.LastStateChangeAt, vm.LaunchedAt = current.CreatedAt, current.LastStateChangeAt, current.LaunchedAt
+			if err := c.store.Put(id, vm); err != nil {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("VM %d: %v", id, err))
+				continue
+			}
+			c.notify(VMResized, id, vm)
+			report.Updated = append(report.Updated, id)
+		}
+	}
+
+	if report.changes() {
+		c.reloads = append(c.reloads, report)
+		if len(c.reloads) > MaxReloads {
+			c.reloads = c.reloads[len(c.reloads)-MaxReloads:]
+		}
+	}
+	return report
+}
+
+// Reloads returns the reports of the latest reloads which changed anything
+func (c *Cloud) Reloads() []ReloadReport {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return append([]ReloadReport{}, c.reloads...)
+}
+
+// Watcher polls a state file, merging its changes into a Cloud
+type Watcher struct {
+	cloud    *Cloud
+	filename string
+	load     func() (CloudState, error)
+	lock     sync.Mutex
+	seen     os.FileInfo // the file last loaded or written
+}
+
+// NewWatcher returns a Watcher of the file loaded by load, taking its
+// current version as seen
+func NewWatcher(c *Cloud, filename string, load func() (CloudState, error)) *Watcher {
+	w := &Watcher{cloud: c, filename: filename, load: load}
+	w.seen, _ = os.Stat(filename)
+	return w
+}
+
+// modified tells whether the file changed since it was last seen
+func (w *Watcher) modified(info os.FileInfo) bool {
+	return w.seen == nil || !info.ModTime().Equal(w.seen.ModTime()) || info.Size() != w.seen.Size()
+}
+
+// Check merges the file into the Cloud if it was modified, a missing file
+// is not a change
+func (w *Watcher) Check() (ReloadReport, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	info, err := os.Stat(w.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return ReloadReport{}, nil
+	}
+	if err != nil || !w.modified(info) {
+		return ReloadReport{}, err
+	}
+	w.seen = info
+	state, err := w.load()
+	if err != nil {
+		return ReloadReport{}, err
+	}
+	return w.cloud.Merge(state), nil
+}
+
+// Write runs save, which writes the file, so that the Watcher does not
+// reload it
+func (w *Watcher) Write(save func() error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	err := save()
+	if info, statErr := os.Stat(w.filename); statErr == nil {
+		w.seen = info
+	}
+	return err
+}
+
+// Run checks the file every interval until stop is closed, logging the
+// reloads
+func (w *Watcher) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		report, err := w.Check()
+		if err != nil {
+			log.Printf("error reloading %q: %v", w.filename, err)
+		} else if report.changes() {
+			log.Printf("Reloaded %q: %v", w.filename, report)
+		}
+	}
+}
+
+func (s *VMServer) listReloads(w http.ResponseWriter, r *http.Request) {
+	reloads := s.vmm.Reloads()
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, reloads)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: reloads, Links: map[string]string{"self": versionedPath(r, "/reloads")}})
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	c := NewDefaultCloud()
+	forceState(&c, GoodID, RUNNING)
+	state := CloudState{
+		Projects: []Project{DefaultProject, teamA},
+		VMs: VMs{
+			0: {VCPUS: 1, Clock: 1500, RAM: 8192, Storage: 128, Network: 1000, State: STOPPED},
+			1: {VCPUS: 8, Clock: 3600, RAM: 32768, Storage: 512, Network: 10000, State: STOPPED},
+			5: {VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100, Project: teamA.ID},
+			6: {VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100, Project: "team-b"},
+		},
+	}
+	report := c.Merge(state)
+	if !reflect.DeepEqual(report.Added, []int{5}) || !reflect.DeepEqual(report.Updated, []int{0}) ||
+		!reflect.DeepEqual(report.Projects, []string{teamA.ID}) || len(report.Conflicts) != 2 {
+		t.Fatalf("got: %v", report)
+	}
+	vms := c.List()
+	if vms[0].RAM != 8192 || vms[1].VCPUS != 4 || vms[1].State != RUNNING || vms[5].State != STOPPED || len(vms) != 4 {
+		t.Fatalf("got VMs: %v", vms)
+	}
+	if report := c.Merge(state); len(report.Added)+len(report.Updated)+len(report.Projects) != 0 {
+		t.Fatalf("got: %v, want no changes merging again", report)
+	}
+	if reloads := c.Reloads(); len(reloads) != 2 {
+		t.Fatalf("got %d reloads, want 2 (with conflicts)", len(reloads))
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, VMsJSON)
+	write := func(state CloudState) error {
+		data, _ := json.Marshal(state)
+		return ioutil.WriteFile(filename, data, 0644)
+	}
+	load := func() (CloudState, error) {
+		var state CloudState
+		data, err := ioutil.ReadFile(filename)
+		if err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+		return state, err
+	}
+	if err := write(defaultState); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewDefaultServer()
+	w := NewWatcher(&s.vmm, filename, load)
+	state := CloudState{VMs: defaultVMs.clone()}
+	state.VMs[3] = VM{VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100}
+	if err := w.Write(func() error { return write(state) }); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := w.Check(); err != nil || report.changes() {
+		t.Fatalf("got: %v, %v, want the file written not reloaded", report, err)
+	}
+	state.VMs[4] = state.VMs[3]
+	if err := write(state); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := w.Check(); err != nil || !reflect.DeepEqual(report.Added, []int{3, 4}) {
+		t.Fatalf("got: %v, %v", report, err)
+	}
+
+	var reloads []ReloadReport
+	if err := json.Unmarshal(serve(s, http.MethodGet, "/reloads").Body.Bytes(), &reloads); err != nil || len(reloads) != 1 {
+		t.Fatalf("got: %+v, %v", reloads, err)
+	}
+}
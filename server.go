@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -18,6 +19,8 @@ import (
 type VMServer struct {
 	vmm     Cloud
 	address string
+	auth    *Authenticator // nil when authentication is disabled
+	audit   *AuditLog      // nil when auditing is disabled
 }
 
 type serverHandler func(s *VMServer, w http.ResponseWriter, r *http.Request)
@@ -34,6 +37,8 @@ type MethodSpec struct {
 	BodySpec string
 	Doc      string
 	Handler  serverHandler
+	Scope    string // needed when authentication is on, by default after Method
+	Role     Role   // needed when authentication is on, any if empty
 }
 
 // EndpointSpec defined a path endpoint and all its methods
@@ -41,16 +46,10 @@ type EndpointSpec struct {
 	DisplayPath string
 	Path        *regexp.Regexp
 	Methods     []MethodSpec
-}
-
-// Added with my own expert hands 🤪🧐
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	// (*w).Header().Set("Vary", "Origin")
-	// (*w).Header().Set("Vary", "Access-Control-Request-Method")
-	// (*w).Header().Set("Vary", "Access-Control-Request-Headers")
-	// (*w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Authorization")
-	// (*w).Header().Set("Access-Control-Allow-Methods", "POST, PUT, GET, DELETE, OPTIONS")
+	Unversioned bool // not part of the versioned REST API
+	Public      bool // no authentication needed
+	Projected   bool // also served under /projects/{project_id}, for that project
+	SelfAudited bool // its handler picks the requests to audit, with auditRequest
 }
 
 // APISpec specifies endpoint paths and their implemented methods
@@ -58,59 +57,506 @@ var APISpec = []EndpointSpec{
 	{
 		DisplayPath: "/vms",
 		Path:        mustCompileAnchored(`/vms[/]?`),
+		Projected:   true,
 		Methods: []MethodSpec{
 			{
-				http.MethodGet, "VMs JSON", "list All VMs",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					enableCors(&w)
+				Method: http.MethodGet, BodySpec: "VMs JSON", Doc: "list All VMs (?at=time for the past ones)",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.list(w, r)
 				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodPost, BodySpec: "VM JSON", Doc: "create a Stopped VM",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.create(w, r)
+				},
+				Role: RoleAdmin,
 			},
 		},
 	},
 	{
 		DisplayPath: "/vms/{vm_id}/launch",
 		Path:        mustCompileAnchored(`/vms/\d+/launch[/]?`),
+		Projected:   true,
 		Methods: []MethodSpec{
 			{
-				http.MethodPut, "", "launch VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					enableCors(&w)
+				Method: http.MethodPut, BodySpec: "", Doc: "launch VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.requestIDfor(s.launch, 2, w, r)
 				},
+				Role: RoleOperator,
 			},
 		},
 	},
 	{
 		DisplayPath: "/vms/{vm_id}/stop",
 		Path:        mustCompileAnchored(`/vms/\d+/stop[/]?`),
+		Projected:   true,
 		Methods: []MethodSpec{
 			{
-				http.MethodPut, "", "stop VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					enableCors(&w)
+				Method: http.MethodPut, BodySpec: "", Doc: "stop VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.requestIDfor(s.stop, 2, w, r)
 				},
+				Role: RoleOperator,
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/reboot",
+		Path:        mustCompileAnchored(`/vms/\d+/reboot[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPut, BodySpec: "", Doc: "reboot VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.reboot, 2, w, r)
+				},
+				Role: RoleOperator,
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/resize",
+		Path:        mustCompileAnchored(`/vms/\d+/resize[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPut, BodySpec: "VM JSON", Doc: "resize a Stopped VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.resize, 2, w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/history",
+		Path:        mustCompileAnchored(`/vms/\d+/history[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Events JSON", Doc: "events of a VM by id, even if deleted",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.history, 2, w, r)
+				},
+				Role: RoleViewer,
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/snapshots",
+		Path:        mustCompileAnchored(`/vms/\d+/snapshots[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Snapshots JSON", Doc: "list the snapshots of a VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.listSnapshots, 2, w, r)
+				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodPost, BodySpec: "Snapshot JSON", Doc: "snapshot the disk of a VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.createSnapshot, 2, w, r)
+				},
+				Role: RoleOperator,
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/snapshots/{snapshot_id}",
+		Path:        mustCompileAnchored(`/vms/\d+/snapshots/\d+[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Snapshot JSON", Doc: "inspect a snapshot of a VM by ids",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.inspectSnapshot, 2, w, r)
+				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodDelete, BodySpec: "", Doc: "delete an Available snapshot of a VM by ids",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.deleteSnapshot, 2, w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/vms/{vm_id}/restore",
+		Path:        mustCompileAnchored(`/vms/\d+/restore[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPost, BodySpec: "VM JSON", Doc: "restore a Stopped VM by id from a snapshot_id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.restoreSnapshot, 2, w, r)
+				},
+				Role: RoleAdmin,
 			},
 		},
 	},
 	{
 		DisplayPath: "/vms/{vm_id}",
 		Path:        mustCompileAnchored(`/vms/\d+`),
+		Projected:   true,
 		Methods: []MethodSpec{
 			{
-				http.MethodGet, "VM JSON", "inspect a VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					enableCors(&w)
+				Method: http.MethodGet, BodySpec: "VM JSON", Doc: "inspect a VM by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.requestIDfor(s.inspect, 2, w, r)
 				},
+				Role: RoleViewer,
 			},
 			{
-				http.MethodDelete, "", "delete a VM by id",
-				func(s *VMServer, w http.ResponseWriter, r *http.Request) {
-					enableCors(&w)
+				Method: http.MethodPatch, BodySpec: "VM JSON", Doc: "update a VM by id, its deletion protection",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.update, 2, w, r)
+				},
+				Role: RoleAdmin,
+			},
+			{
+				Method: http.MethodDelete, BodySpec: "", Doc: "delete a VM by id, to the trash (?force=true detaches its volumes)",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
 					s.requestIDfor(s.delete, 2, w, r)
 				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/trash",
+		Path:        mustCompileAnchored(`/trash[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "VMs JSON", Doc: "list the deleted VMs until purged",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listTrash(w, r)
+				},
+				Role: RoleViewer,
+			},
+		},
+	},
+	{
+		DisplayPath: "/trash/{vm_id}/restore",
+		Path:        mustCompileAnchored(`/trash/\d+/restore[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPost, BodySpec: "VM JSON", Doc: "restore a deleted VM by id, Stopped",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestIDfor(s.restore, 2, w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/volumes",
+		Path:        mustCompileAnchored(`/volumes[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Volumes JSON", Doc: "list volumes",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listVolumes(w, r)
+				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodPost, BodySpec: "Volume JSON", Doc: "create an Available volume",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.createVolume(w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/volumes/{volume_id}/attach",
+		Path:        mustCompileAnchored(`/volumes/\d+/attach[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPut, BodySpec: "Volume JSON", Doc: "attach a volume by id to a vm_id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestVolumeFor(s.attachVolume, 2, w, r)
+				},
+				Role: RoleOperator,
+			},
+		},
+	},
+	{
+		DisplayPath: "/volumes/{volume_id}/detach",
+		Path:        mustCompileAnchored(`/volumes/\d+/detach[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPut, BodySpec: "Volume JSON", Doc: "detach a volume by id from its VM",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestVolumeFor(s.detachVolume, 2, w, r)
+				},
+				Role: RoleOperator,
+			},
+		},
+	},
+	{
+		DisplayPath: "/volumes/{volume_id}",
+		Path:        mustCompileAnchored(`/volumes/\d+[/]?`),
+		Projected:   true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Volume JSON", Doc: "inspect a volume by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestVolumeFor(s.inspectVolume, 2, w, r)
+				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodPatch, BodySpec: "Volume JSON", Doc: "update a volume by id, its name & (growing) size",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestVolumeFor(s.updateVolume, 2, w, r)
+				},
+				Role: RoleAdmin,
+			},
+			{
+				Method: http.MethodDelete, BodySpec: "", Doc: "delete an Available volume by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.requestVolumeFor(s.deleteVolume, 2, w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/projects",
+		Path:        mustCompileAnchored(`/projects[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Projects JSON", Doc: "list projects of the caller",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listProjects(w, r)
+				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodPost, BodySpec: "Project JSON", Doc: "create a project",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.createProject(w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/projects/{project_id}",
+		Path:        mustCompileAnchored(`/projects/[^/]+[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Project JSON", Doc: "inspect a project by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.inspectProject(w, r)
+				},
+				Role: RoleViewer,
+			},
+			{
+				Method: http.MethodPut, BodySpec: "Project JSON", Doc: "update a project name, members & quota",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.updateProject(w, r)
+				},
+				Role: RoleAdmin,
+			},
+			{
+				Method: http.MethodDelete, BodySpec: "", Doc: "delete an empty project by id",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.deleteProject(w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/projects/{project_id}/quota",
+		Path:        mustCompileAnchored(`/projects/[^/]+/quota[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Quota JSON", Doc: "quota usage vs limits of a project",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.inspectQuota(w, r)
+				},
+				Role: RoleViewer,
+			},
+		},
+	},
+	{
+		DisplayPath: "/quotas",
+		Path:        mustCompileAnchored(`/quotas[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Quotas JSON", Doc: "quota usage vs limits of the caller projects",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listQuotas(w, r)
+				},
+				Role: RoleViewer,
+			},
+		},
+	},
+	{
+		DisplayPath: "/reloads",
+		Path:        mustCompileAnchored(`/reloads[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Reloads JSON", Doc: "latest changes reloaded from the state file",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listReloads(w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/audit",
+		Path:        mustCompileAnchored(`/audit[/]?`),
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Audit JSON", Doc: "mutating requests, filtered by actor, method, vm_id, result, since & until",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.listAudit(w, r)
+				},
+				Role: RoleAdmin,
+			},
+		},
+	},
+	{
+		DisplayPath: "/graphql",
+		Path:        mustCompileAnchored(`/graphql[/]?`),
+		Unversioned: true,
+		SelfAudited: true, // mutations only
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPost, BodySpec: "GraphQL JSON", Doc: "run GraphQL requests (SSE for subscriptions)",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.graphql(w, r)
+				},
+				Scope: ScopeRead, // mutations check for ScopeWrite & their role
+				Role:  RoleViewer,
+			},
+			{
+				Method: http.MethodGet, BodySpec: "GraphQL JSON", Doc: "run GraphQL queries (?query=...)",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.graphql(w, r)
+				},
+				Role: RoleViewer,
+			},
+		},
+	},
+	{
+		DisplayPath: "/graphql/schema",
+		Path:        mustCompileAnchored(`/graphql/schema[/]?`),
+		Unversioned: true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "GraphQL SDL", Doc: "GraphQL schema",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.graphqlSchema(w, r)
+				},
+				Role: RoleViewer,
+			},
+		},
+	},
+	{
+		DisplayPath: "/auth/token",
+		Path:        mustCompileAnchored(`/auth/token[/]?`),
+		Unversioned: true,
+		Public:      true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPost, BodySpec: "Token JSON", Doc: "get a bearer token for a username & password",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.token(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/.well-known/openid-configuration",
+		Path:        mustCompileAnchored(`/\.well-known/openid-configuration`),
+		Unversioned: true,
+		Public:      true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "OIDC JSON", Doc: "OpenID Connect discovery",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.oidcDiscovery(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/oauth/jwks",
+		Path:        mustCompileAnchored(`/oauth/jwks[/]?`),
+		Unversioned: true,
+		Public:      true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "JWKS JSON", Doc: "OIDC token signing keys",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.oidcJWKS(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/oauth/authorize",
+		Path:        mustCompileAnchored(`/oauth/authorize[/]?`),
+		Unversioned: true,
+		Public:      true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "Login HTML", Doc: "OIDC login page (authorization code + PKCE)",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.oidcAuthorize(w, r)
+				},
+			},
+			{
+				Method: http.MethodPost, BodySpec: "Redirect", Doc: "OIDC login, redirects with a code",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.oidcAuthorize(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/oauth/token",
+		Path:        mustCompileAnchored(`/oauth/token[/]?`),
+		Unversioned: true,
+		Public:      true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodPost, BodySpec: "Token JSON", Doc: "OIDC code exchange for access & ID tokens",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.oidcToken(w, r)
+				},
+			},
+		},
+	},
+	{
+		DisplayPath: "/oauth/userinfo",
+		Path:        mustCompileAnchored(`/oauth/userinfo[/]?`),
+		Unversioned: true,
+		Methods: []MethodSpec{
+			{
+				Method: http.MethodGet, BodySpec: "User JSON", Doc: "OIDC claims of the token user",
+				Handler: func(s *VMServer, w http.ResponseWriter, r *http.Request) {
+					s.oidcUserInfo(w, r)
+				},
+				Scope: ScopeOpenID,
 			},
 		},
 	},
@@ -129,28 +575,125 @@ func (s *VMServer) WriteAPIDoc(w io.Writer) {
 				m.Method, endpoint.DisplayPath, bodySpec, m.Doc)
 		}
 	}
+	fmt.Fprintf(w, "Versions: %v (default %v, deprecated), pick one by path prefix (/%v/vms)\n",
+		APIVersions, DefaultAPIVersion, LatestAPIVersion)
+	fmt.Fprintf(w, "or Accept header (%s%v+json)\n", VendorMediaTypePrefix, LatestAPIVersion)
+	fmt.Fprintln(w, "VM, trash & volume endpoints are also served per project under /projects/{project_id}, /vms are the default project ones")
+}
+
+// matchEndpoint finds the APISpec endpoint of a routed request
+func matchEndpoint(r *http.Request) (*EndpointSpec, bool) {
+	for i, endpoint := range APISpec {
+		if endpoint.Unversioned && originalPath(r) != r.URL.Path {
+			continue
+		}
+		if projectScoped(r) && !endpoint.Projected {
+			continue
+		}
+		if endpoint.Path.MatchString(r.URL.Path) {
+			return &APISpec[i], true
+		}
+	}
+	return nil, false
+}
+
+// methods lists the methods implemented by the endpoint
+func (e *EndpointSpec) methods() []string {
+	methods := make([]string, 0, len(e.Methods))
+	for _, m := range e.Methods {
+		methods = append(methods, m.Method)
+	}
+	return methods
+}
+
+// MethodsFor lists the methods implemented on the path of the request
+func (s *VMServer) MethodsFor(r *http.Request) []string {
+	r, _, err := negotiateVersion(r)
+	if err != nil {
+		return nil
+	}
+	r = routeProject(r)
+	if endpoint, found := matchEndpoint(r); found {
+		return endpoint.methods()
+	}
+	return nil
+}
+
+// authenticate the caller of r and check it is allowed to run the method
+func (s *VMServer) authenticate(r *http.Request, m MethodSpec) (Identity, error) {
+	identity, err := s.authenticated(r)
+	if err != nil {
+		return identity, err
+	}
+	return identity, authorize(identity, m)
 }
 
 // ServeVM dispatchs the request to the correct method follwing the API schema
 func (s *VMServer) ServeVM(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "OPTIONS" {
-		// w.Header().Set("Access-Control-Allow-Headers", "Authorization") // You can add more headers here if needed
-		// w.Header().Set("Access-Control-Allow-Origin:", "*") // You can add more headers here if needed
-	} else {
-		log.Printf("<- %v %v", r.Method, r.URL.Path)
-		for _, endpoint := range APISpec {
-			if endpoint.Path.MatchString(r.URL.Path) {
-				for _, m := range endpoint.Methods {
-					if r.Method == m.Method {
-						m.Handler(s, w, r)
+	log.Printf("<- %v %v", r.Method, r.URL.Path)
+	setRequestID(w, r)
+	r, negotiable, err := negotiateVersion(r)
+	if negotiable { // not to cache the response of any version for all
+		addVary(w.Header(), "Accept")
+	}
+	if err != nil {
+		writeProblem(w, r, NewProblem(UnsupportedAPIVersion, err.Error()))
+		return
+	}
+	r = routeProject(r)
+	endpoint, found := matchEndpoint(r)
+	if found {
+		allow := strings.Join(append(endpoint.methods(), http.MethodOptions), ", ")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		for _, m := range endpoint.Methods {
+			if r.Method == m.Method {
+				var identity Identity
+				if aw := s.startAudit(w, r, endpoint); aw != nil {
+					w = aw
+					defer func() { s.endAudit(aw, identity) }()
+				}
+				if s.auth != nil && !endpoint.Public {
+					var err error
+					identity, err = s.authenticate(r, m)
+					if err != nil {
+						writeAuthError(w, r, err)
 						return
 					}
+					r = withIdentity(r, identity)
+				}
+				if endpoint.Projected {
+					if err := s.checkProject(r); err != nil {
+						writeError(w, r, err)
+						return
+					}
+				}
+				if !endpoint.Unversioned {
+					setVersionHeaders(w, r)
 				}
+				m.Handler(s, w, r)
+				return
 			}
 		}
-		msg := fmt.Sprintf("%v %v not allowed", r.Method, r.URL.Path)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", allow)
 	}
+	msg := fmt.Sprintf("%v %v not allowed", r.Method, r.URL.Path)
+	writeProblem(w, r, NewProblem(MethodNotAllowed, msg))
+}
+
+// addVary adds field to the Vary header unless it was there already
+func addVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, f := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
 }
 
 func matches(r *http.Request, method string, pathRegex *regexp.Regexp) bool {
@@ -162,45 +705,210 @@ func matches(r *http.Request, method string, pathRegex *regexp.Regexp) bool {
 
 func (s *VMServer) list(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, fmt.Sprintf("%v not allowed", r.Method), http.StatusMethodNotAllowed)
+		writeProblem(w, r, NewProblem(MethodNotAllowed, fmt.Sprintf("%v not allowed", r.Method)))
 		return
 	}
-	fmt.Fprint(w, s.vmm.List().String())
+	format, err := negotiateFormat(w, r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	vms := s.vmm.List()
+	if r.URL.Query().Get("at") != "" {
+		if vms, err = s.listAt(r); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	vms = vms.inProject(projectOf(r))
+	if format != FormatJSON && apiVersion(r) == V1 {
+		writeFormatted(w, r, format, vms.resourcesV1())
+		return
+	}
+	if format != FormatJSON {
+		writeFormatted(w, r, format, vms.resources())
+		return
+	}
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vms.v1())
+		return
+	}
+	envelope, err := s.listV2(r, vms)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, envelope)
 }
 
 func (s *VMServer) requestIDfor(f idHandlerFunc, pos int, w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	id, err := strconv.Atoi(path.Base(pathParts[pos]))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	if vm, found := s.vmm.Inspect(id); found && vm.ProjectID() != projectOf(r) {
+		writeError(w, r, cloudErrorf(VMNotFound, id, "not found VM with id %d in project %q", id, projectOf(r)))
 		return
 	}
 	f(id, w, r)
 }
 
+// accepted replies to a successful launch or stop request on VM id
+func (s *VMServer) accepted(id int, w http.ResponseWriter, r *http.Request) {
+	if apiVersion(r) == V1 {
+		return
+	}
+	vm, _ := s.vmm.Inspect(id)
+	writeJSON(w, r, http.StatusAccepted, s.vmV2(r, id, vm))
+}
+
 func (s *VMServer) launch(id int, w http.ResponseWriter, r *http.Request) {
 	if _, err := s.vmm.Launch(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
+	s.accepted(id, w, r)
 }
 
 func (s *VMServer) stop(id int, w http.ResponseWriter, r *http.Request) {
 	if _, err := s.vmm.Stop(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
+	s.accepted(id, w, r)
+}
+
+func (s *VMServer) reboot(id int, w http.ResponseWriter, r *http.Request) {
+	if _, err := s.vmm.Reboot(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.accepted(id, w, r)
+}
+
+// readVM decodes a VM hardware spec from the request JSON body
+func readVM(r *http.Request) (VM, error) {
+	var spec VM
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		return spec, fmt.Errorf("bad JSON VM: %v", err)
+	}
+	return spec, nil
+}
+
+func (s *VMServer) create(w http.ResponseWriter, r *http.Request) {
+	spec, err := readVM(r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	spec.Project = projectOf(r) // VMs are created on the project of the path
+	id, err := s.vmm.Create(spec)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	vm, _ := s.vmm.Inspect(id)
+	w.Header().Set("Location", versionedPath(r, fmt.Sprintf("/vms/%d", id)))
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusCreated, VMResourceV1{ID: id, VMV1: vm.v1()})
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, s.vmV2(r, id, vm))
+}
+
+func (s *VMServer) resize(id int, w http.ResponseWriter, r *http.Request) {
+	spec, err := readVM(r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	if err := s.vmm.Resize(id, spec); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	vm, _ := s.vmm.Inspect(id)
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vm.v1())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.vmV2(r, id, vm))
+}
+
+// VMPatch is the body of a VM update, with the fields to change
+type VMPatch struct {
+	Protected *bool `json:"protected"`
+}
+
+func (s *VMServer) update(id int, w http.ResponseWriter, r *http.Request) {
+	var patch VMPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON VM patch, only protected can be updated: %v", err)))
+		return
+	}
+	if patch.Protected == nil {
+		writeProblem(w, r, NewProblem(BadRequest, "missing protected, the only field to update"))
+		return
+	}
+	if _, err := s.vmm.Protect(id, *patch.Protected); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	vm, _ := s.vmm.Inspect(id)
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vm.v1())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.vmV2(r, id, vm))
 }
 
 func (s *VMServer) delete(id int, w http.ResponseWriter, r *http.Request) {
-	if err := s.vmm.Delete(id); err != nil {
-		http.Error(w, err.Error(), http.StatusNotAcceptable)
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		if force, err = strconv.ParseBool(value); err != nil {
+			writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad force %q: %v", value, err)))
+			return
+		}
+	}
+	remove := s.vmm.Delete
+	if force {
+		remove = s.vmm.ForceDelete
+	}
+	if err := remove(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) != V1 {
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 func (s *VMServer) inspect(id int, w http.ResponseWriter, r *http.Request) {
-	vm, _ := s.vmm.Inspect(id)
-	if _, err := fmt.Fprint(w, vm); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	format, err := negotiateFormat(w, r)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	vm, found := s.vmm.Inspect(id)
+	if !found {
+		writeError(w, r, s.vmm.NotFound(id, "not found VM with id %d", id))
+		return
+	}
+	if format != FormatJSON && apiVersion(r) == V1 {
+		writeFormatted(w, r, format, VMResourceV1{ID: id, VMV1: vm.v1()})
+		return
+	}
+	if format != FormatJSON {
+		writeFormatted(w, r, format, VMResource{ID: id, VM: vm})
+		return
+	}
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vm.v1())
+		return
 	}
+	writeJSON(w, r, http.StatusOK, s.vmV2(r, id, vm))
 }
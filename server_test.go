@@ -0,0 +1,335 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func NewDefaultServer() *VMServer {
+	return &VMServer{vmm: NewDefaultCloud(), audit: NewAuditLog()}
+}
+
+// serve runs a request against the server and returns the recorded response
+func serve(s *VMServer, method, url string) *httptest.ResponseRecorder {
+	return serveRequest(s, httptest.NewRequest(method, url, nil))
+}
+
+// serveRequest runs r against the server and returns the recorded response
+func serveRequest(s *VMServer, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeVM(w, r)
+	return w
+}
+
+// decodeProblem parses a problem+json response or fails the test
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Fatalf("got Content-Type: %q, want: %q", ct, ProblemContentType)
+	}
+	var p Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("Failed to parse problem %q: %v", w.Body.String(), err)
+	}
+	return p
+}
+
+var problemCases = []struct {
+	method string
+	url    string
+	setup  func(c *Cloud) error
+	status int
+	code   ErrorCode
+	vmID   int
+}{
+	{method: http.MethodPut, url: "/vms/10000/launch",
+		status: http.StatusNotFound, code: VMNotFound, vmID: BadID},
+	{method: http.MethodPut, url: "/vms/10000/stop",
+		status: http.StatusNotFound, code: VMNotFound, vmID: BadID},
+	{method: http.MethodGet, url: "/vms/10000",
+		status: http.StatusNotFound, code: VMNotFound, vmID: BadID},
+	{method: http.MethodDelete, url: "/vms/10000",
+		status: http.StatusNotFound, code: VMNotFound, vmID: BadID},
+	{method: http.MethodPut, url: "/vms/1/stop",
+		status: http.StatusConflict, code: IllegalTransition, vmID: GoodID},
+	{method: http.MethodPut, url: "/vms/1/launch",
+		setup:  func(c *Cloud) error { return forceState(c, GoodID, RUNNING) },
+		status: http.StatusConflict, code: IllegalTransition, vmID: GoodID},
+	{method: http.MethodDelete, url: "/vms/1",
+		setup:  func(c *Cloud) error { return forceState(c, GoodID, RUNNING) },
+		status: http.StatusConflict, code: VMNotStopped, vmID: GoodID},
+}
+
+func TestProblems(t *testing.T) {
+	for _, tc := range problemCases {
+		s := NewDefaultServer()
+		if tc.setup != nil {
+			if err := tc.setup(&s.vmm); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := serve(s, tc.method, tc.url)
+		if w.Code != tc.status {
+			t.Fatalf("%s %s got status: %d, want: %d", tc.method, tc.url, w.Code, tc.status)
+		}
+		p := decodeProblem(t, w)
+		if p.Code != tc.code || p.Status != tc.status {
+			t.Fatalf("%s %s got: %+v, want code: %v", tc.method, tc.url, p, tc.code)
+		}
+		if p.VMID == nil || *p.VMID != tc.vmID {
+			t.Fatalf("%s %s got vm_id: %v, want: %d", tc.method, tc.url, p.VMID, tc.vmID)
+		}
+		if p.Instance != tc.url {
+			t.Fatalf("got instance: %q, want: %q", p.Instance, tc.url)
+		}
+	}
+}
+
+func TestMethodNotAllowedProblem(t *testing.T) {
+	w := serve(NewDefaultServer(), http.MethodPost, "/vms/1/launch")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if p := decodeProblem(t, w); p.Code != MethodNotAllowed || p.VMID != nil {
+		t.Fatalf("got: %+v, want code: %v without vm_id", p, MethodNotAllowed)
+	}
+}
+
+func TestV1KeepsPayloads(t *testing.T) {
+	s := NewDefaultServer()
+	for _, url := range []string{"/vms", "/v1/vms"} {
+		w := serve(s, http.MethodGet, url)
+		if got, want := w.Body.String(), defaultVMs.String(); got != want {
+			t.Fatalf("%s got: %s, want: %s", url, got, want)
+		}
+		if got := w.Header().Get("Deprecation"); got != "true" {
+			t.Fatalf("%s got Deprecation: %q, want: %q", url, got, "true")
+		}
+		if got, want := w.Header().Get("Link"), `</v2/vms>; rel="successor-version"`; got != want {
+			t.Fatalf("%s got Link: %q, want: %q", url, got, want)
+		}
+	}
+	w := serve(s, http.MethodGet, "/v1/projects/default/vms/1")
+	if got, want := w.Header().Get("Link"), `</v2/projects/default/vms/1>; rel="successor-version"`; got != want {
+		t.Fatalf("got Link: %q, want: %q", got, want)
+	}
+	w = serve(s, http.MethodGet, "/v1/vms/1")
+	if got, want := w.Body.String(), defaultVMs[GoodID].String(); got != want {
+		t.Fatalf("got: %s, want: %s", got, want)
+	}
+}
+
+// decodeEnvelope parses a v2 response into an Envelope with the given Data
+func decodeEnvelope(t *testing.T, w *httptest.ResponseRecorder, data interface{}) Envelope {
+	t.Helper()
+	envelope := Envelope{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("Failed to parse envelope %q: %v", w.Body.String(), err)
+	}
+	return envelope
+}
+
+func TestV2List(t *testing.T) {
+	s := NewDefaultServer()
+	w := serve(s, http.MethodGet, "/v2/vms?offset=1&limit=1")
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "" {
+		t.Fatalf("got status: %d, headers: %v", w.Code, w.Header())
+	}
+	var data []VMResource
+	envelope := decodeEnvelope(t, w, &data)
+	want := Page{Total: len(defaultVMs), Offset: 1, Limit: 1}
+	if *envelope.Meta != want {
+		t.Fatalf("got meta: %+v, want: %+v", *envelope.Meta, want)
+	}
+	if len(data) != 1 || data[0].ID != GoodID || data[0].VM != defaultVMs[GoodID] {
+		t.Fatalf("got data: %+v, want only VM %d", data, GoodID)
+	}
+	if got, want := envelope.Links["next"], "/v2/vms?offset=2&limit=1"; got != want {
+		t.Fatalf("got next: %q, want: %q", got, want)
+	}
+	if got, want := envelope.Links["prev"], "/v2/vms?offset=0&limit=1"; got != want {
+		t.Fatalf("got prev: %q, want: %q", got, want)
+	}
+}
+
+func TestV2BadPage(t *testing.T) {
+	w := serve(NewDefaultServer(), http.MethodGet, "/v2/vms?limit=0")
+	if p := decodeProblem(t, w); p.Code != BadRequest {
+		t.Fatalf("got: %+v, want code: %v", p, BadRequest)
+	}
+}
+
+func TestV2ByAcceptHeader(t *testing.T) {
+	for _, accept := range []string{"application/vnd.test-vmbackend.v2+json", "application/json; version=2"} {
+		r := httptest.NewRequest(http.MethodGet, "/vms/1", nil)
+		r.Header.Set("Accept", accept)
+		w := serveRequest(NewDefaultServer(), r)
+		var vm VMResource
+		envelope := decodeEnvelope(t, w, &vm)
+		if vm.ID != GoodID || vm.VM != defaultVMs[GoodID] || envelope.Links["self"] != "/v2/vms/1" {
+			t.Fatalf("Accept: %q got: %+v", accept, envelope)
+		}
+		if got := w.Header().Get("Vary"); got != "Accept" {
+			t.Fatalf("got Vary: %q, want: Accept", got)
+		}
+	}
+}
+
+func TestVaryAccept(t *testing.T) {
+	shrinkTime()
+	for url, want := range map[string]string{"/vms/1/launch": "Accept", "/vms/10000/launch": "Accept", "/v1/vms/1/launch": "", "/v2/vms/1/launch": ""} {
+		if got := serve(NewDefaultServer(), http.MethodPut, url).Header().Get("Vary"); got != want {
+			t.Errorf("%s got Vary: %q, want: %q", url, got, want)
+		}
+	}
+}
+
+func TestV2Actions(t *testing.T) {
+	shrinkTime()
+	s := NewDefaultServer()
+	w := serve(s, http.MethodPut, "/v2/vms/1/launch")
+	var vm VMResource
+	decodeEnvelope(t, w, &vm)
+	if w.Code != http.StatusAccepted || vm.State != STARTING {
+		t.Fatalf("got status: %d, VM: %+v", w.Code, vm)
+	}
+	if w := serve(s, http.MethodDelete, "/v2/vms/2"); w.Code != http.StatusNoContent {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	w := serve(NewDefaultServer(), http.MethodGet, "/v3/vms")
+	if p := decodeProblem(t, w); p.Code != UnsupportedAPIVersion || p.Instance != "/v3/vms" {
+		t.Fatalf("got: %+v, want code: %v", p, UnsupportedAPIVersion)
+	}
+}
+
+var halLinksCases = []struct {
+	state VMState
+	want  string
+}{
+	{state: STOPPED, want: `{"delete":{"href":"/v2/vms/1","method":"DELETE"},` +
+		`"launch":{"href":"/v2/vms/1/launch","method":"PUT"},"resize":{"href":"/v2/vms/1/resize","method":"PUT"},` +
+		`"self":{"href":"/v2/vms/1"}}`},
+	{state: RUNNING, want: `{"reboot":{"href":"/v2/vms/1/reboot","method":"PUT"},` +
+		`"self":{"href":"/v2/vms/1"},"stop":{"href":"/v2/vms/1/stop","method":"PUT"}}`},
+	{state: STARTING, want: `{"self":{"href":"/v2/vms/1"}}`},
+}
+
+func TestHALLinks(t *testing.T) {
+	for _, tc := range halLinksCases {
+		s := NewDefaultServer()
+		forceState(&s.vmm, GoodID, tc.state)
+		var vm VMResource
+		decodeEnvelope(t, serve(s, http.MethodGet, "/v2/vms/1"), &vm)
+		if got := toJSON(t, vm.Links); got != tc.want {
+			t.Fatalf("%v got: %s, want: %s", tc.state, got, tc.want)
+		}
+	}
+	var vms []VMResource
+	decodeEnvelope(t, serve(NewDefaultServer(), http.MethodGet, "/v2/vms"), &vms)
+	for _, vm := range vms {
+		if vm.Links["launch"].Href != fmt.Sprintf("/v2/vms/%d/launch", vm.ID) {
+			t.Fatalf("got: %+v, want launch link", vm.Links)
+		}
+	}
+	s := NewDefaultServer()
+	volume, err := s.vmm.CreateVolume(Volume{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.vmm.AttachVolume(volume.ID, GoodID); err != nil {
+		t.Fatal(err)
+	}
+	var vm VMResource
+	decodeEnvelope(t, serve(s, http.MethodGet, "/v2/vms/1"), &vm)
+	if got, want := vm.Links["delete"].Href, "/v2/vms/1?force=true"; got != want {
+		t.Fatalf("got delete link: %q, want: %q with a volume attached", got, want)
+	}
+	if w := serve(s, http.MethodDelete, vm.Links["delete"].Href); w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+		t.Fatalf("got status: %d following the delete link", w.Code)
+	}
+	if body := serve(NewDefaultServer(), http.MethodGet, "/v1/vms/1").Body.String(); strings.Contains(body, "_links") {
+		t.Fatalf("got: %s, want v1 without links", body)
+	}
+}
+
+func TestCreateVM(t *testing.T) {
+	s := NewDefaultServer()
+	r := httptest.NewRequest(http.MethodPost, "/vms", strings.NewReader(`{"vcpus":2,"clock":2000,"ram":2048,"storage":20,"network":1000}`))
+	w := serveRequest(s, r)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/v1/vms/3" {
+		t.Fatalf("got status: %d, Location: %q", w.Code, w.Header().Get("Location"))
+	}
+	want := `{"id":3,"vcpus":2,"clock":2000,"ram":2048,"storage":20,"network":1000,"state":"Stopped"}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Fatalf("got: %s, want: %s", got, want)
+	}
+	var created VMResource
+	decodeEnvelope(t, serve(s, http.MethodGet, "/v2/vms/3"), &created)
+	if created.CreatedAt == nil || created.UpdatedAt == nil || created.LastStateChangeAt == nil {
+		t.Fatalf("got: %+v, want a v2 VM with timestamps", created)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/vms", strings.NewReader(`{"vcpus":2}`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != InvalidVM {
+		t.Fatalf("got: %+v, want code: %v", p, InvalidVM)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/vms", strings.NewReader(`{"vcpus":`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != BadRequest {
+		t.Fatalf("got: %+v, want code: %v", p, BadRequest)
+	}
+}
+
+func TestPatchVM(t *testing.T) {
+	s := NewDefaultServer()
+	patch := func(body string) *httptest.ResponseRecorder {
+		return serveRequest(s, httptest.NewRequest(http.MethodPatch, "/v2/vms/1", strings.NewReader(body)))
+	}
+	var vm VMResource
+	decodeEnvelope(t, patch(`{"protected":true}`), &vm)
+	if !vm.Protected {
+		t.Fatalf("got VM: %+v, want it protected", vm)
+	}
+	if _, found := vm.Links["delete"]; found {
+		t.Errorf("got links: %v, want no delete link on a protected VM", vm.Links)
+	}
+	want := `{"vcpus":4,"clock":3600,"ram":32768,"storage":512,"network":10000,"state":"Stopped"}`
+	if got := serve(s, http.MethodGet, "/v1/vms/1").Body.String(); got != want {
+		t.Errorf("got: %s, want v1 without v2 only fields: %s", got, want)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodDelete, "/vms/1")); p.Code != VMProtected || p.Status != http.StatusConflict {
+		t.Fatalf("got: %+v, want code: %v", p, VMProtected)
+	}
+	for _, body := range []string{`{"vcpus":8}`, `{}`, `{"protected":`} {
+		if p := decodeProblem(t, patch(body)); p.Code != BadRequest {
+			t.Errorf("%s got: %+v, want code: %v", body, p, BadRequest)
+		}
+	}
+	decodeEnvelope(t, patch(`{"protected":false}`), &vm)
+	if w := serve(s, http.MethodDelete, "/vms/1"); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestResizeVM(t *testing.T) {
+	s := NewDefaultServer()
+	r := httptest.NewRequest(http.MethodPut, "/v2/vms/1/resize", strings.NewReader(`{"vcpus":8,"ram":65536}`))
+	var vm VMResource
+	decodeEnvelope(t, serveRequest(s, r), &vm)
+	if vm.VCPUS != 8 || vm.RAM != 65536 || vm.Storage != defaultVMs[1].Storage {
+		t.Fatalf("got VM: %+v", vm)
+	}
+	forceState(&s.vmm, GoodID, RUNNING)
+	r = httptest.NewRequest(http.MethodPut, "/vms/1/resize", strings.NewReader(`{"vcpus":1}`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != VMNotStopped {
+		t.Fatalf("got: %+v, want code: %v", p, VMNotStopped)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests are waited for on
+// shutdown, below the 10s docker stop waits before killing
+const DefaultShutdownTimeout = 5 * time.Second
+
+// Shutdown stops srv gracefully: pending VM transitions are run right away,
+// event streams are completed and in-flight requests are drained up to
+// timeout, then save is called (if not nil) for a final snapshot.
+func (s *VMServer) Shutdown(srv *http.Server, timeout time.Duration, save func() error) error {
+	start := time.Now()
+	resolved := s.vmm.ResolveTransitions() // so streams get the final states
+	streams := s.vmm.CloseSubscriptions()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	drainErr := srv.Shutdown(ctx)
+	resolved += s.vmm.ResolveTransitions() // started by the drained requests
+
+	summary := []string{
+		fmt.Sprintf("%d pending transitions resolved", resolved),
+		fmt.Sprintf("%d event streams completed", streams),
+	}
+	if drainErr != nil {
+		summary = append(summary, fmt.Sprintf("requests not drained: %v", drainErr))
+	}
+	var saveErr error
+	if save != nil {
+		if saveErr = save(); saveErr == nil {
+			summary = append(summary, fmt.Sprintf("state saved to %q", VMsJSON))
+		}
+	}
+	log.Printf("Shutdown in %v: %s", time.Since(start).Round(time.Millisecond), strings.Join(summary, ", "))
+	return saveErr
+}
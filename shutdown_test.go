@@ -0,0 +1,88 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowTime sets up delays no test would wait for, returning a function to
+// restore them
+func slowTime() func() {
+	start, stop, snapshot, attach, detach := StartDelay, StopDelay, SnapshotDelay, AttachDelay, DetachDelay
+	StartDelay, StopDelay, SnapshotDelay, AttachDelay, DetachDelay = time.Hour, time.Hour, time.Hour, time.Hour, time.Hour
+	return func() {
+		StartDelay, StopDelay, SnapshotDelay, AttachDelay, DetachDelay = start, stop, snapshot, attach, detach
+	}
+}
+
+func TestResolveTransitions(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	forceState(&c, GoodID, RUNNING)
+	launched, err := c.Launch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebooted, err := c.Reboot(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved := c.ResolveTransitions(); resolved != 3 { // launch, stop & launch again
+		t.Fatalf("got %d transitions resolved, want: 3", resolved)
+	}
+	for _, done := range []chan struct{}{launched, rebooted} {
+		if err := waitDone(done, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []int{0, GoodID} {
+		if vm, _ := c.Inspect(id); vm.State != RUNNING {
+			t.Fatalf("got VM %d %v, want: %v", id, vm.State, RUNNING)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer slowTime()()
+	s := NewDefaultServer()
+	ts := httptest.NewServer(http.HandlerFunc(s.ServeVM))
+	defer ts.Close()
+
+	body := `{"query":"subscription { vmEvents(id: 1) { vm { state } } }"}`
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/graphql", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if _, err := s.vmm.Launch(GoodID); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := false
+	err = s.Shutdown(ts.Config, time.Second, func() error {
+		saved = true
+		return nil
+	})
+	if err != nil || !saved {
+		t.Fatalf("got error: %v, saved: %v", err, saved)
+	}
+	stream, err := ioutil.ReadAll(resp.Body) // ends with the stream
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stream), `"RUNNING"`) || !strings.HasSuffix(string(stream), "event: complete\ndata:\n\n") {
+		t.Fatalf("got stream: %q, want the VM running then complete", stream)
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotState represents the current state of a snapshot
+type SnapshotState string
+
+const (
+	// SnapshotCreating snapshot is being taken, in about 5 seconds
+	SnapshotCreating SnapshotState = "Creating"
+
+	// SnapshotAvailable snapshot can be restored or deleted
+	SnapshotAvailable SnapshotState = "Available"
+)
+
+// DefaultSnapshotDelay Create snapshot process simulated delay
+const DefaultSnapshotDelay = 5 * time.Second
+
+// SnapshotDelay for snapshot creations (not a constant so unit test can change it)
+var SnapshotDelay = DefaultSnapshotDelay
+
+// Snapshot is a point in time copy of the disk of a VM
+type Snapshot struct {
+	ID        int           `json:"id"`
+	VMID      int           `json:"vm_id"`
+	Name      string        `json:"name,omitempty"`
+	Storage   int           `json:"storage"` // Size of the VM disk copied, in GB (Gigabytes)
+	State     SnapshotState `json:"state"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// LoadSnapshots sets the snapshots of the VMs & the last snapshot id given,
+// as saved in the state
+func (c *Cloud) LoadSnapshots(snapshots []Snapshot, lastID int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.snapshots = make(map[int]Snapshot, len(snapshots))
+	c.lastSnapshotID = lastID
+	for _, snapshot := range snapshots {
+		c.snapshots[snapshot.ID] = snapshot
+		if snapshot.ID > c.lastSnapshotID { // saved before the last id was
+			c.lastSnapshotID = snapshot.ID
+		}
+	}
+}
+
+// snapshotsLocked returns the snapshots of VM id, all of them for NoVMID,
+// sorted by id. The caller must hold the lock.
+func (c *Cloud) snapshotsLocked(id int) []Snapshot {
+	snapshots := []Snapshot{}
+	for _, snapshot := range c.snapshots {
+		if id == NoVMID || snapshot.VMID == id {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+	return snapshots
+}
+
+// snapshotLocked returns snapshot snapshotID of VM id, or a CloudError if
+// either is missing. The caller must hold the lock.
+func (c *Cloud) snapshotLocked(id, snapshotID int) (Snapshot, error) {
+	if _, found := c.store.Get(id); !found {
+		return Snapshot{}, c.notFoundLocked(id, "not found VM %d", id)
+	}
+	snapshot, found := c.snapshots[snapshotID]
+	if !found || snapshot.VMID != id {
+		return Snapshot{}, cloudErrorf(SnapshotNotFound, id, "not found snapshot %d of VM %d", snapshotID, id)
+	}
+	return snapshot, nil
+}
+
+// CreateSnapshot of the disk of VM id, getting Available after a delay.
+// The return includes a channel to optionally check completion of the
+// snapshot, apart from a possible CloudError if the VM is missing.
+func (c *Cloud) CreateSnapshot(id int, name string) (Snapshot, chan struct{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	vm, found := c.store.Get(id)
+	if !found {
+		return Snapshot{}, nil, c.notFoundLocked(id, "snapshot error: not found VM %d", id)
+	}
+	c.lastSnapshotID++
+	snapshot := Snapshot{ID: c.lastSnapshotID, VMID: id, Name: name, Storage: vm.Storage, State: SnapshotCreating, CreatedAt: time.Now()}
+	if c.snapshots == nil {
+		c.snapshots = make(map[int]Snapshot)
+	}
+	c.snapshots[snapshot.ID] = snapshot
+	c.changed()
+	return snapshot, c.snapshotTransition(snapshot.ID), nil
+}
+
+// snapshotTransition makes snapshot snapshotID Available after the
+// snapshot delay, unless deleted meanwhile
+func (c *Cloud) snapshotTransition(snapshotID int) chan struct{} {
+	return c.schedule(&pendingTransition{id: snapshotID, delay: SnapshotDelay}, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		snapshot, found := c.snapshots[snapshotID]
+		if !found || snapshot.State != SnapshotCreating {
+			log.Printf("snapshot error: snapshot %d is no longer %v", snapshotID, SnapshotCreating)
+			return
+		}
+		snapshot.State = SnapshotAvailable
+		c.snapshots[snapshotID] = snapshot
+		c.changed()
+	})
+}
+
+// Snapshots returns the snapshots of VM id, or a CloudError if it is missing
+func (c *Cloud) Snapshots(id int) ([]Snapshot, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if _, found := c.store.Get(id); !found {
+		return nil, c.notFoundLocked(id, "not found VM %d", id)
+	}
+	return c.snapshotsLocked(id), nil
+}
+
+// InspectSnapshot returns snapshot snapshotID of VM id, or a CloudError if
+// either is missing
+func (c *Cloud) InspectSnapshot(id, snapshotID int) (Snapshot, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.snapshotLocked(id, snapshotID)
+}
+
+// DeleteSnapshot snapshotID of VM id.
+// A CloudError is returned if either is missing or the snapshot is not
+// Available yet.
+func (c *Cloud) DeleteSnapshot(id, snapshotID int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	snapshot, err := c.snapshotLocked(id, snapshotID)
+	if err != nil {
+		return err
+	}
+	if snapshot.State != SnapshotAvailable {
+		return cloudErrorf(SnapshotNotAvailable, id,
+			"delete error: snapshot %d must be %v for deletion but it is %v", snapshotID, SnapshotAvailable, snapshot.State)
+	}
+	delete(c.snapshots, snapshotID)
+	c.changed()
+	return nil
+}
+
+// RestoreSnapshot restores the disk of the Stopped VM id from its
+// snapshot snapshotID. Returns the restored VM, or a CloudError if either
+// is missing, the VM is not Stopped, the snapshot not Available or the
+// project quota is exceeded.
+func (c *Cloud) RestoreSnapshot(id, snapshotID int) (VM, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	snapshot, err := c.snapshotLocked(id, snapshotID)
+	if err != nil {
+		return VM{}, err
+	}
+	vm, _ := c.store.Get(id)
+	if vm.State != STOPPED {
+		return VM{}, cloudErrorf(VMNotStopped, id,
+			"restore error: VM %d must be in state %v for restoring but it is %v", id, STOPPED, vm.State)
+	}
+	if snapshot.State != SnapshotAvailable {
+		return VM{}, cloudErrorf(SnapshotNotAvailable, id,
+			"restore error: snapshot %d must be %v for restoring but it is %v", snapshotID, SnapshotAvailable, snapshot.State)
+	}
+	if err := c.checkQuotaLocked(vm.ProjectID(), id, Usage{Storage: snapshot.Storage - vm.Storage}); err != nil {
+		return VM{}, err
+	}
+	now := time.Now()
+	vm.Storage, vm.UpdatedAt = snapshot.Storage, &now
+	if err := c.store.Put(id, vm); err != nil {
+		return VM{}, err
+	}
+	c.notify(VMSnapshotRestored, id, vm)
+	return vm, nil
+}
+
+// deleteSnapshotsLocked deletes the snapshots of VM id, once purged.
+// The caller must hold the lock.
+func (c *Cloud) deleteSnapshotsLocked(id int) {
+	for _, snapshot := range c.snapshotsLocked(id) {
+		delete(c.snapshots, snapshot.ID)
+	}
+}
+
+// resumeSnapshotsLocked resumes the creation of the snapshots Creating when
+// the state was saved. The caller must hold the lock.
+func (c *Cloud) resumeSnapshotsLocked() {
+	for _, snapshot := range c.snapshotsLocked(NoVMID) {
+		if snapshot.State == SnapshotCreating {
+			c.snapshotTransition(snapshot.ID)
+			log.Printf("Resuming snapshot %d creation of VM %d", snapshot.ID, snapshot.VMID)
+		}
+	}
+}
+
+// pathIDAt reads the id at the given position of the path, like a snapshot
+// or volume id
+func pathIDAt(r *http.Request, pos int) (int, error) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) <= pos {
+		return 0, fmt.Errorf("missing id in %q", r.URL.Path)
+	}
+	return strconv.Atoi(path.Base(pathParts[pos]))
+}
+
+// snapshotV2 wraps the snapshot of VM id in a v2 envelope
+func snapshotV2(r *http.Request, id int, snapshot Snapshot) Envelope {
+	return Envelope{Data: snapshot, Links: map[string]string{
+		"self": versionedPath(r, fmt.Sprintf("/vms/%d/snapshots/%d", id, snapshot.ID)),
+		"vm":   versionedPath(r, fmt.Sprintf("/vms/%d", id)),
+	}}
+}
+
+func (s *VMServer) createSnapshot(id int, w http.ResponseWriter, r *http.Request) {
+	var spec struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON snapshot: %v", err)))
+			return
+		}
+	}
+	snapshot, _, err := s.vmm.CreateSnapshot(id, spec.Name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", versionedPath(r, fmt.Sprintf("/vms/%d/snapshots/%d", id, snapshot.ID)))
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusAccepted, snapshot)
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, snapshotV2(r, id, snapshot))
+}
+
+func (s *VMServer) listSnapshots(id int, w http.ResponseWriter, r *http.Request) {
+	snapshots, err := s.vmm.Snapshots(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, snapshots)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: snapshots, Links: map[string]string{
+		"self": versionedPath(r, fmt.Sprintf("/vms/%d/snapshots", id)),
+		"vm":   versionedPath(r, fmt.Sprintf("/vms/%d", id)),
+	}})
+}
+
+func (s *VMServer) inspectSnapshot(id int, w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := pathIDAt(r, 4)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	snapshot, err := s.vmm.InspectSnapshot(id, snapshotID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, snapshot)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, snapshotV2(r, id, snapshot))
+}
+
+func (s *VMServer) deleteSnapshot(id int, w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := pathIDAt(r, 4)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	if err := s.vmm.DeleteSnapshot(id, snapshotID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) != V1 {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *VMServer) restoreSnapshot(id int, w http.ResponseWriter, r *http.Request) {
+	var spec struct {
+		SnapshotID *int `json:"snapshot_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON restore: %v", err)))
+		return
+	}
+	if spec.SnapshotID == nil {
+		writeProblem(w, r, NewProblem(BadRequest, `missing snapshot_id, want {"snapshot_id": id}`))
+		return
+	}
+	vm, err := s.vmm.RestoreSnapshot(id, *spec.SnapshotID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vm.v1())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.vmV2(r, id, vm))
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// codeOf returns the code of a CloudError, or fails the test
+func codeOf(t *testing.T, err error) ErrorCode {
+	t.Helper()
+	var cerr *CloudError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("got: %v, want a CloudError", err)
+	}
+	return cerr.Code
+}
+
+func TestSnapshots(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	snapshot, done, err := c.CreateSnapshot(GoodID, "before resize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.State != SnapshotCreating || snapshot.Storage != defaultVMs[GoodID].Storage {
+		t.Fatalf("got: %+v, want a %v snapshot of VM %d", snapshot, SnapshotCreating, GoodID)
+	}
+	if _, err := c.RestoreSnapshot(GoodID, snapshot.ID); codeOf(t, err) != SnapshotNotAvailable {
+		t.Errorf("got: %v, want: %v", err, SnapshotNotAvailable)
+	}
+	if err := c.DeleteSnapshot(GoodID, snapshot.ID); codeOf(t, err) != SnapshotNotAvailable {
+		t.Errorf("got: %v, want: %v", err, SnapshotNotAvailable)
+	}
+	if got := c.ResolveTransitions(); got != 1 {
+		t.Fatalf("got %d transitions resolved, want 1", got)
+	}
+	if err := waitDone(done, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.InspectSnapshot(GoodID, snapshot.ID); got.State != SnapshotAvailable {
+		t.Fatalf("got: %+v, want it %v", got, SnapshotAvailable)
+	}
+
+	if err := c.Resize(GoodID, VM{Storage: 2048}); err != nil {
+		t.Fatal(err)
+	}
+	forceState(&c, GoodID, RUNNING)
+	if _, err := c.RestoreSnapshot(GoodID, snapshot.ID); codeOf(t, err) != VMNotStopped {
+		t.Errorf("got: %v, want: %v", err, VMNotStopped)
+	}
+	forceState(&c, GoodID, STOPPED)
+	vm, err := c.RestoreSnapshot(GoodID, snapshot.ID)
+	if err != nil || vm.Storage != defaultVMs[GoodID].Storage {
+		t.Fatalf("got: %v %v, want VM %d with storage %d", vm, err, GoodID, defaultVMs[GoodID].Storage)
+	}
+
+	if _, err := c.InspectSnapshot(0, snapshot.ID); codeOf(t, err) != SnapshotNotFound {
+		t.Errorf("got: %v, want: %v", err, SnapshotNotFound)
+	}
+	if _, err := c.Snapshots(BadID); codeOf(t, err) != VMNotFound {
+		t.Errorf("got: %v, want: %v", err, VMNotFound)
+	}
+	if err := c.DeleteSnapshot(GoodID, snapshot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, _ := c.Snapshots(GoodID); len(snapshots) != 0 {
+		t.Errorf("got: %v, want no snapshots", snapshots)
+	}
+}
+
+func TestResumeSnapshots(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	c.CreateSnapshot(GoodID, "")
+	c.CreateSnapshot(0, "")
+	state := c.State()
+	if len(state.Snapshots) != 2 || state.Snapshots[0].ID != 1 || state.Snapshots[1].ID != 2 {
+		t.Fatalf("got: %+v, want the 2 snapshots by id", state.Snapshots)
+	}
+
+	resumed := NewDefaultCloud()
+	resumed.LoadSnapshots(state.Snapshots, state.LastSnapshotID)
+	resumed.Resume()
+	if got := resumed.ResolveTransitions(); got != 2 {
+		t.Fatalf("got %d transitions resolved, want 2", got)
+	}
+	if got, _ := resumed.InspectSnapshot(0, 2); got.State != SnapshotAvailable {
+		t.Errorf("got: %+v, want it %v", got, SnapshotAvailable)
+	}
+	c.ResolveTransitions()
+}
+
+func TestSnapshotIDs(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	c.CreateSnapshot(GoodID, "")
+	c.ResolveTransitions()
+	if err := c.DeleteSnapshot(GoodID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot, _, _ := c.CreateSnapshot(GoodID, ""); snapshot.ID != 2 {
+		t.Fatalf("got id: %d, want the deleted id 1 not reused", snapshot.ID)
+	}
+	c.ResolveTransitions()
+	c.DeleteSnapshot(GoodID, 2)
+
+	state := c.State()
+	if state.LastSnapshotID != 2 {
+		t.Fatalf("got last id: %d, want: 2", state.LastSnapshotID)
+	}
+	resumed := NewDefaultCloud()
+	resumed.LoadSnapshots(state.Snapshots, state.LastSnapshotID)
+	if snapshot, _, _ := resumed.CreateSnapshot(GoodID, ""); snapshot.ID != 3 {
+		t.Errorf("got id: %d, want: 3 after the saved last id", snapshot.ID)
+	}
+	resumed.ResolveTransitions()
+}
+
+func TestSnapshotsAPI(t *testing.T) {
+	defer slowTime()()
+	s := NewDefaultServer()
+	r := httptest.NewRequest(http.MethodPost, "/v2/vms/1/snapshots", strings.NewReader(`{"name":"daily"}`))
+	w := serveRequest(s, r)
+	if w.Code != http.StatusAccepted || w.Header().Get("Location") != "/v2/vms/1/snapshots/1" {
+		t.Fatalf("got status: %d, Location: %q", w.Code, w.Header().Get("Location"))
+	}
+	var snapshot Snapshot
+	decodeEnvelope(t, w, &snapshot)
+	if snapshot.Name != "daily" || snapshot.State != SnapshotCreating {
+		t.Errorf("got: %+v, want the daily snapshot %v", snapshot, SnapshotCreating)
+	}
+	if w := serve(s, http.MethodPost, "/vms/1/snapshots"); w.Code != http.StatusAccepted {
+		t.Errorf("got status: %d, want: %d without body", w.Code, http.StatusAccepted)
+	}
+	s.vmm.ResolveTransitions()
+
+	var snapshots []Snapshot
+	decodeEnvelope(t, serve(s, http.MethodGet, "/v2/vms/1/snapshots"), &snapshots)
+	if len(snapshots) != 2 || snapshots[0].State != SnapshotAvailable {
+		t.Fatalf("got: %+v, want 2 snapshots %v", snapshots, SnapshotAvailable)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodGet, "/vms/0/snapshots/1")); p.Code != SnapshotNotFound {
+		t.Errorf("got: %v, want: %v", p.Code, SnapshotNotFound)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/vms/1/restore", strings.NewReader(`{"snapshot_id":1}`))
+	if w := serveRequest(s, r); w.Code != http.StatusOK {
+		t.Errorf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/vms/1/restore", strings.NewReader(`{}`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != BadRequest {
+		t.Errorf("got: %v, want: %v", p.Code, BadRequest)
+	}
+	if w := serve(s, http.MethodDelete, "/v2/vms/1/snapshots/2"); w.Code != http.StatusNoContent {
+		t.Errorf("got status: %d, want: %d", w.Code, http.StatusNoContent)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodGet, "/vms/1/snapshots/2")); p.Code != SnapshotNotFound {
+		t.Errorf("got: %v, want: %v", p.Code, SnapshotNotFound)
+	}
+}
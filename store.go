@@ -0,0 +1,291 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// Store keeps the VMs of a Cloud by id, safe for concurrent use.
+// Every implementation serves reads from memory, while writes might fail
+// to be persisted.
+type Store interface {
+	Get(id int) (VM, bool)
+	List() VMs
+	Put(id int, vm VM) error
+	Delete(id int) error
+	// CompareAndSwap replaces VM id by new only if it is still old,
+	// telling whether it did
+	CompareAndSwap(id int, old, new VM) (bool, error)
+	// Watch notifies the writes on the store, as VMStored & VMDeleted events
+	Watch() (<-chan VMEvent, func())
+	Close() error
+}
+
+// VMStored a VM was put on a Store, see Store.Watch
+const VMStored VMEventType = "stored"
+
+// Store kinds for the -store flag
+const (
+	MemoryStoreKind = "memory"
+	FileStoreKind   = "file"
+	LogStoreKind    = "log"
+)
+
+// Default files of the stores, next to VMsJSON
+const (
+	StoreJSON = "vms-store.json"
+	StoreLog  = "vms.log"
+)
+
+// OpenStore opens a store of the given kind on filename (the kind default
+// if empty), starting with the seed VMs if the file does not exist yet
+func OpenStore(kind, filename string, seed VMs) (Store, error) {
+	switch kind {
+	case MemoryStoreKind:
+		return NewMemoryStore(seed.clone()), nil
+	case FileStoreKind:
+		if filename == "" {
+			filename = StoreJSON
+		}
+		return OpenFileStore(filename, seed)
+	case LogStoreKind:
+		if filename == "" {
+			filename = StoreLog
+		}
+		return OpenLogStore(filename, seed)
+	}
+	return nil, fmt.Errorf("unknown store %q, use %s, %s or %s", kind, MemoryStoreKind, FileStoreKind, LogStoreKind)
+}
+
+// storeOp is a write on a Store, as appended to logs
+type storeOp struct {
+	Op string `json:"op"` // put or delete
+	ID int    `json:"id"`
+	VM *VM    `json:"vm,omitempty"`
+}
+
+// MemoryStore keeps VMs in memory, the base of the other stores
+type MemoryStore struct {
+	lock    sync.RWMutex
+	vms     VMs
+	events  broadcaster
+	persist func(op storeOp, vms VMs) error // nil for memory only
+}
+
+// NewMemoryStore returns a store holding the given VMs
+func NewMemoryStore(vms VMs) *MemoryStore {
+	if vms == nil {
+		vms = make(VMs)
+	}
+	return &MemoryStore{vms: vms}
+}
+
+// Get a VM by id
+func (s *MemoryStore) Get(id int) (VM, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	vm, found := s.vms[id]
+	return vm, found
+}
+
+// List all the VMs
+func (s *MemoryStore) List() VMs {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.vms.clone()
+}
+
+// Put a VM by id, adding or replacing it
+func (s *MemoryStore) Put(id int, vm VM) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.applyLocked(storeOp{Op: "put", ID: id, VM: &vm})
+}
+
+// Delete a VM by id, missing ones are ignored
+func (s *MemoryStore) Delete(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.vms[id]; !found {
+		return nil
+	}
+	return s.applyLocked(storeOp{Op: "delete", ID: id})
+}
+
+// CompareAndSwap replaces VM id by new only if it is still old
+func (s *MemoryStore) CompareAndSwap(id int, old, new VM) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if current, found := s.vms[id]; !found || current != old {
+		return false, nil
+	}
+	return true, s.applyLocked(storeOp{Op: "put", ID: id, VM: &new})
+}
+
+// Watch the writes on the store
+func (s *MemoryStore) Watch() (<-chan VMEvent, func()) {
+	return s.events.subscribe()
+}
+
+// Close ends the watches
+func (s *MemoryStore) Close() error {
+	s.events.close()
+	return nil
+}
+
+// applyLocked applies the write & persists it, undoing it if persisting
+// fails, the caller must hold the lock
+func (s *MemoryStore) applyLocked(op storeOp) error {
+	previous, found := s.vms[op.ID]
+	if op.VM != nil {
+		s.vms[op.ID] = *op.VM
+	} else {
+		delete(s.vms, op.ID)
+	}
+	if s.persist != nil {
+		if err := s.persist(op, s.vms); err != nil {
+			if found {
+				s.vms[op.ID] = previous
+			} else {
+				delete(s.vms, op.ID)
+			}
+			return err
+		}
+	}
+	event := VMEvent{Type: VMStored, ID: op.ID}
+	if op.VM == nil {
+		event.Type, event.VM = VMDeleted, previous
+	} else {
+		event.VM = *op.VM
+	}
+	s.events.publish(event)
+	return nil
+}
+
+// OpenFileStore returns a store rewriting all its VMs as JSON to filename
+// on every write, starting with the seed VMs if the file does not exist
+func OpenFileStore(filename string, seed VMs) (Store, error) {
+	s := NewMemoryStore(nil)
+	data, err := ioutil.ReadFile(filename)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.vms = seed.clone()
+		if err := saveVMs(filename, s.vms); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("error reading store %q: %v", filename, err)
+	default:
+		if err := json.Unmarshal(data, &s.vms); err != nil {
+			return nil, fmt.Errorf("error JSON-parsing store %q: %v", filename, err)
+		}
+	}
+	s.persist = func(op storeOp, vms VMs) error {
+		return saveVMs(filename, vms)
+	}
+	return s, nil
+}
+
+func saveVMs(filename string, vms VMs) error {
+	if err := writeFileAtomic(filename, []byte(vms.String()), 0644); err != nil {
+		return fmt.Errorf("error saving store %q: %v", filename, err)
+	}
+	return nil
+}
+
+// LogStore appends every write to a log file, replayed on open
+type LogStore struct {
+	*MemoryStore
+	file *os.File
+}
+
+// OpenLogStore returns a store appending its writes as JSON lines to
+// filename. The log is replayed & compacted on open, and starts with the
+// seed VMs if it does not exist.
+func OpenLogStore(filename string, seed VMs) (Store, error) {
+	s := &LogStore{MemoryStore: NewMemoryStore(nil)}
+	data, err := ioutil.ReadFile(filename)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		s.vms = seed.clone()
+	case err != nil:
+		return nil, fmt.Errorf("error reading store %q: %v", filename, err)
+	default:
+		s.replay(filename, data)
+	}
+	if err := s.compact(filename); err != nil {
+		return nil, err
+	}
+	s.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening store %q: %v", filename, err)
+	}
+	s.persist = s.append
+	return s, nil
+}
+
+// replay applies the writes of the log data, skipping the broken ones
+// (like the last line of a crash)
+func (s *LogStore) replay(filename string, data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		var op storeOp
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil || (op.Op == "put") != (op.VM != nil) {
+			log.Printf("Skipping broken line %d of store %q", line, filename)
+			continue
+		}
+		if op.VM != nil {
+			s.vms[op.ID] = *op.VM
+		} else {
+			delete(s.vms, op.ID)
+		}
+	}
+}
+
+// compact rewrites the log with just a put per VM
+func (s *LogStore) compact(filename string) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for id, vm := range s.vms {
+		vm := vm
+		if err := encoder.Encode(storeOp{Op: "put", ID: id, VM: &vm}); err != nil {
+			return fmt.Errorf("error compacting store %q: %v", filename, err)
+		}
+	}
+	if err := writeFileAtomic(filename, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error compacting store %q: %v", filename, err)
+	}
+	return nil
+}
+
+func (s *LogStore) append(op storeOp, vms VMs) error {
+	line, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error appending to store %q: %v", s.file.Name(), err)
+	}
+	return nil
+}
+
+// Close the log file
+func (s *LogStore) Close() error {
+	s.MemoryStore.Close()
+	return s.file.Close()
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openStores opens every kind of store in dir with the default VMs
+func openStores(t *testing.T, dir string) map[string]Store {
+	stores := make(map[string]Store)
+	for _, kind := range []string{MemoryStoreKind, FileStoreKind, LogStoreKind} {
+		store, err := OpenStore(kind, filepath.Join(dir, kind), defaultVMs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[kind] = store
+	}
+	return stores
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for kind, store := range openStores(t, dir) {
+		events, cancel := store.Watch()
+		if got := store.List(); !reflect.DeepEqual(got, defaultVMs) {
+			t.Errorf("%s: got: %v, want: %v", kind, got, defaultVMs)
+		}
+
+		vm := VM{VCPUS: 1, Clock: 1000, RAM: 1024, Storage: 10, Network: 100, State: STOPPED}
+		if err := store.Put(3, vm); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if got, found := store.Get(3); !found || got != vm {
+			t.Errorf("%s: got: %v %v, want: %v", kind, got, found, vm)
+		}
+		if event := <-events; event.Type != VMStored || event.ID != 3 || event.VM != vm {
+			t.Errorf("%s: got event: %v, want VM 3 stored", kind, event)
+		}
+
+		started, _ := vm.WithState(STARTING)
+		if swapped, err := store.CompareAndSwap(3, started, vm); err != nil || swapped {
+			t.Errorf("%s: got: %v %v, want no swap of a stale VM", kind, swapped, err)
+		}
+		if swapped, err := store.CompareAndSwap(3, vm, started); err != nil || !swapped {
+			t.Errorf("%s: got: %v %v, want a swap", kind, swapped, err)
+		}
+		<-events
+
+		if err := store.Delete(0); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if _, found := store.Get(0); found {
+			t.Errorf("%s: got VM 0, want it deleted", kind)
+		}
+		if event := <-events; event.Type != VMDeleted || event.ID != 0 {
+			t.Errorf("%s: got event: %v, want VM 0 deleted", kind, event)
+		}
+		if err := store.Delete(0); err != nil {
+			t.Errorf("%s: got: %v, want deleting a missing VM ignored", kind, err)
+		}
+		cancel()
+		if err := store.Close(); err != nil {
+			t.Errorf("%s: %v", kind, err)
+		}
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stores := openStores(t, dir)
+	for _, kind := range []string{FileStoreKind, LogStoreKind} {
+		store := stores[kind]
+		if err := store.Delete(1); err != nil {
+			t.Fatal(err)
+		}
+		vm, _ := store.Get(2)
+		vm.RAM *= 2
+		if err := store.Put(2, vm); err != nil {
+			t.Fatal(err)
+		}
+		want := store.List()
+		store.Close()
+
+		reopened, err := OpenStore(kind, filepath.Join(dir, kind), VMs{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reopened.List(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got: %v, want: %v", kind, got, want)
+		}
+		reopened.Close()
+	}
+}
+
+func TestLogStoreBrokenLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, StoreLog)
+	log := `{"op":"put","id":1,"vm":{"vcpus":1,"clock":1000,"ram":1024,"storage":10,"network":100,"state":"Stopped"}}
+{"op":"put","id":2,"vm":{"vcpus":2,"clock":1000,"ram":1024,"storage":10,"network":100,"state":"Stopped"}}
+{"op":"delete","id":1}
+{"op":"put","id":3,"vm":{"vcpu`
+	if err := ioutil.WriteFile(filename, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenLogStore(filename, defaultVMs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := store.List(); len(got) != 1 || got[2].VCPUS != 2 {
+		t.Errorf("got: %v, want just VM 2", got)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if got, want := string(data), `{"op":"put","id":2,"vm":{"vcpus":2,"clock":1000,"ram":1024,"storage":10,"network":100,"state":"Stopped"}}`+"\n"; got != want {
+		t.Errorf("got compacted log: %q, want: %q", got, want)
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	store := NewMemoryStore(defaultVMs.clone())
+	failure := errors.New("disk full")
+	store.persist = func(op storeOp, vms VMs) error { return failure }
+	c := Cloud{store: store}
+
+	if err := c.Delete(1); !errors.Is(err, failure) {
+		t.Errorf("got: %v, want: %v", err, failure)
+	}
+	if _, found := c.Inspect(1); !found {
+		t.Errorf("got VM 1 deleted, want it kept when the store fails")
+	}
+	if _, err := c.Launch(1); !errors.Is(err, failure) {
+		t.Errorf("got: %v, want: %v", err, failure)
+	}
+	if vm, _ := c.Inspect(1); vm.State != STOPPED {
+		t.Errorf("got: %v, want: %v", vm.State, STOPPED)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of the local CA & certificate generated when -tls is given without
+// -tls-cert & -tls-key, next to VMsJSON
+const (
+	TLSCACert = "ca.pem"
+	TLSCAKey  = "ca-key.pem"
+	TLSCert   = "cert.pem"
+	TLSKey    = "key.pem"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 397 * 24 * time.Hour // the longest browsers accept
+)
+
+// TLSConfig configures HTTPS serving
+type TLSConfig struct {
+	Enabled  bool   // serve HTTPS (and HTTP/2) instead of HTTP
+	CertFile string // PEM certificate chain, generated if empty
+	KeyFile  string // PEM private key, generated if empty
+}
+
+// RegisterFlags sets up flags for the config on the flag set,
+// using the current config values as defaults
+func (c *TLSConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Enabled, "tls", c.Enabled,
+		"Serve HTTPS & HTTP/2, with a generated local CA unless -tls-cert & -tls-key are given")
+	fs.StringVar(&c.CertFile, "tls-cert", c.CertFile, "PEM certificate file, used with -tls")
+	fs.StringVar(&c.KeyFile, "tls-key", c.KeyFile, "PEM private key file, used with -tls")
+}
+
+// Files returns the certificate & key files to serve address with,
+// generating them on first run if none were given
+func (c *TLSConfig) Files(address string) (certFile, keyFile string, err error) {
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return "", "", errors.New("-tls-cert & -tls-key must be given together")
+		}
+		return c.CertFile, c.KeyFile, nil
+	}
+	return localCertificate(filepath.Dir(VMsJSON), tlsHosts(address))
+}
+
+// tlsHosts lists the names the local certificate is valid for
+func tlsHosts(address string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return hosts
+	}
+	for _, h := range hosts {
+		if h == host {
+			return hosts
+		}
+	}
+	return append(hosts, host)
+}
+
+// localCertificate returns the certificate & key files in dir, issuing
+// them for hosts with the local CA (created if missing) unless they exist
+func localCertificate(dir string, hosts []string) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, TLSCert), filepath.Join(dir, TLSKey)
+	if exists(certFile) && exists(keyFile) {
+		return certFile, keyFile, nil
+	}
+	ca, caKey, err := localCA(dir)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating TLS key: %v", err)
+	}
+	template, err := certificateTemplate(hosts[0], leafValidity)
+	if err != nil {
+		return "", "", err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return "", "", fmt.Errorf("error issuing TLS certificate: %v", err)
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return "", "", err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return "", "", err
+	}
+	log.Printf("Generated TLS certificate %q for %v", certFile, hosts)
+	return certFile, keyFile, nil
+}
+
+// localCA loads the CA in dir, creating it if missing
+func localCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	certFile, keyFile := filepath.Join(dir, TLSCACert), filepath.Join(dir, TLSCAKey)
+	if exists(certFile) && exists(keyFile) {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading local CA %q: %v", certFile, err)
+		}
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing local CA %q: %v", certFile, err)
+		}
+		return ca, pair.PrivateKey.(crypto.Signer), nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating CA key: %v", err)
+	}
+	template, err := certificateTemplate("test-vmbackend local CA", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating local CA: %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing local CA: %v", err)
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := writeKey(keyFile, key); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Generated local CA %q, trust it to avoid browser warnings (eg. curl --cacert %s)", certFile, certFile)
+	return ca, key, nil
+}
+
+// certificateTemplate returns the common fields of the generated certificates
+func certificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating certificate serial number: %v", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"test-vmbackend"}, CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour), // tolerate clock skew
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writeKey saves the private key as a PKCS #8 PEM file readable only by the owner
+func writeKey(filename string, key crypto.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("error encoding key %q: %v", filename, err)
+	}
+	return writePEM(filename, "PRIVATE KEY", der, 0600)
+}
+
+func writePEM(filename, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(filename, data, perm); err != nil {
+		return fmt.Errorf("error saving %q: %v", filename, err)
+	}
+	return nil
+}
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := localCertificate(dir, tlsHosts("127.0.0.1:8443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(dir, TLSCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(NewDefaultServer().ServeVM))
+	ts.EnableHTTP2 = true
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	ts.StartTLS()
+	defer ts.Close()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(ts.URL + "/vms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Fatalf("got status: %d, protocol: %s", resp.StatusCode, resp.Proto)
+	}
+
+	first, _ := ioutil.ReadFile(certFile)
+	if _, _, err := localCertificate(dir, tlsHosts("")); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ioutil.ReadFile(certFile); string(again) != string(first) {
+		t.Fatalf("got a new certificate on second run")
+	}
+}
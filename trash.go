@@ -0,0 +1,240 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultTrashRetention is how long deleted VMs are kept in the trash
+// before being purged
+const DefaultTrashRetention = 24 * time.Hour
+
+// LoadTrash sets the deleted VMs in the trash & the ids of the purged ones,
+// as saved in the state
+func (c *Cloud) LoadTrash(trash VMs, purged []int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.trash = trash.clone()
+	c.purged = make(map[int]bool, len(purged))
+	for _, id := range purged {
+		c.purged[id] = true
+	}
+	for _, vm := range c.trash {
+		c.schedulePurgeLocked(vm)
+	}
+}
+
+// trashLocked moves VM id, already out of the store, to the trash.
+// The caller must hold the lock.
+func (c *Cloud) trashLocked(id int, vm VM) {
+	now := time.Now()
+	vm.State, vm.UpdatedAt, vm.LastStateChangeAt, vm.DeletedAt = DELETED, &now, &now, &now
+	if c.trash == nil {
+		c.trash = make(VMs)
+	}
+	c.trash[id] = vm
+	c.notify(VMDeleted, id, vm)
+	c.purgeLocked(now)
+	c.schedulePurgeLocked(vm)
+}
+
+// schedulePurgeLocked purges the VM deleted once its retention is over, as
+// any other VM expired by then. It is not a pending transition, so it is
+// not resolved on shutdown. The caller must hold the lock.
+func (c *Cloud) schedulePurgeLocked(vm VM) {
+	if vm.DeletedAt == nil || c.retention == 0 {
+		return
+	}
+	time.AfterFunc(time.Until(vm.DeletedAt.Add(c.retention)), func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.purgeLocked(time.Now())
+	})
+}
+
+// expiredLocked tells whether the VM in the trash is due to be purged.
+// The caller must hold the lock.
+func (c *Cloud) expiredLocked(vm VM, now time.Time) bool {
+	return vm.DeletedAt == nil || now.Sub(*vm.DeletedAt) >= c.retention
+}
+
+// purgeLocked purges the VMs deleted longer than the retention ago, all of
+// them without retention. The caller must hold the lock.
+func (c *Cloud) purgeLocked(now time.Time) {
+	for _, id := range c.trash.sortedIDs() {
+		vm := c.trash[id]
+		if !c.expiredLocked(vm, now) {
+			continue
+		}
+		delete(c.trash, id)
+		if c.purged == nil {
+			c.purged = make(map[int]bool)
+		}
+		c.purged[id] = true
+		c.deleteSnapshotsLocked(id)
+		c.notify(VMPurged, id, vm)
+	}
+}
+
+// Trash returns the deleted VMs not purged yet
+func (c *Cloud) Trash() VMs {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.purgeLocked(time.Now())
+	return c.trash.clone()
+}
+
+// Trashed returns the deleted VM id if it is in the trash
+func (c *Cloud) Trashed(id int) (VM, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.purgeLocked(time.Now())
+	vm, found := c.trash[id]
+	return vm, found
+}
+
+// Restore the deleted VM id from the trash, Stopped.
+// A CloudError is returned if it is not in the trash, its project is gone
+// or the project quota is exceeded.
+func (c *Cloud) Restore(id int) (VM, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.purgeLocked(time.Now())
+	vm, found := c.trash[id]
+	if !found {
+		return VM{}, c.notFoundLocked(id, "restore error: not found VM %d in the trash", id)
+	}
+	if _, found := c.findProjectLocked(vm.ProjectID()); !found {
+		return VM{}, cloudErrorf(ProjectNotFound, id, "restore error: not found project %q of VM %d", vm.ProjectID(), id)
+	}
+	requested := Usage{VCPUS: vm.VCPUS, RAM: vm.RAM, Storage: vm.Storage, VMs: 1}
+	if err := c.checkQuotaLocked(vm.ProjectID(), NoVMID, requested); err != nil {
+		return VM{}, err
+	}
+	now := time.Now()
+	vm.State, vm.UpdatedAt, vm.LastStateChangeAt, vm.DeletedAt = STOPPED, &now, &now, nil
+	if err := c.store.Put(id, vm); err != nil {
+		return VM{}, err
+	}
+	delete(c.trash, id)
+	c.notify(VMRestored, id, vm)
+	return vm, nil
+}
+
+// NotFound returns the VMNotFound CloudError of VM id with the message,
+// telling whether the VM is in the trash or was purged
+func (c *Cloud) NotFound(id int, format string, args ...interface{}) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.notFoundLocked(id, format, args...)
+}
+
+// notFoundLocked is NotFound for callers holding the lock
+func (c *Cloud) notFoundLocked(id int, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if vm, found := c.trash[id]; found && !c.expiredLocked(vm, time.Now()) {
+		message += ", it is in the trash until restored or purged"
+	} else if found || c.purged[id] { // expired ones are about to be purged
+		message += ", it was deleted & purged from the trash"
+	}
+	return cloudErrorf(VMNotFound, id, "%s", message)
+}
+
+// Deleted tells whether VM id is in the trash or was purged
+func (c *Cloud) Deleted(id int) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.deletedLocked(id)
+}
+
+// deletedLocked tells whether VM id is in the trash or was purged.
+// The caller must hold the lock.
+func (c *Cloud) deletedLocked(id int) bool {
+	_, found := c.trash[id]
+	return found || c.purged[id]
+}
+
+// nextIDLocked returns the id of a new VM, never reusing the ids of deleted
+// ones. The caller must hold the lock.
+func (c *Cloud) nextIDLocked() int {
+	next := c.store.List().nextID()
+	if id := c.trash.nextID(); id > next {
+		next = id
+	}
+	for id := range c.purged {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// purgedIDsLocked returns the sorted ids of the purged VMs.
+// The caller must hold the lock.
+func (c *Cloud) purgedIDsLocked() []int {
+	if len(c.purged) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(c.purged))
+	for id := range c.purged {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// replayTrash returns the VMs in the trash & the purged ids resulting from
+// the events
+func replayTrash(events []VMEvent) (VMs, []int) {
+	trash, purged := make(VMs), []int{}
+	for _, event := range events {
+		switch event.Type {
+		case VMDeleted:
+			trash[event.ID] = event.VM
+		case VMPurged:
+			delete(trash, event.ID)
+			purged = append(purged, event.ID)
+		default:
+			delete(trash, event.ID)
+		}
+	}
+	return trash, purged
+}
+
+func (s *VMServer) listTrash(w http.ResponseWriter, r *http.Request) {
+	vms := s.vmm.Trash().inProject(projectOf(r))
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vms.v1())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: vms.resources(), Links: map[string]string{"self": versionedPath(r, "/trash")}})
+}
+
+func (s *VMServer) restore(id int, w http.ResponseWriter, r *http.Request) {
+	if vm, found := s.vmm.Trashed(id); found && vm.ProjectID() != projectOf(r) {
+		writeError(w, r, cloudErrorf(VMNotFound, id, "not found VM %d in the trash of project %q", id, projectOf(r)))
+		return
+	}
+	vm, err := s.vmm.Restore(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) == V1 {
+		fmt.Fprint(w, vm.v1())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s.vmV2(r, id, vm))
+}
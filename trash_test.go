@@ -0,0 +1,172 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	c := NewDefaultCloud()
+	if err := c.Delete(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := c.Inspect(GoodID); found {
+		t.Errorf("got VM %d, want it out of the VMs", GoodID)
+	}
+	trashed, found := c.Trashed(GoodID)
+	if !found || trashed.State != DELETED || trashed.DeletedAt == nil {
+		t.Fatalf("got: %v, want VM %d %v in the trash", trashed, GoodID, DELETED)
+	}
+	c.lock.Lock()
+	id := c.nextIDLocked()
+	c.lock.Unlock()
+	if id != len(defaultVMs) {
+		t.Errorf("got next id: %d, want: %d", id, len(defaultVMs))
+	}
+
+	vm, err := c.Restore(GoodID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.State != STOPPED || vm.DeletedAt != nil {
+		t.Errorf("got: %v, want VM %d restored %v", vm, GoodID, STOPPED)
+	}
+	if got, _ := c.Inspect(GoodID); !reflect.DeepEqual(withoutTimes(got), withoutTimes(defaultVMs[GoodID])) {
+		t.Errorf("got: %v, want: %v", got, defaultVMs[GoodID])
+	}
+	if _, err := c.Restore(GoodID); err == nil {
+		t.Errorf("got no error restoring VM %d twice", GoodID)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c := NewDefaultCloud()
+	c.retention = time.Hour
+	if err := c.Delete(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	c.lock.Lock()
+	deletedAt := time.Now().Add(-2 * time.Hour)
+	vm := c.trash[GoodID]
+	vm.DeletedAt = &deletedAt
+	c.trash[GoodID] = vm
+	c.lock.Unlock()
+
+	if trash := c.Trash(); len(trash) != 0 {
+		t.Fatalf("got: %v, want the expired VM %d purged", trash, GoodID)
+	}
+	_, err := c.Restore(GoodID)
+	if err == nil || !strings.Contains(err.Error(), "purged") {
+		t.Errorf("got: %v, want an error about VM %d purged", err, GoodID)
+	}
+	state := c.State()
+	if !reflect.DeepEqual(state.Purged, []int{GoodID}) {
+		t.Errorf("got purged: %v, want: %v", state.Purged, []int{GoodID})
+	}
+
+	c.retention = 0
+	if err := c.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+	if trash := c.Trash(); len(trash) != 0 {
+		t.Errorf("got: %v, want VM 0 purged right away without retention", trash)
+	}
+}
+
+func TestScheduledPurge(t *testing.T) {
+	s := NewDefaultServer()
+	s.vmm.retention = 50 * time.Millisecond
+	events, cancel := s.vmm.Subscribe()
+	defer cancel()
+	serve(s, http.MethodDelete, "/vms/1")
+	time.Sleep(100 * time.Millisecond)
+
+	p := decodeProblem(t, serve(s, http.MethodGet, "/vms/1"))
+	if p.Status != http.StatusNotFound || !strings.Contains(p.Detail, "purged") {
+		t.Errorf("got: %+v, want a 404 telling VM 1 was purged", p)
+	}
+	s.vmm.lock.RLock()
+	purged := s.vmm.purged[GoodID]
+	s.vmm.lock.RUnlock()
+	if !purged {
+		t.Errorf("got VM %d not purged, want it purged once its retention is over", GoodID)
+	}
+	for _, want := range []VMEventType{VMDeleted, VMPurged} {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Errorf("got event: %v, want: %v", event.Type, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got no %v event", want)
+		}
+	}
+}
+
+func TestReplayTrash(t *testing.T) {
+	events := []VMEvent{
+		{Type: VMCreated, ID: 0}, {Type: VMCreated, ID: 1}, {Type: VMCreated, ID: 2},
+		{Type: VMDeleted, ID: 0}, {Type: VMDeleted, ID: 1}, {Type: VMDeleted, ID: 2},
+		{Type: VMPurged, ID: 0}, {Type: VMRestored, ID: 2},
+	}
+	trash, purged := replayTrash(events)
+	if _, found := trash[1]; !found || len(trash) != 1 {
+		t.Errorf("got trash: %v, want VM 1 only", trash)
+	}
+	if !reflect.DeepEqual(purged, []int{0}) {
+		t.Errorf("got purged: %v, want: %v", purged, []int{0})
+	}
+	if vms := replayEvents(events, time.Time{}); len(vms) != 1 {
+		t.Errorf("got VMs: %v, want VM 2 only", vms)
+	}
+}
+
+func TestTrashAPI(t *testing.T) {
+	s := NewDefaultServer()
+	serve(s, http.MethodDelete, "/vms/1")
+	p := decodeProblem(t, serve(s, http.MethodGet, "/vms/1"))
+	if p.Status != http.StatusNotFound || !strings.Contains(p.Detail, "trash") {
+		t.Errorf("got: %+v, want a 404 telling VM 1 is in the trash", p)
+	}
+
+	var trash VMs
+	w := serve(s, http.MethodGet, "/trash")
+	if err := json.Unmarshal(w.Body.Bytes(), &trash); err != nil {
+		t.Fatalf("Failed to parse trash %q: %v", w.Body.String(), err)
+	}
+	if vm, found := trash[GoodID]; !found || len(trash) != 1 || vm.State != DELETED {
+		t.Errorf("got: %v, want VM %d %v", trash, GoodID, DELETED)
+	}
+	var resources []VMResource
+	decodeEnvelope(t, serve(s, http.MethodGet, "/v2/trash"), &resources)
+	if len(resources) != 1 || resources[0].ID != GoodID {
+		t.Errorf("got: %v, want VM %d", resources, GoodID)
+	}
+	if w := serve(s, http.MethodGet, "/projects/"+DefaultProjectID+"/trash"); w.Code != http.StatusOK {
+		t.Errorf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+
+	if w := serve(s, http.MethodPost, "/trash/1/restore"); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	if w := serve(s, http.MethodGet, "/vms/1"); w.Code != http.StatusOK {
+		t.Errorf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodPost, "/trash/1/restore")); p.Code != VMNotFound {
+		t.Errorf("got: %v, want: %v", p.Code, VMNotFound)
+	}
+
+	s.vmm.retention = 0
+	serve(s, http.MethodDelete, "/vms/1")
+	p = decodeProblem(t, serve(s, http.MethodGet, "/vms/1"))
+	if p.Status != http.StatusNotFound || !strings.Contains(p.Detail, "purged") {
+		t.Errorf("got: %+v, want a 404 telling VM 1 was purged", p)
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// APIVersion identifies a version of the REST API
+type APIVersion string
+
+const (
+	// V1 is the original API, with bare JSON payloads.
+	// It is the default for unversioned requests and it is deprecated.
+	V1 APIVersion = "v1"
+
+	// V2 wraps payloads in envelopes and paginates lists
+	V2 APIVersion = "v2"
+)
+
+// DefaultAPIVersion is used when the request does not ask for one
+const DefaultAPIVersion = V1
+
+// LatestAPIVersion is the successor of all deprecated versions
+const LatestAPIVersion = V2
+
+// APIVersions lists all supported versions
+var APIVersions = []APIVersion{V1, V2}
+
+// VendorMediaTypePrefix prefixes the versioned media types accepted in the
+// Accept header, such as "application/vnd.test-vmbackend.v2+json"
+const VendorMediaTypePrefix = "application/vnd.test-vmbackend."
+
+const (
+	// DefaultPageLimit is the page size for v2 lists when no limit is given
+	DefaultPageLimit = 20
+
+	// MaxPageLimit is the maximum page size accepted for v2 lists
+	MaxPageLimit = 100
+)
+
+func isSupported(version APIVersion) bool {
+	for _, v := range APIVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey string
+
+const (
+	versionKey      contextKey = "version"
+	originalPathKey contextKey = "originalPath"
+)
+
+var versionPrefix = regexp.MustCompile(`^/(v\d+)(/.*)?$`)
+
+// negotiateVersion finds the API version requested by r, by path prefix
+// (/v1/vms) or else by Accept header, and returns a request routed to the
+// unversioned path with the version in its context.
+// The boolean reports whether the path was unprefixed, so the version was
+// negotiated by the Accept header (even if defaulted).
+func negotiateVersion(r *http.Request) (*http.Request, bool, error) {
+	version, path := DefaultAPIVersion, r.URL.Path
+	negotiable := true
+	if m := versionPrefix.FindStringSubmatch(r.URL.Path); m != nil {
+		version, path, negotiable = APIVersion(m[1]), m[2], false
+	} else if v, found := acceptedVersion(r.Header.Get("Accept")); found {
+		version = v
+	}
+	if !isSupported(version) {
+		return r, negotiable, fmt.Errorf("API version %q not supported, use one of %v", version, APIVersions)
+	}
+	ctx := context.WithValue(r.Context(), versionKey, version)
+	ctx = context.WithValue(ctx, originalPathKey, r.URL.Path)
+	routed := r.WithContext(ctx)
+	url := *r.URL
+	url.Path = path
+	routed.URL = &url
+	return routed, negotiable, nil
+}
+
+// acceptedVersion looks for a version in the Accept header, either as a vendor
+// media type or a version parameter, such as "application/json; version=2"
+func acceptedVersion(accept string) (APIVersion, bool) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(mediaType, VendorMediaTypePrefix) {
+			v := strings.TrimPrefix(mediaType, VendorMediaTypePrefix)
+			return APIVersion(strings.TrimSuffix(v, "+json")), true
+		}
+		if v, found := params["version"]; found {
+			return APIVersion("v" + strings.TrimPrefix(v, "v")), true
+		}
+	}
+	return "", false
+}
+
+// apiVersion returns the negotiated API version of the request
+func apiVersion(r *http.Request) APIVersion {
+	if version, ok := r.Context().Value(versionKey).(APIVersion); ok {
+		return version
+	}
+	return DefaultAPIVersion
+}
+
+// originalPath returns the path as requested by the client, before routing
+func originalPath(r *http.Request) string {
+	if path, ok := r.Context().Value(originalPathKey).(string); ok {
+		return path
+	}
+	return r.URL.Path
+}
+
+// versionedPath returns path prefixed with the request API version,
+// and project if the request was routed by project
+func versionedPath(r *http.Request, path string) string {
+	return "/" + string(apiVersion(r)) + projectPath(r, path)
+}
+
+// setVersionHeaders flags the response API version, with deprecation
+// headers pointing to the successor version if needed
+func setVersionHeaders(w http.ResponseWriter, r *http.Request) {
+	version := apiVersion(r)
+	w.Header().Set("API-Version", string(version))
+	if version != LatestAPIVersion {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf(`</%s%s>; rel="successor-version"`, LatestAPIVersion, projectPath(r, r.URL.Path)))
+	}
+}
+
+// VMResource is the v2 representation of a VM, including its id and,
+// in v2 JSON, the HAL links to itself and its legal actions
+type VMResource struct {
+	ID int `json:"id"`
+	VM
+	Links map[string]HALLink `json:"_links,omitempty"`
+}
+
+// VMV1 is the v1 representation of a VM, keeping the payloads v1 had
+// before timestamps, progress & deletion protection, which are v2 only
+type VMV1 struct {
+	VCPUS   int     `json:"vcpus,omitempty"`
+	Clock   float32 `json:"clock,omitempty"`
+	RAM     int     `json:"ram,omitempty"`
+	Storage int     `json:"storage,omitempty"`
+	Network int     `json:"network,omitempty"`
+	State   VMState `json:"state,omitempty"`
+	Project string  `json:"project,omitempty"`
+}
+
+// VMResourceV1 is the v1 representation of a VM including its id, as
+// replied to creations & in other formats than JSON
+type VMResourceV1 struct {
+	ID int `json:"id"`
+	VMV1
+}
+
+// VMsV1 is the v1 representation of VMs, by id
+type VMsV1 map[int]VMV1
+
+// String dumps the VM in JSON format, as v1 replies
+func (vm VMV1) String() string {
+	vmJSON, err := json.Marshal(vm)
+	dieOnError(err, "Can't generate JSON for VM object %#v", vm)
+	return string(vmJSON)
+}
+
+// String dumps the VMs in JSON format, as v1 replies
+func (vms VMsV1) String() string {
+	vmJSON, err := json.Marshal(vms)
+	dieOnError(err, "Can't generate JSON for VM object %#v", vms)
+	return string(vmJSON)
+}
+
+// v1 returns the v1 representation of the VM
+func (vm VM) v1() VMV1 {
+	return VMV1{VCPUS: vm.VCPUS, Clock: vm.Clock, RAM: vm.RAM, Storage: vm.Storage, Network: vm.Network,
+		State: vm.State, Project: vm.Project}
+}
+
+// v1 returns the v1 representation of the VMs
+func (vms VMs) v1() VMsV1 {
+	v1 := make(VMsV1, len(vms))
+	for id, vm := range vms {
+		v1[id] = vm.v1()
+	}
+	return v1
+}
+
+// resourcesV1 returns the VMs as VMResourceV1s sorted by id
+func (vms VMs) resourcesV1() []VMResourceV1 {
+	resources := make([]VMResourceV1, 0, len(vms))
+	for _, id := range vms.sortedIDs() {
+		resources = append(resources, VMResourceV1{ID: id, VMV1: vms[id].v1()})
+	}
+	return resources
+}
+
+// Page is the metadata of a paginated v2 list
+type Page struct {
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// Envelope wraps every v2 payload
+type Envelope struct {
+	Data  interface{}       `json:"data"`
+	Meta  *Page             `json:"meta,omitempty"`
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// sortedIDs returns the VM ids in ascending order
+func (vms VMs) sortedIDs() []int {
+	ids := make([]int, 0, len(vms))
+	for id := range vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// resources returns the VMs as VMResources sorted by id
+func (vms VMs) resources() []VMResource {
+	resources := make([]VMResource, 0, len(vms))
+	for _, id := range vms.sortedIDs() {
+		resources = append(resources, VMResource{ID: id, VM: vms[id]})
+	}
+	return resources
+}
+
+// parsePage reads offset & limit query parameters
+func parsePage(r *http.Request) (Page, error) {
+	page := Page{Limit: DefaultPageLimit}
+	query := r.URL.Query()
+	for name, field := range map[string]*int{"offset": &page.Offset, "limit": &page.Limit} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return page, fmt.Errorf("%s must be a non negative integer, got %q", name, value)
+		}
+		*field = n
+	}
+	if page.Limit == 0 || page.Limit > MaxPageLimit {
+		return page, fmt.Errorf("limit must be within [1, %d], got %d", MaxPageLimit, page.Limit)
+	}
+	return page, nil
+}
+
+// pageLinks returns self, next and prev links for the page, keeping the
+// other query parameters (like at for past listings)
+func pageLinks(r *http.Request, page Page) map[string]string {
+	others := r.URL.Query()
+	others.Del("offset")
+	others.Del("limit")
+	link := func(offset int) string {
+		path := fmt.Sprintf("%s?offset=%d&limit=%d", versionedPath(r, r.URL.Path), offset, page.Limit)
+		if len(others) > 0 {
+			path += "&" + others.Encode()
+		}
+		return path
+	}
+	links := map[string]string{"self": link(page.Offset)}
+	if page.Offset+page.Limit < page.Total {
+		links["next"] = link(page.Offset + page.Limit)
+	}
+	if page.Offset > 0 {
+		prev := page.Offset - page.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links["prev"] = link(prev)
+	}
+	return links
+}
+
+// listV2 returns the page of VMs requested as an Envelope
+func (s *VMServer) listV2(r *http.Request, vms VMs) (Envelope, error) {
+	page, err := parsePage(r)
+	if err != nil {
+		return Envelope{}, err
+	}
+	resources := vms.resources()
+	page.Total = len(resources)
+	data := []VMResource{}
+	if page.Offset < page.Total {
+		end := page.Offset + page.Limit
+		if end > page.Total {
+			end = page.Total
+		}
+		data = resources[page.Offset:end]
+	}
+	for i := range data {
+		data[i] = s.withLinks(r, data[i])
+	}
+	return Envelope{Data: data, Meta: &page, Links: pageLinks(r, page)}, nil
+}
+
+// vmV2 returns the Envelope for a single VM
+func (s *VMServer) vmV2(r *http.Request, id int, vm VM) Envelope {
+	self := versionedPath(r, fmt.Sprintf("/vms/%d", id))
+	resource := s.withLinks(r, VMResource{ID: id, VM: vm})
+	return Envelope{Data: resource, Links: map[string]string{"self": self}}
+}
+
+// writeJSON dumps v as JSON with the given status code
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error generating JSON for %#v: %v", v, err)
+		writeProblem(w, r, NewProblem(InternalError, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(body))
+}
@@ -25,8 +25,14 @@ const (
 
 	// STOPPING VM is transitioning from Running to Stopped
 	STOPPING VMState = "Stopping"
+
+	// DELETED VM is in the trash, it can be restored until purged
+	DELETED VMState = "Deleted"
 )
 
+// VMStates lists all the VM states
+var VMStates = []VMState{STOPPED, STARTING, RUNNING, STOPPING, DELETED}
+
 const (
 	// DefaultStartDelay Start VM process simulated delay
 	DefaultStartDelay = 10 * time.Second
@@ -59,7 +65,20 @@ type VM struct {
 	RAM     int     `json:"ram,omitempty"`     // Amount of internal memory, in MB (Megabytes)
 	Storage int     `json:"storage,omitempty"` // Amount of persistent storage, in GB (Gigabytes)
 	Network int     `json:"network,omitempty"` // Network device speed in Gb/s (Gigabits per second)
-	State   VMState `json:"state,omitempty"`   // Value within [Running, Stopped, Starting, Stopping]
+	State   VMState `json:"state,omitempty"`   // Value within [Running, Stopped, Starting, Stopping, Deleted]
+	Project string  `json:"project,omitempty"` // Owner project id, the default one if empty
+
+	Protected bool `json:"protected,omitempty"` // Deletion protection, cleared with PATCH to delete the VM
+
+	// Timestamps, missing on VMs of older state files until they change
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+	LastStateChangeAt *time.Time `json:"last_state_change_at,omitempty"`
+	LaunchedAt        *time.Time `json:"launched_at,omitempty"`    // when last launched, getting Starting
+	DeletedAt         *time.Time `json:"deleted_at,omitempty"`     // when moved to the trash
+	UptimeSeconds     int64      `json:"uptime_seconds,omitempty"` // since it got Running, computed on read
+
+	Progress *Progress `json:"progress,omitempty"` // of the Starting or Stopping transition, computed on read
 }
 
 // VM by default dumps itself in JSON format
@@ -69,6 +88,25 @@ func (vm VM) String() string {
 	return string(vmJSON)
 }
 
+// Validate checks the VM hardware spec makes sense
+func (vm VM) Validate() error {
+	for _, field := range []struct {
+		name  string
+		value float32
+	}{
+		{"vcpus", float32(vm.VCPUS)},
+		{"clock", vm.Clock},
+		{"ram", float32(vm.RAM)},
+		{"storage", float32(vm.Storage)},
+		{"network", float32(vm.Network)},
+	} { // in order, to always report the same one first
+		if field.value <= 0 {
+			return fmt.Errorf("invalid VM spec: %s must be positive, got %v", field.name, field.value)
+		}
+	}
+	return nil
+}
+
 // AllowedTransition lists allowed state transitions
 var AllowedTransition = map[VMState]VMState{
 	STOPPED:  STARTING,
@@ -90,6 +128,27 @@ func (vm VM) WithState(state VMState) (VM, error) {
 	return vm, nil
 }
 
+// stamped returns the VM with now as its missing creation, update & state
+// change times, for VMs created now
+func (vm VM) stamped(now time.Time) VM {
+	for _, t := range []**time.Time{&vm.CreatedAt, &vm.UpdatedAt, &vm.LastStateChangeAt} {
+		if *t == nil {
+			*t = &now
+		}
+	}
+	vm.UptimeSeconds, vm.Progress = 0, nil
+	return vm
+}
+
+// withUptime returns the VM with its uptime at the given time, if Running
+func (vm VM) withUptime(now time.Time) VM {
+	vm.UptimeSeconds = 0
+	if vm.State == RUNNING && vm.LastStateChangeAt != nil {
+		vm.UptimeSeconds = int64(now.Sub(*vm.LastStateChangeAt).Seconds())
+	}
+	return vm
+}
+
 // VMs defines a map of VMs with attached methods
 type VMs map[int]VM
 
@@ -102,6 +161,25 @@ func (vms VMs) clone() VMs {
 	return cloneList
 }
 
+// withUptime returns the VMs with their uptime at the given time
+func (vms VMs) withUptime(now time.Time) VMs {
+	for id, vm := range vms {
+		vms[id] = vm.withUptime(now)
+	}
+	return vms
+}
+
+// nextID returns the id a new VM would get in the list
+func (vms VMs) nextID() int {
+	next := 0
+	for id := range vms {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	return next
+}
+
 // String in VMs by default dumps itself in JSON format skipping empty entries
 func (vms VMs) String() string {
 	vmJSON, err := json.Marshal(vms)
@@ -75,3 +75,12 @@ func TestWithStateErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateOrder(t *testing.T) {
+	want := "invalid VM spec: clock must be positive, got 0"
+	for i := 0; i < 20; i++ { // map iteration would change the first field checked
+		if got := (VM{VCPUS: 1}).Validate(); got == nil || got.Error() != want {
+			t.Fatalf("got: %v, want: %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// VolumeState represents the current state of a volume
+type VolumeState string
+
+const (
+	// VolumeAvailable volume is detached, it can be attached or removed
+	VolumeAvailable VolumeState = "Available"
+
+	// VolumeAttaching volume is transitioning from Available to InUse
+	VolumeAttaching VolumeState = "Attaching"
+
+	// VolumeInUse volume is attached to a VM
+	VolumeInUse VolumeState = "InUse"
+
+	// VolumeDetaching volume is transitioning from InUse to Available
+	VolumeDetaching VolumeState = "Detaching"
+)
+
+// VolumeTypes lists the types of volumes, the first one is the default
+var VolumeTypes = []string{"standard", "ssd"}
+
+const (
+	// DefaultAttachDelay Attach volume process simulated delay
+	DefaultAttachDelay = 2 * time.Second
+
+	// DefaultDetachDelay Detach volume process simulated delay
+	DefaultDetachDelay = 2 * time.Second
+)
+
+var (
+	// AttachDelay for attach operations (not a constant so unit test can change it)
+	AttachDelay = DefaultAttachDelay
+
+	// DetachDelay for detach operations (not a constant so unit test can change it)
+	DetachDelay = DefaultDetachDelay
+)
+
+// Volume is a block storage device, which can be attached to a VM
+type Volume struct {
+	ID        int         `json:"id"`
+	Name      string      `json:"name,omitempty"`
+	Size      int         `json:"size"`              // Amount of storage, in GB (Gigabytes)
+	Type      string      `json:"type"`              // Value within VolumeTypes
+	State     VolumeState `json:"state"`             // Value within [Available, Attaching, InUse, Detaching]
+	VMID      *int        `json:"vm_id,omitempty"`   // VM attached to, while not Available
+	Project   string      `json:"project,omitempty"` // Owner project id, the default one if empty
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// ProjectID returns the id of the project owning the volume
+func (v Volume) ProjectID() string {
+	if v.Project == "" {
+		return DefaultProjectID
+	}
+	return v.Project
+}
+
+// Validate checks the volume size & type
+func (v Volume) Validate() error {
+	if v.Size <= 0 {
+		return fmt.Errorf("invalid volume: size must be positive, got %d", v.Size)
+	}
+	for _, t := range VolumeTypes {
+		if v.Type == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid volume: type must be one of %v, got %q", VolumeTypes, v.Type)
+}
+
+// attachedTo tells whether the volume is attached to VM id, or being
+// attached or detached
+func (v Volume) attachedTo(id int) bool {
+	return v.VMID != nil && *v.VMID == id
+}
+
+// LoadVolumes sets the volumes & the last volume id given, as saved in the
+// state
+func (c *Cloud) LoadVolumes(volumes []Volume, lastID int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.volumes = make(map[int]Volume, len(volumes))
+	c.lastVolumeID = lastID
+	for _, volume := range volumes {
+		c.volumes[volume.ID] = volume
+		if volume.ID > c.lastVolumeID { // saved before the last id was
+			c.lastVolumeID = volume.ID
+		}
+	}
+}
+
+// volumesLocked returns the volumes matching, sorted by id.
+// The caller must hold the lock.
+func (c *Cloud) volumesLocked(matches func(Volume) bool) []Volume {
+	volumes := []Volume{}
+	for _, volume := range c.volumes {
+		if matches(volume) {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].ID < volumes[j].ID })
+	return volumes
+}
+
+// volumeLocked returns volume id, or a CloudError if missing.
+// The caller must hold the lock.
+func (c *Cloud) volumeLocked(id int) (Volume, error) {
+	volume, found := c.volumes[id]
+	if !found {
+		return Volume{}, cloudErrorf(VolumeNotFound, NoVMID, "not found volume %d", id)
+	}
+	return volume, nil
+}
+
+// Volumes returns the volumes of the project
+func (c *Cloud) Volumes(projectID string) []Volume {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.volumesLocked(func(v Volume) bool { return v.ProjectID() == projectID })
+}
+
+// InspectVolume returns volume id, or a CloudError if missing
+func (c *Cloud) InspectVolume(id int) (Volume, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.volumeLocked(id)
+}
+
+// CreateVolume with the given size, type (the default one if empty),
+// name & project, always Available. Returns the new volume, or a CloudError
+// if the spec or project are invalid, or the project storage quota exceeded.
+func (c *Cloud) CreateVolume(spec Volume) (Volume, error) {
+	if spec.Type == "" {
+		spec.Type = VolumeTypes[0]
+	}
+	if err := spec.Validate(); err != nil {
+		return Volume{}, &CloudError{Code: InvalidVolume, ID: NoVMID, Err: err}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, found := c.findProjectLocked(spec.ProjectID()); !found {
+		return Volume{}, cloudErrorf(ProjectNotFound, NoVMID, "not found project %q", spec.ProjectID())
+	}
+	if err := c.checkQuotaLocked(spec.ProjectID(), NoVMID, Usage{Storage: spec.Size}); err != nil {
+		return Volume{}, err
+	}
+	if spec.Project == DefaultProjectID {
+		spec.Project = ""
+	}
+	c.lastVolumeID++
+	volume := Volume{ID: c.lastVolumeID, Name: spec.Name, Size: spec.Size, Type: spec.Type, State: VolumeAvailable,
+		Project: spec.Project, CreatedAt: time.Now()}
+	if c.volumes == nil {
+		c.volumes = make(map[int]Volume)
+	}
+	c.volumes[volume.ID] = volume
+	c.changed()
+	return volume, nil
+}
+
+// UpdateVolume id with the name & size of the patch, if given, volumes
+// can only grow. Returns the volume, or a CloudError if it is missing, the
+// new size is invalid or exceeds the project storage quota.
+func (c *Cloud) UpdateVolume(id int, name *string, size *int) (Volume, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	volume, err := c.volumeLocked(id)
+	if err != nil {
+		return Volume{}, err
+	}
+	if size != nil && *size < volume.Size {
+		return Volume{}, cloudErrorf(InvalidVolume, NoVMID, "invalid volume: size can only grow from %d, got %d", volume.Size, *size)
+	}
+	if size != nil {
+		if err := c.checkQuotaLocked(volume.ProjectID(), NoVMID, Usage{Storage: *size - volume.Size}); err != nil {
+			return Volume{}, err
+		}
+	}
+	if name != nil {
+		volume.Name = *name
+	}
+	if size != nil {
+		volume.Size = *size
+	}
+	c.volumes[id] = volume
+	c.changed()
+	return volume, nil
+}
+
+// DeleteVolume id.
+// A CloudError is returned if the volume is missing or not Available.
+func (c *Cloud) DeleteVolume(id int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	volume, err := c.volumeLocked(id)
+	if err != nil {
+		return err
+	}
+	if volume.State != VolumeAvailable {
+		return cloudErrorf(VolumeAttached, NoVMID,
+			"delete error: volume %d must be %v for deletion but it is %v, detach it first", id, VolumeAvailable, volume.State)
+	}
+	delete(c.volumes, id)
+	c.changed()
+	return nil
+}
+
+// AttachVolume id to VM vmID of the same project, getting InUse after a
+// delay. The return includes a channel to optionally check completion of
+// the attachment, apart from a possible CloudError if either is missing,
+// they are in different projects or the volume is not Available.
+func (c *Cloud) AttachVolume(id, vmID int) (chan struct{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	volume, err := c.volumeLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	vm, found := c.store.Get(vmID)
+	if !found || vm.ProjectID() != volume.ProjectID() {
+		return nil, c.notFoundLocked(vmID, "attach error: not found VM %d in project %q", vmID, volume.ProjectID())
+	}
+	if volume.State != VolumeAvailable {
+		return nil, cloudErrorf(IllegalTransition, vmID,
+			"attach error: volume %d must be %v for attaching but it is %v", id, VolumeAvailable, volume.State)
+	}
+	volume.State, volume.VMID = VolumeAttaching, &vmID
+	c.volumes[id] = volume
+	c.changed()
+	return c.volumeTransition(id, VolumeAttaching, VolumeInUse, AttachDelay), nil
+}
+
+// DetachVolume id from its VM, getting Available after a delay.
+// The return includes a channel to optionally check completion of the
+// detachment, apart from a possible CloudError if the volume is missing
+// or not InUse.
+func (c *Cloud) DetachVolume(id int) (chan struct{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	volume, err := c.volumeLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if volume.State != VolumeInUse {
+		return nil, cloudErrorf(IllegalTransition, NoVMID,
+			"detach error: volume %d must be %v for detaching but it is %v", id, VolumeInUse, volume.State)
+	}
+	volume.State = VolumeDetaching
+	c.volumes[id] = volume
+	c.changed()
+	return c.volumeTransition(id, VolumeDetaching, VolumeAvailable, DetachDelay), nil
+}
+
+// volumeTransition moves volume id from state to the end state after the
+// delay, unless it changed meanwhile
+func (c *Cloud) volumeTransition(id int, from, to VolumeState, delay time.Duration) chan struct{} {
+	return c.schedule(&pendingTransition{id: id, delay: delay}, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		volume, found := c.volumes[id]
+		if !found || volume.State != from {
+			log.Printf("volume error: volume %d is no longer %v", id, from)
+			return
+		}
+		volume.State = to
+		if to == VolumeAvailable {
+			volume.VMID = nil
+		}
+		c.volumes[id] = volume
+		c.changed()
+	})
+}
+
+// AttachedVolumes returns how many volumes are attached to VM id
+func (c *Cloud) AttachedVolumes(id int) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.attachedVolumesLocked(id))
+}
+
+// attachedVolumesLocked returns the volumes attached to VM id, or being
+// attached or detached. The caller must hold the lock.
+func (c *Cloud) attachedVolumesLocked(id int) []Volume {
+	return c.volumesLocked(func(v Volume) bool { return v.attachedTo(id) })
+}
+
+// detachVolumesLocked detaches the volumes of VM id right away, for
+// deleting it. The caller must hold the lock.
+func (c *Cloud) detachVolumesLocked(id int) {
+	for _, volume := range c.attachedVolumesLocked(id) {
+		volume.State, volume.VMID = VolumeAvailable, nil
+		c.volumes[volume.ID] = volume
+	}
+}
+
+// resumeVolumesLocked resumes the attachments & detachments in flight when
+// the state was saved. The caller must hold the lock.
+func (c *Cloud) resumeVolumesLocked() {
+	for _, volume := range c.volumesLocked(func(v Volume) bool { return true }) {
+		switch volume.State {
+		case VolumeAttaching:
+			c.volumeTransition(volume.ID, VolumeAttaching, VolumeInUse, AttachDelay)
+		case VolumeDetaching:
+			c.volumeTransition(volume.ID, VolumeDetaching, VolumeAvailable, DetachDelay)
+		default:
+			continue
+		}
+		log.Printf("Resuming volume %d transition from %v", volume.ID, volume.State)
+	}
+}
+
+// volumeHandlerFunc handles requests on a volume by id
+type volumeHandlerFunc func(id int, w http.ResponseWriter, r *http.Request)
+
+// requestVolumeFor calls f with the volume id at the given position of the
+// path, replying a 404 if the volume is in another project than the path one
+func (s *VMServer) requestVolumeFor(f volumeHandlerFunc, pos int, w http.ResponseWriter, r *http.Request) {
+	id, err := pathIDAt(r, pos)
+	if err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, err.Error()))
+		return
+	}
+	if volume, err := s.vmm.InspectVolume(id); err == nil && volume.ProjectID() != projectOf(r) {
+		writeError(w, r, cloudErrorf(VolumeNotFound, NoVMID, "not found volume %d in project %q", id, projectOf(r)))
+		return
+	}
+	f(id, w, r)
+}
+
+// writeVolume replies with the volume, wrapped in an Envelope for v2
+func writeVolume(w http.ResponseWriter, r *http.Request, status int, volume Volume) {
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, status, volume)
+		return
+	}
+	links := map[string]string{"self": versionedPath(r, fmt.Sprintf("/volumes/%d", volume.ID))}
+	if volume.VMID != nil {
+		links["vm"] = versionedPath(r, fmt.Sprintf("/vms/%d", *volume.VMID))
+	}
+	writeJSON(w, r, status, Envelope{Data: volume, Links: links})
+}
+
+func (s *VMServer) listVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes := s.vmm.Volumes(projectOf(r))
+	if apiVersion(r) == V1 {
+		writeJSON(w, r, http.StatusOK, volumes)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, Envelope{Data: volumes, Links: map[string]string{"self": versionedPath(r, "/volumes")}})
+}
+
+func (s *VMServer) createVolume(w http.ResponseWriter, r *http.Request) {
+	var spec Volume
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON volume: %v", err)))
+		return
+	}
+	spec.Project = projectOf(r) // volumes are created on the project of the path
+	volume, err := s.vmm.CreateVolume(spec)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", versionedPath(r, fmt.Sprintf("/volumes/%d", volume.ID)))
+	writeVolume(w, r, http.StatusCreated, volume)
+}
+
+func (s *VMServer) inspectVolume(id int, w http.ResponseWriter, r *http.Request) {
+	volume, err := s.vmm.InspectVolume(id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeVolume(w, r, http.StatusOK, volume)
+}
+
+func (s *VMServer) updateVolume(id int, w http.ResponseWriter, r *http.Request) {
+	var patch struct {
+		Name *string `json:"name"`
+		Size *int    `json:"size"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON volume patch, only name & size can be updated: %v", err)))
+		return
+	}
+	volume, err := s.vmm.UpdateVolume(id, patch.Name, patch.Size)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeVolume(w, r, http.StatusOK, volume)
+}
+
+func (s *VMServer) deleteVolume(id int, w http.ResponseWriter, r *http.Request) {
+	if err := s.vmm.DeleteVolume(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if apiVersion(r) != V1 {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *VMServer) attachVolume(id int, w http.ResponseWriter, r *http.Request) {
+	var spec struct {
+		VMID *int `json:"vm_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		writeProblem(w, r, NewProblem(BadRequest, fmt.Sprintf("bad JSON attach: %v", err)))
+		return
+	}
+	if spec.VMID == nil {
+		writeProblem(w, r, NewProblem(BadRequest, `missing vm_id, want {"vm_id": id}`))
+		return
+	}
+	if _, err := s.vmm.AttachVolume(id, *spec.VMID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.acceptedVolume(id, w, r)
+}
+
+func (s *VMServer) detachVolume(id int, w http.ResponseWriter, r *http.Request) {
+	if _, err := s.vmm.DetachVolume(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.acceptedVolume(id, w, r)
+}
+
+// acceptedVolume replies to a successful attach or detach request on
+// volume id
+func (s *VMServer) acceptedVolume(id int, w http.ResponseWriter, r *http.Request) {
+	volume, _ := s.vmm.InspectVolume(id)
+	writeVolume(w, r, http.StatusAccepted, volume)
+}
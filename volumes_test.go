@@ -0,0 +1,170 @@
+// Copyright 2020 VMware, Inc.
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVolumes(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	if _, err := c.CreateVolume(Volume{Size: 10, Type: "tape"}); codeOf(t, err) != InvalidVolume {
+		t.Errorf("got: %v, want: %v", err, InvalidVolume)
+	}
+	volume, err := c.CreateVolume(Volume{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume.State != VolumeAvailable || volume.Type != VolumeTypes[0] {
+		t.Fatalf("got: %+v, want a %v %s volume", volume, VolumeAvailable, VolumeTypes[0])
+	}
+
+	if _, err := c.AttachVolume(volume.ID, BadID); codeOf(t, err) != VMNotFound {
+		t.Errorf("got: %v, want: %v", err, VMNotFound)
+	}
+	if _, err := c.AttachVolume(volume.ID, GoodID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.InspectVolume(volume.ID); got.State != VolumeAttaching || !got.attachedTo(GoodID) {
+		t.Fatalf("got: %+v, want it %v to VM %d", got, VolumeAttaching, GoodID)
+	}
+	if _, err := c.AttachVolume(volume.ID, 0); codeOf(t, err) != IllegalTransition {
+		t.Errorf("got: %v, want: %v", err, IllegalTransition)
+	}
+	c.ResolveTransitions()
+	if got, _ := c.InspectVolume(volume.ID); got.State != VolumeInUse {
+		t.Fatalf("got: %+v, want it %v", got, VolumeInUse)
+	}
+	if err := c.DeleteVolume(volume.ID); codeOf(t, err) != VolumeAttached {
+		t.Errorf("got: %v, want: %v", err, VolumeAttached)
+	}
+	if err := c.Delete(GoodID); codeOf(t, err) != VMHasVolumes {
+		t.Errorf("got: %v, want: %v", err, VMHasVolumes)
+	}
+
+	if _, err := c.DetachVolume(volume.ID); err != nil {
+		t.Fatal(err)
+	}
+	c.ResolveTransitions()
+	if got, _ := c.InspectVolume(volume.ID); got.State != VolumeAvailable || got.VMID != nil {
+		t.Fatalf("got: %+v, want it %v", got, VolumeAvailable)
+	}
+	if _, err := c.DetachVolume(volume.ID); codeOf(t, err) != IllegalTransition {
+		t.Errorf("got: %v, want: %v", err, IllegalTransition)
+	}
+
+	size := 5
+	if _, err := c.UpdateVolume(volume.ID, nil, &size); codeOf(t, err) != InvalidVolume {
+		t.Errorf("got: %v, want: %v", err, InvalidVolume)
+	}
+	size = 20
+	if got, err := c.UpdateVolume(volume.ID, nil, &size); err != nil || got.Size != size {
+		t.Errorf("got: %+v %v, want size %d", got, err, size)
+	}
+	if err := c.DeleteVolume(volume.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.InspectVolume(volume.ID); codeOf(t, err) != VolumeNotFound {
+		t.Errorf("got: %v, want: %v", err, VolumeNotFound)
+	}
+	if got, _ := c.CreateVolume(Volume{Size: 10}); got.ID == volume.ID {
+		t.Errorf("got id: %d, want the deleted id not reused", got.ID)
+	}
+	if state := c.State(); state.LastVolumeID != volume.ID+1 {
+		t.Errorf("got last id: %d, want: %d", state.LastVolumeID, volume.ID+1)
+	}
+}
+
+func TestForceDelete(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	volume, _ := c.CreateVolume(Volume{Size: 10})
+	c.AttachVolume(volume.ID, GoodID)
+	if err := c.ForceDelete(GoodID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.InspectVolume(volume.ID); got.State != VolumeAvailable || got.VMID != nil {
+		t.Errorf("got: %+v, want it detached from the deleted VM", got)
+	}
+	c.ResolveTransitions() // the attachment no longer completes
+	if got, _ := c.InspectVolume(volume.ID); got.State != VolumeAvailable {
+		t.Errorf("got: %+v, want it %v", got, VolumeAvailable)
+	}
+}
+
+func TestResumeVolumes(t *testing.T) {
+	defer slowTime()()
+	c := NewDefaultCloud()
+	volume, _ := c.CreateVolume(Volume{Size: 10})
+	c.AttachVolume(volume.ID, GoodID)
+	state := c.State()
+	if len(state.Volumes) != 1 || state.Volumes[0].State != VolumeAttaching {
+		t.Fatalf("got: %+v, want the volume %v", state.Volumes, VolumeAttaching)
+	}
+
+	resumed := NewDefaultCloud()
+	resumed.LoadVolumes(state.Volumes, state.LastVolumeID)
+	resumed.Resume()
+	if got := resumed.ResolveTransitions(); got != 1 {
+		t.Fatalf("got %d transitions resolved, want 1", got)
+	}
+	if got, _ := resumed.InspectVolume(volume.ID); got.State != VolumeInUse {
+		t.Errorf("got: %+v, want it %v", got, VolumeInUse)
+	}
+	c.ResolveTransitions()
+}
+
+func TestVolumesAPI(t *testing.T) {
+	defer slowTime()()
+	s := NewDefaultServer()
+	r := httptest.NewRequest(http.MethodPost, "/v2/volumes", strings.NewReader(`{"name":"data","size":100,"type":"ssd"}`))
+	w := serveRequest(s, r)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/v2/volumes/1" {
+		t.Fatalf("got status: %d, Location: %q", w.Code, w.Header().Get("Location"))
+	}
+	r = httptest.NewRequest(http.MethodPost, "/volumes", strings.NewReader(`{"size":0}`))
+	if p := decodeProblem(t, serveRequest(s, r)); p.Code != InvalidVolume {
+		t.Errorf("got: %v, want: %v", p.Code, InvalidVolume)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/v2/volumes/1/attach", strings.NewReader(`{"vm_id":1}`))
+	var volume Volume
+	envelope := decodeEnvelope(t, serveRequest(s, r), &volume)
+	if volume.State != VolumeAttaching || envelope.Links["vm"] != "/v2/vms/1" {
+		t.Fatalf("got: %+v %v, want it %v to VM 1", volume, envelope.Links, VolumeAttaching)
+	}
+	s.vmm.ResolveTransitions()
+	if p := decodeProblem(t, serve(s, http.MethodDelete, "/vms/1")); p.Code != VMHasVolumes {
+		t.Errorf("got: %v, want: %v", p.Code, VMHasVolumes)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodDelete, "/volumes/1")); p.Code != VolumeAttached {
+		t.Errorf("got: %v, want: %v", p.Code, VolumeAttached)
+	}
+	if p := decodeProblem(t, serve(s, http.MethodDelete, "/vms/1?force=maybe")); p.Code != BadRequest {
+		t.Errorf("got: %v, want: %v", p.Code, BadRequest)
+	}
+	if w := serve(s, http.MethodDelete, "/vms/1?force=true"); w.Code != http.StatusOK {
+		t.Fatalf("got status: %d, want: %d", w.Code, http.StatusOK)
+	}
+
+	var volumes []Volume
+	decodeEnvelope(t, serve(s, http.MethodGet, "/v2/volumes"), &volumes)
+	if len(volumes) != 1 || volumes[0].State != VolumeAvailable {
+		t.Fatalf("got: %+v, want the volume %v", volumes, VolumeAvailable)
+	}
+	r = httptest.NewRequest(http.MethodPatch, "/volumes/1", strings.NewReader(`{"size":200}`))
+	if w := serveRequest(s, r); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"size":200`) {
+		t.Errorf("got: %d %s, want the volume grown", w.Code, w.Body.String())
+	}
+	if p := decodeProblem(t, serve(s, http.MethodGet, "/projects/team-a/volumes/1")); p.Code != ProjectNotFound {
+		t.Errorf("got: %v, want: %v", p.Code, ProjectNotFound)
+	}
+	if w := serve(s, http.MethodDelete, "/v2/volumes/1"); w.Code != http.StatusNoContent {
+		t.Errorf("got status: %d, want: %d", w.Code, http.StatusNoContent)
+	}
+}